@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+)
+
+// chunkSteps are what a command does to its posts, run chunk by chunk by
+// runChunks.
+type chunkSteps[T any] struct {
+	// describe is logged at debug level before a post is repaired.
+	describe string
+	// logger returns the logger of a post.
+	logger func(post T) *slog.Logger
+	// checkpoint is where a resumed run picks up once post is processed.
+	checkpoint func(post T) string
+	// repair repairs a post, and returns the state it left the post in,
+	// zero when there is nothing to verify, or why it is left unfixed.
+	repair func(ctx context.Context, post T) (PostState, *UnfixedPosts)
+	// endChunk, when set, finishes the posts repaired by a chunk, e.g. with
+	// their bulk OpenSearch update, and counts them done. It returns the
+	// states left to verify, with the posts it left unfixed.
+	endChunk func(ctx context.Context, chunk []T, states []PostState) ([]PostState, []UnfixedPosts)
+	// remaining, when set, lets the run start with a canary chunk, and sums
+	// up the impact of the posts left after it.
+	remaining func(rest []T) Impact
+	// summary, when set, shows the command's own totals ahead of the
+	// summary of the run.
+	summary func()
+}
+
+// runChunks runs steps on posts chunk by chunk, starting with the canary
+// posts when the run has some. After every chunk, the posts repaired are
+// verified, and the redirect map and the report are saved. It returns the
+// error the run ends with.
+func runChunks[T any](ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, posts []T, steps chunkSteps[T], osIndex string) error {
+	chunkSize, _ := strconv.Atoi(os.Getenv("POST_CHUNK_SIZE"))
+	canary, rest := []T(nil), posts
+	if steps.remaining != nil {
+		canary, rest = canarySplit(run, posts)
+	}
+	chunks := withCanary(canary, Chunk(rest, chunkSize))
+	chunkLength := len(chunks)
+	run.Log.Info("chunked posts", "stage", StageFetch, "chunk_size", chunkSize, "chunks", chunkLength, "canary_posts", len(canary))
+	unfixedPosts := []UnfixedPosts{}
+	processed := 0
+	checkpoint := ""
+
+	for i, chunk := range chunks {
+		if run.Err(ctx) != nil {
+			break
+		}
+		inCanary := i == 0 && len(canary) > 0
+		run.Log.Info("running chunk", "chunk", i+1, "chunks", chunkLength, "canary", inCanary)
+		metrics.SetChunk(i+1, chunkLength)
+		states := []PostState{}
+		chunkUnfixed := []UnfixedPosts{}
+
+		for i, post := range chunk {
+			if run.Err(ctx) != nil {
+				break
+			}
+			steps.logger(post).Debug(steps.describe, "position", i+1, "chunk_posts", len(chunk))
+
+			postCtx, cancel := run.PostContext(ctx)
+			state, unfixed := steps.repair(postCtx, post)
+			cancel()
+			if unfixed != nil {
+				chunkUnfixed = append(chunkUnfixed, *unfixed)
+				run.postsDone(StageRepair, 0, *unfixed)
+			} else {
+				if state.ID != "" {
+					states = append(states, state)
+				}
+				if steps.endChunk == nil {
+					run.postsDone(StageRepair, 1)
+				}
+			}
+			processed++
+			// A random canary is out of order, so it does not move the
+			// checkpoint.
+			if !inCanary || !run.CanaryRandom {
+				checkpoint = steps.checkpoint(post)
+			}
+		}
+
+		if steps.endChunk != nil {
+			var failed []UnfixedPosts
+			states, failed = steps.endChunk(ctx, chunk, states)
+			chunkUnfixed = append(chunkUnfixed, failed...)
+		}
+		unfixedPosts = append(unfixedPosts, chunkUnfixed...)
+
+		// A stopped run skips verification.
+		var canaryErr error
+		if inCanary && run.Err(ctx) == nil {
+			var failed []UnfixedPosts
+			failed, canaryErr = checkCanary(ctx, run, onecmsDB, onecmsOS, states, chunkUnfixed, len(canary), steps.remaining(rest), osIndex)
+			unfixedPosts = append(unfixedPosts, failed...)
+		} else if run.Err(ctx) == nil {
+			unfixedPosts = append(unfixedPosts, verifyChunk(ctx, run, onecmsDB, onecmsOS, states, osIndex)...)
+		}
+
+		if err := run.Redirects.Save(); err != nil {
+			return fmt.Errorf("failed saving redirect map: %w", err)
+		}
+
+		if err := run.Checkpoint(processed, len(posts), checkpoint, unfixedPosts); err != nil {
+			return fmt.Errorf("failed saving report: %w", err)
+		}
+
+		logThroughput(run)
+
+		if canaryErr != nil {
+			printSummary(run, unfixedPosts)
+			return canaryErr
+		}
+	}
+
+	if steps.summary != nil {
+		steps.summary()
+	}
+	printSummary(run, unfixedPosts)
+
+	if err := run.Err(ctx); err != nil {
+		return runStoppedError(err, processed, len(posts))
+	}
+
+	if len(unfixedPosts) > 0 {
+		return &UnfixedPostsError{Posts: unfixedPosts}
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseCommandArgs parses a command's flags even when they are mixed with its
+// positional arguments, e.g. "rebuild-url 2024-01-01 --dry-run 2024-01-31",
+// and returns the positional arguments in order.
+func parseCommandArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// takeGlobalFlag removes the flag name, given as "--name value" or
+// "--name=value" anywhere after the command, from args and returns the
+// remaining args with its value. The last occurrence wins.
+func takeGlobalFlag(args []string, name string) ([]string, string) {
+	remaining := []string{}
+	value := ""
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if i < 2 || !strings.HasPrefix(arg, "-") {
+			remaining = append(remaining, arg)
+			continue
+		}
+
+		flagName, flagValue, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if flagName != name {
+			remaining = append(remaining, arg)
+			continue
+		}
+
+		if !hasValue && i+1 < len(args) {
+			i++
+			flagValue = args[i]
+		}
+		value = flagValue
+	}
+
+	return remaining, value
+}
+
+// takeGlobalBoolFlag removes the boolean flag name, given as "--name" or
+// "--name=<bool>" anywhere after the command, from args and returns the
+// remaining args with its value.
+func takeGlobalBoolFlag(args []string, name string) ([]string, bool, error) {
+	remaining := []string{}
+	value := false
+
+	for i, arg := range args {
+		if i < 2 || !strings.HasPrefix(arg, "-") {
+			remaining = append(remaining, arg)
+			continue
+		}
+
+		flagName, flagValue, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if flagName != name {
+			remaining = append(remaining, arg)
+			continue
+		}
+
+		value = true
+		if hasValue {
+			var err error
+			if value, err = strconv.ParseBool(flagValue); err != nil {
+				return nil, false, fmt.Errorf("invalid --%s %q", name, flagValue)
+			}
+		}
+	}
+
+	return remaining, value, nil
+}
+
+// globalFlags are the flags taken from anywhere after the command name,
+// before the command parses its own.
+type globalFlags struct {
+	MetricsAddr  string
+	Operator     string
+	MaxChanges   string
+	Canary       string
+	AssumeYes    bool
+	CanaryRandom bool
+}
+
+// runArgs lists the flags changing what a run does, as given, so they are
+// recorded with its arguments.
+func (flags globalFlags) runArgs() []string {
+	args := []string{}
+	if flags.AssumeYes {
+		args = append(args, "--yes")
+	}
+	if flags.MaxChanges != "" {
+		args = append(args, "--max-changes="+flags.MaxChanges)
+	}
+	if flags.Canary != "" {
+		args = append(args, "--canary="+flags.Canary)
+	}
+	if flags.CanaryRandom {
+		args = append(args, "--canary-random")
+	}
+
+	return args
+}
+
+// runCommands make a run: they take a run lock and are recorded in
+// repair_runs.
+var runCommands = map[string]bool{
+	"fix-url":          true,
+	"fix-csc-popmama":  true,
+	"rebuild-url":      true,
+	"propagate-author": true,
+	"drain-outbox":     true,
+}
+
+// canaryCommands can start their run with a canary chunk.
+var canaryCommands = map[string]bool{"fix-url": true, "fix-csc-popmama": true}
+
+// runlessCommands only read the run history and locks, and never record a
+// run of their own.
+var runlessCommands = map[string]bool{"history": true, "locks": true}
+
+// takeGlobalFlags removes the global flags from args, the command line with
+// the program name, and returns the remaining args with the flags. Commands
+// without a run only take --metrics-addr, leaving the flags of a run to their
+// own flag set, e.g. the --operator filter of history. A canary given to a
+// command without canary support is an error.
+func takeGlobalFlags(args []string) ([]string, globalFlags, error) {
+	flags := globalFlags{}
+	args, flags.MetricsAddr = takeGlobalFlag(args, "metrics-addr")
+	if len(args) > 1 && runlessCommands[args[1]] {
+		return args, flags, nil
+	}
+
+	args, flags.Operator = takeGlobalFlag(args, "operator")
+	args, flags.MaxChanges = takeGlobalFlag(args, "max-changes")
+	args, flags.Canary = takeGlobalFlag(args, "canary")
+
+	var err error
+	if args, flags.AssumeYes, err = takeGlobalBoolFlag(args, "yes"); err != nil {
+		return nil, flags, err
+	}
+	if args, flags.CanaryRandom, err = takeGlobalBoolFlag(args, "canary-random"); err != nil {
+		return nil, flags, err
+	}
+	if (flags.Canary != "" || flags.CanaryRandom) && len(args) > 1 && !canaryCommands[args[1]] {
+		return nil, flags, fmt.Errorf("%s does not support --canary", args[1])
+	}
+
+	return args, flags, nil
+}
+
+// historyArgs are the arguments of the history command.
+type historyArgs struct {
+	ID     string
+	Post   string
+	Filter RunHistoryFilter
+}
+
+// parseHistoryArgs parses the arguments of history, given after its name.
+func parseHistoryArgs(args []string) (historyArgs, error) {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	limit := fs.Int("limit", 20, "number of runs to list")
+	command := fs.String("command", "", "only list runs of this command")
+	operator := fs.String("operator", "", "only list runs started by this operator")
+	post := fs.String("post", "", "show every repair of this post instead")
+	positional, err := parseCommandArgs(fs, args)
+	if err != nil {
+		return historyArgs{}, err
+	}
+
+	history := historyArgs{
+		Post:   *post,
+		Filter: RunHistoryFilter{Command: *command, Operator: *operator, Limit: *limit},
+	}
+	if len(positional) > 0 {
+		history.ID = positional[0]
+	}
+
+	return history, nil
+}
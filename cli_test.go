@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCommandArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		positional  []string
+		dryRun      bool
+		expectError bool
+	}{
+		{
+			name:       "Positional only",
+			args:       []string{"2024-01-01", "2024-01-31"},
+			positional: []string{"2024-01-01", "2024-01-31"},
+		},
+		{
+			name:       "Flag before positional",
+			args:       []string{"--dry-run", "2024-01-01", "2024-01-31"},
+			positional: []string{"2024-01-01", "2024-01-31"},
+			dryRun:     true,
+		},
+		{
+			name:       "Flag between positional",
+			args:       []string{"2024-01-01", "--dry-run", "2024-01-31"},
+			positional: []string{"2024-01-01", "2024-01-31"},
+			dryRun:     true,
+		},
+		{
+			name:        "Unknown flag",
+			args:        []string{"2024-01-01", "--unknown"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			dryRun := fs.Bool("dry-run", false, "")
+
+			positional, err := parseCommandArgs(fs, tt.args)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("parseCommandArgs() error = %v, expectError %v", err, tt.expectError)
+			}
+			if tt.expectError {
+				return
+			}
+			if !reflect.DeepEqual(positional, tt.positional) {
+				t.Errorf("parseCommandArgs() = %v, want %v", positional, tt.positional)
+			}
+			if *dryRun != tt.dryRun {
+				t.Errorf("parseCommandArgs() dry-run = %v, want %v", *dryRun, tt.dryRun)
+			}
+		})
+	}
+}
+
+func TestTakeGlobalFlag(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		remaining []string
+		value     string
+	}{
+		{
+			name:      "Absent",
+			args:      []string{"repair", "fix-url", "2024-01-01", "2024-01-31"},
+			remaining: []string{"repair", "fix-url", "2024-01-01", "2024-01-31"},
+		},
+		{
+			name:      "Separate value",
+			args:      []string{"repair", "fix-url", "--metrics-addr", ":9090", "2024-01-01", "2024-01-31"},
+			remaining: []string{"repair", "fix-url", "2024-01-01", "2024-01-31"},
+			value:     ":9090",
+		},
+		{
+			name:      "Inline value next to other flags",
+			args:      []string{"repair", "rebuild-url", "2024-01-01", "--dry-run", "-metrics-addr=localhost:9090", "2024-01-31"},
+			remaining: []string{"repair", "rebuild-url", "2024-01-01", "--dry-run", "2024-01-31"},
+			value:     "localhost:9090",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remaining, value := takeGlobalFlag(tt.args, "metrics-addr")
+			if !reflect.DeepEqual(remaining, tt.remaining) || value != tt.value {
+				t.Errorf("takeGlobalFlag() = %v, %q, want %v, %q", remaining, value, tt.remaining, tt.value)
+			}
+		})
+	}
+}
+
+func TestTakeGlobalBoolFlag(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		remaining   []string
+		value       bool
+		expectError bool
+	}{
+		{
+			name:      "Absent",
+			args:      []string{"repair", "fix-url", "2024-01-01", "2024-01-31"},
+			remaining: []string{"repair", "fix-url", "2024-01-01", "2024-01-31"},
+		},
+		{
+			name:      "Present",
+			args:      []string{"repair", "fix-url", "--yes", "2024-01-01", "2024-01-31"},
+			remaining: []string{"repair", "fix-url", "2024-01-01", "2024-01-31"},
+			value:     true,
+		},
+		{
+			name:      "Inline value",
+			args:      []string{"repair", "rebuild-url", "2024-01-01", "--dry-run", "-yes=false", "2024-01-31"},
+			remaining: []string{"repair", "rebuild-url", "2024-01-01", "--dry-run", "2024-01-31"},
+		},
+		{
+			name:        "Invalid value",
+			args:        []string{"repair", "fix-url", "--yes=maybe"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remaining, value, err := takeGlobalBoolFlag(tt.args, "yes")
+			if (err != nil) != tt.expectError {
+				t.Fatalf("takeGlobalBoolFlag() error = %v, expectError %v", err, tt.expectError)
+			}
+			if tt.expectError {
+				return
+			}
+			if !reflect.DeepEqual(remaining, tt.remaining) || value != tt.value {
+				t.Errorf("takeGlobalBoolFlag() = %v, %v, want %v, %v", remaining, value, tt.remaining, tt.value)
+			}
+		})
+	}
+}
+
+func TestTakeGlobalFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		remaining []string
+		flags     globalFlags
+		runArgs   []string
+	}{
+		{
+			name:      "Run flags of a repair",
+			args:      []string{"repair", "fix-url", "--operator", "alice", "2024-01-01", "--yes", "--canary=5", "--max-changes", "100", "2024-01-31"},
+			remaining: []string{"repair", "fix-url", "2024-01-01", "2024-01-31"},
+			flags:     globalFlags{Operator: "alice", MaxChanges: "100", Canary: "5", AssumeYes: true},
+			runArgs:   []string{"--yes", "--max-changes=100", "--canary=5"},
+		},
+		{
+			name:      "History keeps its own operator filter",
+			args:      []string{"repair", "history", "--operator", "alice", "--metrics-addr", ":9090", "--limit", "5"},
+			remaining: []string{"repair", "history", "--operator", "alice", "--limit", "5"},
+			flags:     globalFlags{MetricsAddr: ":9090"},
+			runArgs:   []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remaining, flags, err := takeGlobalFlags(tt.args)
+			if err != nil {
+				t.Fatalf("takeGlobalFlags() error = %v", err)
+			}
+			if !reflect.DeepEqual(remaining, tt.remaining) || flags != tt.flags {
+				t.Errorf("takeGlobalFlags() = %v, %+v, want %v, %+v", remaining, flags, tt.remaining, tt.flags)
+			}
+			if runArgs := flags.runArgs(); !reflect.DeepEqual(runArgs, tt.runArgs) {
+				t.Errorf("runArgs() = %v, want %v", runArgs, tt.runArgs)
+			}
+		})
+	}
+}
+
+func TestTakeGlobalFlagsCanaryUnsupported(t *testing.T) {
+	for _, args := range [][]string{
+		{"repair", "rebuild-url", "2024-01-01", "2024-01-31", "--canary", "5"},
+		{"repair", "propagate-author", "author-1", "--canary-random"},
+		{"repair", "drain-outbox", "--canary=1"},
+	} {
+		if _, _, err := takeGlobalFlags(args); err == nil || !strings.Contains(err.Error(), "--canary") {
+			t.Errorf("takeGlobalFlags(%v) error = %v, expected --canary to be rejected", args, err)
+		}
+	}
+}
+
+func TestParseHistoryArgs(t *testing.T) {
+	args, _, err := takeGlobalFlags([]string{"repair", "history", "--operator", "alice", "--command=fix-url", "--limit", "5"})
+	if err != nil {
+		t.Fatalf("takeGlobalFlags() error = %v", err)
+	}
+
+	history, err := parseHistoryArgs(args[2:])
+	if err != nil {
+		t.Fatalf("parseHistoryArgs() error = %v", err)
+	}
+
+	expected := historyArgs{Filter: RunHistoryFilter{Command: "fix-url", Operator: "alice", Limit: 5}}
+	if !reflect.DeepEqual(history, expected) {
+		t.Errorf("parseHistoryArgs() = %+v, want %+v", history, expected)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// impactSampleSize is how many posts the impact of a run shows with
+	// their URL before and after.
+	impactSampleSize = 5
+	// impactSampleAttempts bounds how many posts are looked at to find the
+	// sample, since posts whose URL is kept are left out of it.
+	impactSampleAttempts = 4 * impactSampleSize
+)
+
+// ErrNotConfirmed is returned by a run whose impact was not confirmed, before
+// any change.
+var ErrNotConfirmed = errors.New("run not confirmed")
+
+// TooManyChangesError is returned by a run selecting more posts than its
+// MaxChanges cap, before any change.
+type TooManyChangesError struct {
+	Posts      int
+	MaxChanges int
+}
+
+func (e *TooManyChangesError) Error() string {
+	return fmt.Sprintf("run would change %d posts, more than the cap of %d", e.Posts, e.MaxChanges)
+}
+
+// isAborted reports whether err stopped the run before its first change.
+func isAborted(err error) bool {
+	var tooMany *TooManyChangesError
+
+	return errors.Is(err, ErrNotConfirmed) || errors.As(err, &tooMany)
+}
+
+// URLChange is a post with its URL and the one a run would give it.
+type URLChange struct {
+	PostID string
+	OldURL string
+	NewURL string
+}
+
+// Impact sums up the posts a run is about to change: how many, of which
+// publishers and created between From and To, zero when not known, with a
+// sample of their URL changes.
+type Impact struct {
+	Command    string
+	Posts      int
+	Publishers []string
+	From       time.Time
+	To         time.Time
+	Samples    []URLChange
+}
+
+// newImpact sums up the impact of a run changing posts.
+func newImpact(run *Run, posts []Post) Impact {
+	impact := Impact{Command: run.Command, Posts: len(posts), Publishers: []string{}, Samples: []URLChange{}}
+
+	publishers := map[string]bool{}
+	for _, post := range posts {
+		if !publishers[post.Publisher] {
+			publishers[post.Publisher] = true
+			impact.Publishers = append(impact.Publishers, post.Publisher)
+		}
+
+		if post.CreatedAt.IsZero() {
+			continue
+		}
+		if impact.From.IsZero() || post.CreatedAt.Before(impact.From) {
+			impact.From = post.CreatedAt
+		}
+		if post.CreatedAt.After(impact.To) {
+			impact.To = post.CreatedAt
+		}
+	}
+	sort.Strings(impact.Publishers)
+
+	return impact
+}
+
+// sample adds the URL changes of the first posts to the impact, newURL giving
+// the URL each post would get. Posts newURL fails for or leaves unchanged are
+// left out.
+func (impact *Impact) sample(ctx context.Context, posts []Post, newURL func(ctx context.Context, post Post) (string, error)) {
+	for i, post := range posts {
+		if i >= impactSampleAttempts || len(impact.Samples) >= impactSampleSize {
+			return
+		}
+
+		url, err := newURL(ctx, post)
+		if err != nil || url == post.FullURL {
+			continue
+		}
+		impact.Samples = append(impact.Samples, URLChange{PostID: post.ID, OldURL: post.FullURL, NewURL: url})
+	}
+}
+
+func (impact Impact) write(w io.Writer) {
+	fmt.Fprintf(w, "\n⚠️  %s is about to change %d posts", impact.Command, impact.Posts)
+	if len(impact.Publishers) > 0 {
+		fmt.Fprintf(w, " of %d publishers (%s)", len(impact.Publishers), strings.Join(impact.Publishers, ", "))
+	}
+	if !impact.From.IsZero() {
+		fmt.Fprintf(w, " created from %s to %s", impact.From.Format(time.DateOnly), impact.To.Format(time.DateOnly))
+	}
+	fmt.Fprintln(w)
+
+	for _, change := range impact.Samples {
+		fmt.Fprintf(w, "   %s: %s → %s\n", change.PostID, change.OldURL, change.NewURL)
+	}
+}
+
+// confirmImpact logs the impact of the run, checks it against the run's
+// MaxChanges cap and asks its Confirm to go ahead. It returns why the run
+// must not go ahead, nil when it can.
+func confirmImpact(run *Run, impact Impact) error {
+	run.Log.Info("run impact", "stage", StageFetch, "posts", impact.Posts, "publishers", impact.Publishers, "from", impact.From, "to", impact.To)
+
+	if run.MaxChanges > 0 && impact.Posts > run.MaxChanges {
+		return &TooManyChangesError{Posts: impact.Posts, MaxChanges: run.MaxChanges}
+	}
+
+	if impact.Posts == 0 || run.Confirm == nil {
+		return nil
+	}
+	if !run.Confirm(impact) {
+		return ErrNotConfirmed
+	}
+
+	return nil
+}
+
+// PromptConfirm returns a Run.Confirm showing the impact on out and asking to
+// go ahead on in. Anything but y or yes, the end of in included, is a no, and
+// so is the run being stopped or ctx done while waiting for the answer.
+func PromptConfirm(ctx context.Context, stopped <-chan struct{}, in io.Reader, out io.Writer) func(impact Impact) bool {
+	reader := bufio.NewReader(in)
+
+	return func(impact Impact) bool {
+		impact.write(out)
+		fmt.Fprint(out, "Proceed? [y/N] ")
+
+		// Reading blocks until a line comes in, so it cannot be interrupted;
+		// the read is left behind when the run stops first.
+		answers := make(chan string, 1)
+		go func() {
+			answer, _ := reader.ReadString('\n')
+			answers <- answer
+		}()
+
+		select {
+		case answer := <-answers:
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "y", "yes":
+				return true
+			}
+		case <-stopped:
+		case <-ctx.Done():
+		}
+
+		fmt.Fprintln(out)
+		return false
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewImpact(t *testing.T) {
+	posts := []Post{
+		{ID: "1", Publisher: "popmama", CreatedAt: time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{ID: "2", Publisher: "idntimes", CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ID: "3", Publisher: "popmama", CreatedAt: time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)},
+	}
+
+	impact := newImpact(NewRun("fix-url"), posts)
+	if impact.Posts != 3 || !reflect.DeepEqual(impact.Publishers, []string{"idntimes", "popmama"}) {
+		t.Errorf("newImpact() = %+v, want 3 posts of idntimes and popmama", impact)
+	}
+	if !impact.From.Equal(posts[1].CreatedAt) || !impact.To.Equal(posts[2].CreatedAt) {
+		t.Errorf("newImpact() span = %s to %s, want 2024-01-01 to 2024-01-31", impact.From, impact.To)
+	}
+}
+
+func TestConfirmImpact(t *testing.T) {
+	impact := Impact{Command: "fix-url", Posts: 10}
+
+	run := NewRun("fix-url")
+	if err := confirmImpact(run, impact); err != nil {
+		t.Errorf("confirmImpact() error = %v without cap nor Confirm, want nil", err)
+	}
+
+	run.MaxChanges = 5
+	if err := confirmImpact(run, impact); !isAborted(err) {
+		t.Errorf("confirmImpact() error = %v above the cap, want an abort", err)
+	}
+
+	run.MaxChanges = 10
+	asked := false
+	run.Confirm = func(Impact) bool {
+		asked = true
+		return false
+	}
+	if err := confirmImpact(run, impact); err != ErrNotConfirmed || !asked {
+		t.Errorf("confirmImpact() error = %v, want ErrNotConfirmed once asked", err)
+	}
+
+	asked = false
+	if err := confirmImpact(run, Impact{Command: "fix-url"}); err != nil || asked {
+		t.Errorf("confirmImpact() asked to confirm a run changing nothing")
+	}
+}
+
+func TestPromptConfirm(t *testing.T) {
+	impact := Impact{
+		Command:    "fix-url",
+		Posts:      2,
+		Publishers: []string{"popmama"},
+		From:       time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		To:         time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC),
+		Samples:    []URLChange{{PostID: "1", OldURL: "https://example.com/a-oldkey-1", NewURL: "https://example.com/a-newkey-1"}},
+	}
+
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{input: "y\n", expected: true},
+		{input: " YES \n", expected: true},
+		{input: "n\n", expected: false},
+		{input: "\n", expected: false},
+		{input: "", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.TrimSpace(tt.input), func(t *testing.T) {
+			var out bytes.Buffer
+			if confirmed := PromptConfirm(context.Background(), nil, strings.NewReader(tt.input), &out)(impact); confirmed != tt.expected {
+				t.Errorf("PromptConfirm() = %v for %q, want %v", confirmed, tt.input, tt.expected)
+			}
+
+			for _, part := range []string{"change 2 posts", "1 publishers (popmama)", "from 2024-01-01 to 2024-01-31", "https://example.com/a-oldkey-1 → https://example.com/a-newkey-1", "Proceed?"} {
+				if !strings.Contains(out.String(), part) {
+					t.Errorf("PromptConfirm() showed %q, expected it to contain %q", out.String(), part)
+				}
+			}
+		})
+	}
+}
+
+func TestPromptConfirmStopped(t *testing.T) {
+	in, _ := io.Pipe()
+	stop := make(chan struct{})
+	confirm := PromptConfirm(context.Background(), stop, in, io.Discard)
+
+	confirmed := make(chan bool)
+	go func() { confirmed <- confirm(Impact{Command: "fix-url", Posts: 1}) }()
+	close(stop)
+
+	select {
+	case ok := <-confirmed:
+		if ok {
+			t.Errorf("PromptConfirm() = true once the run stopped, want false")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("PromptConfirm() still waits for an answer once the run stopped")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if PromptConfirm(ctx, nil, in, io.Discard)(Impact{Command: "fix-url", Posts: 1}) {
+		t.Errorf("PromptConfirm() = true once ctx is done, want false")
+	}
+}
@@ -3,11 +3,15 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 func GetDBConnection(DSN string) (*sqlx.DB, error) {
@@ -18,36 +22,60 @@ func GetDBConnection(DSN string) (*sqlx.DB, error) {
 		return nil, fmt.Errorf("Database ping failed with error: %s", err.Error())
 	}
 
-	fmt.Println("✅ Database is connected successfully!")
+	slog.Info("connected to database")
 
 	return sqlx.NewDb(db, "postgres"), err
 }
 
+// ErrPostChanged is returned by a conditional update whose post no longer
+// holds the values it was read with.
+var ErrPostChanged = errors.New("post changed since it was read")
+
 type OneCMSDB interface {
 	BeginTx(ctx context.Context) (*sql.Tx, error)
 	Commit(ctx context.Context, tx *sql.Tx) error
 	Rollback(ctx context.Context, tx *sql.Tx) error
 	GetPostsByCreatedAt(ctx context.Context, startAt, endat string) ([]Post, error)
+	GetPostsWithCategoryByCreatedAt(ctx context.Context, startAt, endAt string) ([]Post, error)
 	GetBrokenPopmamaArticleCSC(ctx context.Context) ([]BrokenPopmamaArticleCSC, error)
 	GetAuthorKeyByPostID(ctx context.Context, postID string) (string, error)
-	UpdateArticleURLByID(ctx context.Context, postID, fixedURL string) error
+	UpdateArticleURLByID(ctx context.Context, transactionDB *sql.Tx, postID, oldURL, fixedURL string) (int64, error)
+	GetPostForUpdate(ctx context.Context, transactionDB *sql.Tx, postID string) (*Post, error)
+	GetPostsByIDs(ctx context.Context, postIDs []string) ([]Post, error)
 	GetPostByOldIDAndPublisher(ctx context.Context, oldID, publisher string) (*Post, error)
-	UpdateBrokenPopmamaArticleCSC(ctx context.Context, transactionDB *sql.Tx, postID string, post Post) error
-	SetPostAuthor(ctx context.Context, transactionDB *sql.Tx, postID string, authorID string, orderNumber int) error
-	FlushPostAuthors(ctx context.Context, transactionDB *sql.Tx, postID string) error
+	UpdateBrokenPopmamaArticleCSC(ctx context.Context, transactionDB *sql.Tx, postID string, post Post) (int64, error)
+	SetPostAuthor(ctx context.Context, transactionDB *sql.Tx, postID string, authorID string, orderNumber int) (int64, error)
+	FlushPostAuthors(ctx context.Context, transactionDB *sql.Tx, postID string) (int64, error)
+	GetPostsByAuthorID(ctx context.Context, authorID string) ([]AuthorPost, error)
+	SaveRedirect(ctx context.Context, transactionDB *sql.Tx, table string, redirect PostRedirect) (int64, error)
+	SaveAudit(ctx context.Context, transactionDB *sql.Tx, audit PostAudit) (int64, error)
+	GetPostIDByURL(ctx context.Context, publisher, fullURL, excludePostID string) (string, error)
+	GetPostAuthorIDs(ctx context.Context, transactionDB *sql.Tx, postID string) ([]string, error)
+	GetPostsAuthorIDs(ctx context.Context, postIDs []string) (map[string][]string, error)
+	EnqueueOSUpdate(ctx context.Context, transactionDB *sql.Tx, entry OSOutboxEntry) (int64, error)
+	GetPendingOSUpdates(ctx context.Context, afterID int64, limit int) ([]OSOutboxEntry, error)
+	MarkOSUpdateDone(ctx context.Context, id int64) (int64, error)
+	MarkOSUpdateFailed(ctx context.Context, id int64, lastError string, nextAttemptAt time.Time) (int64, error)
 }
 
 type oneCMSDB struct {
-	dbClient sqlx.DB
+	dbClient    sqlx.DB
+	callTimeout time.Duration
 }
 
-func NewOneCMSDB(client sqlx.DB) OneCMSDB {
+// NewOneCMSDB returns a Postgres client whose statements are each bounded by
+// callTimeout, zero meaning no limit. Transactions live as long as the
+// context given to BeginTx.
+func NewOneCMSDB(client sqlx.DB, callTimeout time.Duration) OneCMSDB {
 	return &oneCMSDB{
-		dbClient: client,
+		dbClient:    client,
+		callTimeout: callTimeout,
 	}
 }
 
 func (oneDB *oneCMSDB) BeginTx(ctx context.Context) (*sql.Tx, error) {
+	defer metrics.observeCall("postgres", "BeginTx", time.Now())
+
 	tx, err := oneDB.dbClient.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
@@ -57,6 +85,8 @@ func (oneDB *oneCMSDB) BeginTx(ctx context.Context) (*sql.Tx, error) {
 }
 
 func (oneDB *oneCMSDB) Commit(ctx context.Context, tx *sql.Tx) error {
+	defer metrics.observeCall("postgres", "Commit", time.Now())
+
 	err := tx.Commit()
 	if err != nil {
 		return err
@@ -66,6 +96,8 @@ func (oneDB *oneCMSDB) Commit(ctx context.Context, tx *sql.Tx) error {
 }
 
 func (oneDB *oneCMSDB) Rollback(ctx context.Context, tx *sql.Tx) error {
+	defer metrics.observeCall("postgres", "Rollback", time.Now())
+
 	err := tx.Rollback()
 	if err != nil {
 		return err
@@ -75,19 +107,83 @@ func (oneDB *oneCMSDB) Rollback(ctx context.Context, tx *sql.Tx) error {
 }
 
 func (oneDB *oneCMSDB) GetPostsByCreatedAt(ctx context.Context, startAt, endAt string) ([]Post, error) {
+	defer metrics.observeCall("postgres", "GetPostsByCreatedAt", time.Now())
+
 	query := `			
 		SELECT 
 			p.id,
 			p.title,
 			p.full_url,			
 			p.key,
+			p.publisher,
+			p.created_at
+		FROM posts p		
+		WHERE p.created_at >= $1 
+			AND p.created_at <= $2
+		ORDER BY p.created_at
+	`
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	rows, err := oneDB.dbClient.QueryContext(c, query, startAt, endAt)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []Post{}
+	for rows.Next() {
+		var post Post
+		err := rows.Scan(
+			&post.ID,
+			&post.Title,
+			&post.FullURL,
+			&post.Key,
+			&post.Publisher,
+			&post.CreatedAt,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, post)
+	}
+
+	return items, nil
+}
+
+// GetPostsWithCategoryByCreatedAt reads the posts created between startAt and
+// endAt like GetPostsByCreatedAt, with the full path of their category: the
+// slugs of its ancestors down to its own, e.g. "parenting/baby". Only
+// rebuild-url needs it, so the others do not depend on the categories table.
+func (oneDB *oneCMSDB) GetPostsWithCategoryByCreatedAt(ctx context.Context, startAt, endAt string) ([]Post, error) {
+	defer metrics.observeCall("postgres", "GetPostsWithCategoryByCreatedAt", time.Now())
+
+	query := `
+		WITH RECURSIVE category_paths AS (
+			SELECT id, slug::text AS path
+			FROM categories
+			WHERE parent_id IS NULL
+			UNION ALL
+			SELECT c.id, cp.path || '/' || c.slug
+			FROM categories c
+			JOIN category_paths cp ON cp.id = c.parent_id
+		)
+		SELECT 
+			p.id,
+			p.title,
+			p.full_url,			
+			p.key,
+			p.publisher,
+			COALESCE(cp.path, '') AS category_path,
 			p.created_at
 		FROM posts p		
+		LEFT JOIN category_paths cp ON cp.id = p.category_id
 		WHERE p.created_at >= $1 
 			AND p.created_at <= $2
 		ORDER BY p.created_at
 	`
-	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
 	defer cancel()
 
 	rows, err := oneDB.dbClient.QueryContext(c, query, startAt, endAt)
@@ -103,6 +199,8 @@ func (oneDB *oneCMSDB) GetPostsByCreatedAt(ctx context.Context, startAt, endAt s
 			&post.Title,
 			&post.FullURL,
 			&post.Key,
+			&post.Publisher,
+			&post.CategoryPath,
 			&post.CreatedAt,
 		)
 
@@ -117,6 +215,8 @@ func (oneDB *oneCMSDB) GetPostsByCreatedAt(ctx context.Context, startAt, endAt s
 }
 
 func (oneDB *oneCMSDB) GetAuthorKeyByPostID(ctx context.Context, postID string) (string, error) {
+	defer metrics.observeCall("postgres", "GetAuthorKeyByPostID", time.Now())
+
 	var authorKey string
 
 	query := `			
@@ -127,7 +227,7 @@ func (oneDB *oneCMSDB) GetAuthorKeyByPostID(ctx context.Context, postID string)
 		ORDER BY pa.order_number ASC
 		LIMIT 1
 	`
-	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
 	defer cancel()
 
 	err := oneDB.dbClient.GetContext(c, &authorKey, query, postID)
@@ -138,27 +238,93 @@ func (oneDB *oneCMSDB) GetAuthorKeyByPostID(ctx context.Context, postID string)
 	return authorKey, nil
 }
 
-func (oneDB *oneCMSDB) UpdateArticleURLByID(ctx context.Context, postID, fixedURL string) error {
+// UpdateArticleURLByID sets the URL of a post only while it still is oldURL,
+// and returns the number of rows updated: none when an editor changed it
+// since it was read.
+func (oneDB *oneCMSDB) UpdateArticleURLByID(ctx context.Context, transactionDB *sql.Tx, postID, oldURL, fixedURL string) (int64, error) {
+	defer metrics.observeCall("postgres", "UpdateArticleURLByID", time.Now())
+
 	query := `
 		UPDATE
 			posts
 		SET full_url = $1
-		WHERE id = $2
+		WHERE id = $2 AND full_url = $3
 	`
 
-	_, err := oneDB.dbClient.ExecContext(ctx, query, fixedURL, postID)
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
 
-	return err
+	return execInTx(c, transactionDB, query, fixedURL, postID, oldURL)
+}
+
+// GetPostForUpdate reads the URL and author of a post inside transactionDB
+// and locks its row until the transaction ends.
+func (oneDB *oneCMSDB) GetPostForUpdate(ctx context.Context, transactionDB *sql.Tx, postID string) (*Post, error) {
+	defer metrics.observeCall("postgres", "GetPostForUpdate", time.Now())
+
+	post := Post{ID: postID}
+
+	query := `
+		SELECT full_url, author_id FROM posts WHERE id = $1 FOR UPDATE
+	`
+
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	err := transactionDB.QueryRowContext(c, query, postID).Scan(&post.FullURL, &post.AuthorID)
+	if err != nil {
+		transactionDB.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrPostChanged
+		}
+		return nil, err
+	}
+
+	return &post, nil
+}
+
+// GetPostsByIDs reads the URL of the posts, outside of any transaction.
+// Posts not found are left out. Their authors are read from post_authors by
+// GetPostsAuthorIDs, since posts.author_id may be NULL.
+func (oneDB *oneCMSDB) GetPostsByIDs(ctx context.Context, postIDs []string) ([]Post, error) {
+	defer metrics.observeCall("postgres", "GetPostsByIDs", time.Now())
+
+	query := `
+		SELECT id, full_url FROM posts WHERE id = ANY($1)
+	`
+
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	rows, err := oneDB.dbClient.QueryContext(c, query, pq.Array(postIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Post{}
+	for rows.Next() {
+		var post Post
+		if err := rows.Scan(&post.ID, &post.FullURL); err != nil {
+			return nil, err
+		}
+
+		items = append(items, post)
+	}
+
+	return items, rows.Err()
 }
 
 func (oneDB *oneCMSDB) GetPostByOldIDAndPublisher(ctx context.Context, oldID, publisher string) (*Post, error) {
+	defer metrics.observeCall("postgres", "GetPostByOldIDAndPublisher", time.Now())
+
 	var post *Post
 
 	query := `
 		SELECT * FROM posts WHERE old_id = $1 AND publisher = $2
 	`
 
-	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
 	defer cancel()
 
 	err := oneDB.dbClient.GetContext(c, &post, query, oldID, publisher)
@@ -170,6 +336,8 @@ func (oneDB *oneCMSDB) GetPostByOldIDAndPublisher(ctx context.Context, oldID, pu
 }
 
 func (oneDB *oneCMSDB) GetBrokenPopmamaArticleCSC(ctx context.Context) ([]BrokenPopmamaArticleCSC, error) {
+	defer metrics.observeCall("postgres", "GetBrokenPopmamaArticleCSC", time.Now())
+
 	query := `
 		SELECT 
 			p.old_id,
@@ -180,7 +348,10 @@ func (oneDB *oneCMSDB) GetBrokenPopmamaArticleCSC(ctx context.Context) ([]Broken
 		FROM temp_popmama_csc
 	`
 
-	rows, err := oneDB.dbClient.QueryContext(ctx, query)
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	rows, err := oneDB.dbClient.QueryContext(c, query)
 	if err != nil {
 		return nil, err
 	}
@@ -206,25 +377,29 @@ func (oneDB *oneCMSDB) GetBrokenPopmamaArticleCSC(ctx context.Context) ([]Broken
 	return items, nil
 }
 
-func (oneDB *oneCMSDB) UpdateBrokenPopmamaArticleCSC(ctx context.Context, transactionDB *sql.Tx, postID string, post Post) error {
-	query := `
-		UPDATE
-			posts
-		SET 
-			full_url = $1,
-			author_id = $2
-		WHERE id = $3
-	`
-
-	_, err := transactionDB.ExecContext(ctx, query, post.FullURL, post.AuthorID, postID)
-	if err != nil {
-		transactionDB.Rollback()
-	}
+// updateBrokenPopmamaArticleCSCQuery writes the columns of a post changed by
+// a Popmama CSC repair, the ones popmamaPostChanges audits.
+const updateBrokenPopmamaArticleCSCQuery = `
+	UPDATE
+		posts
+	SET
+		full_url = $1,
+		author_id = $2
+	WHERE id = $3
+`
+
+func (oneDB *oneCMSDB) UpdateBrokenPopmamaArticleCSC(ctx context.Context, transactionDB *sql.Tx, postID string, post Post) (int64, error) {
+	defer metrics.observeCall("postgres", "UpdateBrokenPopmamaArticleCSC", time.Now())
+
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
 
-	return err
+	return execInTx(c, transactionDB, updateBrokenPopmamaArticleCSCQuery, post.FullURL, post.AuthorID, postID)
 }
 
-func (oneDB *oneCMSDB) SetPostAuthor(ctx context.Context, transactionDB *sql.Tx, postID string, authorID string, orderNumber int) error {
+func (oneDB *oneCMSDB) SetPostAuthor(ctx context.Context, transactionDB *sql.Tx, postID string, authorID string, orderNumber int) (int64, error) {
+	defer metrics.observeCall("postgres", "SetPostAuthor", time.Now())
+
 	postAuthorValues := []interface{}{postID, authorID, orderNumber}
 	postAuthorQuery := `INSERT INTO post_authors
 	(
@@ -234,23 +409,413 @@ func (oneDB *oneCMSDB) SetPostAuthor(ctx context.Context, transactionDB *sql.Tx,
 	)
 	VALUES ($1, $2, $3)`
 
-	if _, err := transactionDB.ExecContext(ctx, postAuthorQuery, postAuthorValues...); err != nil {
-		transactionDB.Rollback()
-		return err
-	}
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
 
-	return nil
+	return execInTx(c, transactionDB, postAuthorQuery, postAuthorValues...)
 }
 
-func (oneDB *oneCMSDB) FlushPostAuthors(ctx context.Context, transactionDB *sql.Tx, postID string) error {
+func (oneDB *oneCMSDB) FlushPostAuthors(ctx context.Context, transactionDB *sql.Tx, postID string) (int64, error) {
+	defer metrics.observeCall("postgres", "FlushPostAuthors", time.Now())
 
 	queryDel := `DELETE FROM post_authors
     	WHERE post_id = $1`
 
-	_, err := transactionDB.ExecContext(ctx, queryDel, postID)
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	return execInTx(c, transactionDB, queryDel, postID)
+}
+
+func (oneDB *oneCMSDB) GetPostsByAuthorID(ctx context.Context, authorID string) ([]AuthorPost, error) {
+	defer metrics.observeCall("postgres", "GetPostsByAuthorID", time.Now())
+
+	// The URL only carries the key of the first author, so flag the posts
+	// where this author has the lowest order number.
+	query := `
+		SELECT
+			p.id,
+			p.title,
+			p.full_url,
+			p.key,
+			p.publisher,
+			p.created_at,
+			pa.order_number = (
+				SELECT MIN(pa2.order_number)
+				FROM post_authors pa2
+				WHERE pa2.post_id = p.id
+			) AS is_primary_author
+		FROM post_authors pa
+		JOIN posts p ON p.id = pa.post_id
+		WHERE pa.author_id = $1
+		ORDER BY p.created_at
+	`
+
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	rows, err := oneDB.dbClient.QueryContext(c, query, authorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []AuthorPost{}
+	for rows.Next() {
+		var post AuthorPost
+		err := rows.Scan(
+			&post.ID,
+			&post.Title,
+			&post.FullURL,
+			&post.Key,
+			&post.Publisher,
+			&post.CreatedAt,
+			&post.IsPrimaryAuthor,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, post)
+	}
+
+	return items, rows.Err()
+}
+
+// SaveRedirect stores a redirect and collapses chains: rows pointing at the
+// old path now point at the new one, and a row redirecting the new path away
+// is dropped since that path is live again. It returns the number of rows
+// inserted.
+func (oneDB *oneCMSDB) SaveRedirect(ctx context.Context, transactionDB *sql.Tx, table string, redirect PostRedirect) (int64, error) {
+	defer metrics.observeCall("postgres", "SaveRedirect", time.Now())
+
+	queries := []struct {
+		query string
+		args  []interface{}
+	}{
+		{
+			query: fmt.Sprintf(`DELETE FROM %s WHERE old_path IN ($1, $2)`, table),
+			args:  []interface{}{redirect.OldPath, redirect.NewPath},
+		},
+		{
+			query: fmt.Sprintf(`UPDATE %s SET new_path = $1 WHERE new_path = $2`, table),
+			args:  []interface{}{redirect.NewPath, redirect.OldPath},
+		},
+		{
+			query: fmt.Sprintf(`INSERT INTO %s
+			(
+				old_path,
+				new_path,
+				status_code,
+				source_run_id
+			)
+			VALUES ($1, $2, $3, $4)`, table),
+			args: []interface{}{redirect.OldPath, redirect.NewPath, redirect.StatusCode, redirect.SourceRunID},
+		},
+	}
+
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	var rows int64
+	for _, q := range queries {
+		var err error
+		if rows, err = execInTx(c, transactionDB, q.query, q.args...); err != nil {
+			return 0, err
+		}
+	}
+
+	return rows, nil
+}
+
+// SaveAudit records the changes of a post in the repair_audit table, inside
+// the transaction of the change.
+func (oneDB *oneCMSDB) SaveAudit(ctx context.Context, transactionDB *sql.Tx, audit PostAudit) (int64, error) {
+	defer metrics.observeCall("postgres", "SaveAudit", time.Now())
+
+	changes, err := json.Marshal(audit.Changes)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		INSERT INTO repair_audit
+		(
+			post_id,
+			run_id,
+			changes
+		)
+		VALUES ($1, $2, $3)
+	`
+
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	return execInTx(c, transactionDB, query, audit.PostID, audit.RunID, string(changes))
+}
+
+// GetPostIDByURL returns the ID of another post of the publisher already
+// using fullURL, with or without a trailing slash, or "" when there is none.
+func (oneDB *oneCMSDB) GetPostIDByURL(ctx context.Context, publisher, fullURL, excludePostID string) (string, error) {
+	defer metrics.observeCall("postgres", "GetPostIDByURL", time.Now())
+
+	var postID string
+
+	query := `
+		SELECT id
+		FROM posts
+		WHERE publisher = $1
+		AND full_url IN ($2, $3)
+		AND id <> $4
+		LIMIT 1
+	`
+
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	err := oneDB.dbClient.GetContext(c, &postID, query, publisher, fullURL, fullURL+"/", excludePostID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return postID, nil
+}
+
+// GetPostAuthorIDs returns the author IDs of a post in order, locking its
+// post_authors rows until the end of the transaction.
+func (oneDB *oneCMSDB) GetPostAuthorIDs(ctx context.Context, transactionDB *sql.Tx, postID string) ([]string, error) {
+	defer metrics.observeCall("postgres", "GetPostAuthorIDs", time.Now())
+
+	query := `
+		SELECT author_id
+		FROM post_authors
+		WHERE post_id = $1
+		ORDER BY order_number ASC
+		FOR UPDATE
+	`
+
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	rows, err := transactionDB.QueryContext(c, query, postID)
+	if err != nil {
+		transactionDB.Rollback()
+		return nil, err
+	}
+	defer rows.Close()
+
+	authorIDs := []string{}
+	for rows.Next() {
+		var authorID string
+		if err := rows.Scan(&authorID); err != nil {
+			transactionDB.Rollback()
+			return nil, err
+		}
+		authorIDs = append(authorIDs, authorID)
+	}
+	if err := rows.Err(); err != nil {
+		transactionDB.Rollback()
+		return nil, err
+	}
+
+	return authorIDs, nil
+}
+
+// GetPostsAuthorIDs returns the author IDs of the posts in order, by post ID,
+// outside of any transaction. Posts without authors are left out.
+func (oneDB *oneCMSDB) GetPostsAuthorIDs(ctx context.Context, postIDs []string) (map[string][]string, error) {
+	defer metrics.observeCall("postgres", "GetPostsAuthorIDs", time.Now())
+
+	query := `
+		SELECT post_id, author_id
+		FROM post_authors
+		WHERE post_id = ANY($1)
+		ORDER BY post_id, order_number ASC
+	`
+
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	rows, err := oneDB.dbClient.QueryContext(c, query, pq.Array(postIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	authorIDs := map[string][]string{}
+	for rows.Next() {
+		var postID, authorID string
+		if err := rows.Scan(&postID, &authorID); err != nil {
+			return nil, err
+		}
+
+		authorIDs[postID] = append(authorIDs[postID], authorID)
+	}
+
+	return authorIDs, rows.Err()
+}
+
+// EnqueueOSUpdate stores an OpenSearch update in the os_outbox table, inside
+// transactionDB when given.
+func (oneDB *oneCMSDB) EnqueueOSUpdate(ctx context.Context, transactionDB *sql.Tx, entry OSOutboxEntry) (int64, error) {
+	defer metrics.observeCall("postgres", "EnqueueOSUpdate", time.Now())
+
+	query := `
+		INSERT INTO os_outbox
+		(
+			doc_id,
+			index_name,
+			payload,
+			run_id,
+			last_error
+		)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	args := []interface{}{entry.DocID, entry.Index, string(entry.Payload), entry.RunID, entry.LastError}
+
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	if transactionDB == nil {
+		result, err := oneDB.dbClient.ExecContext(c, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+	}
+
+	return execInTx(c, transactionDB, query, args...)
+}
+
+// GetPendingOSUpdates returns up to limit outbox entries not applied yet and
+// due for an attempt, with an ID above afterID. Entries queued after a failed
+// entry of the same document wait for it to be applied.
+func (oneDB *oneCMSDB) GetPendingOSUpdates(ctx context.Context, afterID int64, limit int) ([]OSOutboxEntry, error) {
+	defer metrics.observeCall("postgres", "GetPendingOSUpdates", time.Now())
+
+	query := `
+		SELECT
+			id,
+			doc_id,
+			index_name,
+			payload,
+			run_id,
+			attempts,
+			COALESCE(last_error, '')
+		FROM os_outbox o
+		WHERE done_at IS NULL
+			AND (next_attempt_at IS NULL OR next_attempt_at <= NOW())
+			AND id > $1
+			AND NOT EXISTS (
+				SELECT 1
+				FROM os_outbox earlier
+				WHERE earlier.doc_id = o.doc_id
+					AND earlier.index_name = o.index_name
+					AND earlier.id < o.id
+					AND earlier.done_at IS NULL
+					AND earlier.next_attempt_at > NOW()
+			)
+		ORDER BY id
+		LIMIT $2
+	`
+
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	rows, err := oneDB.dbClient.QueryContext(c, query, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []OSOutboxEntry{}
+	for rows.Next() {
+		var entry OSOutboxEntry
+		var payload []byte
+		err := rows.Scan(
+			&entry.ID,
+			&entry.DocID,
+			&entry.Index,
+			&payload,
+			&entry.RunID,
+			&entry.Attempts,
+			&entry.LastError,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entry.Payload = payload
+		items = append(items, entry)
+	}
+
+	return items, rows.Err()
+}
+
+func (oneDB *oneCMSDB) MarkOSUpdateDone(ctx context.Context, id int64) (int64, error) {
+	defer metrics.observeCall("postgres", "MarkOSUpdateDone", time.Now())
+
+	query := `
+		UPDATE os_outbox
+		SET
+			done_at = NOW(),
+			attempts = attempts + 1
+		WHERE id = $1
+	`
+
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	result, err := oneDB.dbClient.ExecContext(c, query, id)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (oneDB *oneCMSDB) MarkOSUpdateFailed(ctx context.Context, id int64, lastError string, nextAttemptAt time.Time) (int64, error) {
+	defer metrics.observeCall("postgres", "MarkOSUpdateFailed", time.Now())
+
+	query := `
+		UPDATE os_outbox
+		SET
+			attempts = attempts + 1,
+			last_error = $2,
+			next_attempt_at = $3
+		WHERE id = $1
+	`
+
+	c, cancel := withOptionalTimeout(ctx, oneDB.callTimeout)
+	defer cancel()
+
+	result, err := oneDB.dbClient.ExecContext(c, query, id, lastError, nextAttemptAt)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// execInTx runs a mutating statement in transactionDB and returns the number
+// of rows it affected. The transaction is rolled back when it fails.
+func execInTx(ctx context.Context, transactionDB *sql.Tx, query string, args ...interface{}) (int64, error) {
+	result, err := transactionDB.ExecContext(ctx, query, args...)
+	if err != nil {
+		transactionDB.Rollback()
+		return 0, err
+	}
+
+	rows, err := result.RowsAffected()
 	if err != nil {
 		transactionDB.Rollback()
+		return 0, err
 	}
 
-	return err
+	return rows, nil
 }
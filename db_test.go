@@ -3,9 +3,14 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"io"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/jmoiron/sqlx"
 )
 
 // MockDBTransaction is a mock for database transactions
@@ -39,11 +44,30 @@ type MockOneCMSDB struct {
 	AuthorKey              string
 	GetAuthorKeyErr        error
 	UpdateURLErr           error
+	TransientUpdateURLErrs []error
+	ChangedPostIDs         map[string]bool
+	AffectedRows           map[string]int64
 	Post                   *Post
+	LockedPost             *Post
 	GetPostErr             error
 	BrokenPosts            []BrokenPopmamaArticleCSC
 	GetBrokenPostsErr      error
 	UpdateBrokenPostErr    error
+	AuthorPosts            []AuthorPost
+	GetAuthorPostsErr      error
+	UpdatedURLs            map[string]string
+	SavedRedirects         []PostRedirect
+	SaveRedirectErr        error
+	SavedAudits            []PostAudit
+	SaveAuditErr           error
+	GetPostsByIDsErr       error
+	PostIDsByURL           map[string]string
+	GetPostIDByURLErr      error
+	PostAuthorIDs          []string
+	Outbox                 []OSOutboxEntry
+	OutboxDone             map[int64]bool
+	OutboxNextAttempt      map[int64]time.Time
+	EnqueueErr             error
 }
 
 func (m *MockOneCMSDB) BeginTx(ctx context.Context) (*sql.Tx, error) {
@@ -81,6 +105,10 @@ func (m *MockOneCMSDB) GetPostsByCreatedAt(ctx context.Context, startAt, endAt s
 	return m.PostsByCreatedAt, m.GetPostsByCreatedAtErr
 }
 
+func (m *MockOneCMSDB) GetPostsWithCategoryByCreatedAt(ctx context.Context, startAt, endAt string) ([]Post, error) {
+	return m.PostsByCreatedAt, m.GetPostsByCreatedAtErr
+}
+
 func (m *MockOneCMSDB) GetBrokenPopmamaArticleCSC(ctx context.Context) ([]BrokenPopmamaArticleCSC, error) {
 	return m.BrokenPosts, m.GetBrokenPostsErr
 }
@@ -89,24 +117,120 @@ func (m *MockOneCMSDB) GetAuthorKeyByPostID(ctx context.Context, postID string)
 	return m.AuthorKey, m.GetAuthorKeyErr
 }
 
-func (m *MockOneCMSDB) UpdateArticleURLByID(ctx context.Context, postID, fixedURL string) error {
-	return m.UpdateURLErr
+func (m *MockOneCMSDB) UpdateArticleURLByID(ctx context.Context, transactionDB *sql.Tx, postID, oldURL, fixedURL string) (int64, error) {
+	if rows, ok := m.AffectedRows["UpdateArticleURLByID"]; ok {
+		return rows, nil
+	}
+	if m.ChangedPostIDs[postID] {
+		return 0, nil
+	}
+	if current, ok := m.UpdatedURLs[postID]; ok && current != oldURL {
+		return 0, nil
+	}
+	if len(m.TransientUpdateURLErrs) > 0 {
+		err := m.TransientUpdateURLErrs[0]
+		m.TransientUpdateURLErrs = m.TransientUpdateURLErrs[1:]
+		return 0, err
+	}
+	if m.UpdateURLErr != nil {
+		return 0, m.UpdateURLErr
+	}
+	if m.UpdatedURLs == nil {
+		m.UpdatedURLs = map[string]string{}
+	}
+	m.UpdatedURLs[postID] = fixedURL
+	return 1, nil
+}
+
+func (m *MockOneCMSDB) SaveAudit(ctx context.Context, transactionDB *sql.Tx, audit PostAudit) (int64, error) {
+	if m.SaveAuditErr != nil {
+		return 0, m.SaveAuditErr
+	}
+	m.SavedAudits = append(m.SavedAudits, audit)
+	return 1, nil
+}
+
+func (m *MockOneCMSDB) SaveRedirect(ctx context.Context, transactionDB *sql.Tx, table string, redirect PostRedirect) (int64, error) {
+	if m.SaveRedirectErr != nil {
+		return 0, m.SaveRedirectErr
+	}
+	m.SavedRedirects = append(m.SavedRedirects, redirect)
+	return 1, nil
+}
+
+func (m *MockOneCMSDB) GetPostIDByURL(ctx context.Context, publisher, fullURL, excludePostID string) (string, error) {
+	if m.GetPostIDByURLErr != nil {
+		return "", m.GetPostIDByURLErr
+	}
+	if postID, ok := m.PostIDsByURL[fullURL]; ok && postID != excludePostID {
+		return postID, nil
+	}
+	for postID, url := range m.UpdatedURLs {
+		if url == fullURL && postID != excludePostID {
+			return postID, nil
+		}
+	}
+	return "", nil
+}
+
+func (m *MockOneCMSDB) GetPostsByAuthorID(ctx context.Context, authorID string) ([]AuthorPost, error) {
+	return m.AuthorPosts, m.GetAuthorPostsErr
 }
 
 func (m *MockOneCMSDB) GetPostByOldIDAndPublisher(ctx context.Context, oldID, publisher string) (*Post, error) {
 	return m.Post, m.GetPostErr
 }
 
-func (m *MockOneCMSDB) UpdateBrokenPopmamaArticleCSC(ctx context.Context, transactionDB *sql.Tx, postID string, post Post) error {
-	return m.UpdateBrokenPostErr
+func (m *MockOneCMSDB) GetPostsByIDs(ctx context.Context, postIDs []string) ([]Post, error) {
+	if m.GetPostsByIDsErr != nil {
+		return nil, m.GetPostsByIDsErr
+	}
+	posts := []Post{}
+	for _, postID := range postIDs {
+		if m.Post != nil && m.Post.ID == postID {
+			posts = append(posts, *m.Post)
+		} else if url, ok := m.UpdatedURLs[postID]; ok {
+			posts = append(posts, Post{ID: postID, FullURL: url})
+		}
+	}
+	return posts, nil
 }
 
-func (m *MockOneCMSDB) FlushPostAuthors(ctx context.Context, transactionDB *sql.Tx, postID string) error {
-	return nil
+func (m *MockOneCMSDB) GetPostForUpdate(ctx context.Context, transactionDB *sql.Tx, postID string) (*Post, error) {
+	if m.LockedPost != nil {
+		return m.LockedPost, nil
+	}
+	if m.Post == nil {
+		return nil, ErrPostChanged
+	}
+	post := *m.Post
+	return &post, nil
 }
 
-func (m *MockOneCMSDB) SetPostAuthor(ctx context.Context, transactionDB *sql.Tx, postID string, authorID string, orderNumber int) error {
-	return nil
+func (m *MockOneCMSDB) UpdateBrokenPopmamaArticleCSC(ctx context.Context, transactionDB *sql.Tx, postID string, post Post) (int64, error) {
+	if m.UpdateBrokenPostErr != nil {
+		return 0, m.UpdateBrokenPostErr
+	}
+	if rows, ok := m.AffectedRows["UpdateBrokenPopmamaArticleCSC"]; ok {
+		return rows, nil
+	}
+	if m.Post == nil || m.Post.ID != postID {
+		return 0, nil
+	}
+	m.Post.FullURL = post.FullURL
+	m.Post.AuthorID = post.AuthorID
+	return 1, nil
+}
+
+func (m *MockOneCMSDB) FlushPostAuthors(ctx context.Context, transactionDB *sql.Tx, postID string) (int64, error) {
+	rows := int64(len(m.PostAuthorIDs))
+	m.PostAuthorIDs = nil
+	return rows, nil
+}
+
+func (m *MockOneCMSDB) SetPostAuthor(ctx context.Context, transactionDB *sql.Tx, postID string, authorID string, orderNumber int) (int64, error) {
+	m.PostAuthorIDs = append(m.PostAuthorIDs, authorID)
+	return 1, nil
 }
 
 // Test BeginTx, Commit, and Rollback
@@ -245,9 +369,9 @@ func TestUpdateArticleURLByID(t *testing.T) {
 	t.Run("Successfully update URL", func(t *testing.T) {
 		mockDB := &MockOneCMSDB{}
 
-		err := mockDB.UpdateArticleURLByID(ctx, "1", "https://example.com/new-url")
-		if err != nil {
-			t.Errorf("UpdateArticleURLByID() error = %v, expected nil", err)
+		rows, err := mockDB.UpdateArticleURLByID(ctx, nil, "1", "https://example.com/old-url", "https://example.com/new-url")
+		if err != nil || rows != 1 {
+			t.Errorf("UpdateArticleURLByID() = %d, %v, expected 1 row", rows, err)
 		}
 	})
 
@@ -256,11 +380,22 @@ func TestUpdateArticleURLByID(t *testing.T) {
 			UpdateURLErr: errors.New("database error"),
 		}
 
-		err := mockDB.UpdateArticleURLByID(ctx, "1", "https://example.com/new-url")
+		_, err := mockDB.UpdateArticleURLByID(ctx, nil, "1", "https://example.com/old-url", "https://example.com/new-url")
 		if err == nil {
 			t.Errorf("UpdateArticleURLByID() expected error, got nil")
 		}
 	})
+
+	t.Run("Post changed since it was read", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			UpdatedURLs: map[string]string{"1": "https://example.com/edited-url"},
+		}
+
+		rows, err := mockDB.UpdateArticleURLByID(ctx, nil, "1", "https://example.com/old-url", "https://example.com/new-url")
+		if err != nil || rows != 0 {
+			t.Errorf("UpdateArticleURLByID() = %d, %v, expected no row", rows, err)
+		}
+	})
 }
 
 // Test GetPostByOldIDAndPublisher
@@ -348,7 +483,7 @@ func TestUpdateBrokenPopmamaArticleCSC(t *testing.T) {
 	ctx := context.Background()
 
 	t.Run("Successfully update broken post", func(t *testing.T) {
-		mockDB := &MockOneCMSDB{}
+		mockDB := &MockOneCMSDB{Post: &Post{ID: "1"}}
 
 		post := Post{
 			ID:      "1",
@@ -357,9 +492,18 @@ func TestUpdateBrokenPopmamaArticleCSC(t *testing.T) {
 			Key:     "test-key",
 		}
 
-		err := mockDB.UpdateBrokenPopmamaArticleCSC(ctx, nil, "old-1", post)
-		if err != nil {
-			t.Errorf("UpdateBrokenPopmamaArticleCSC() error = %v, expected nil", err)
+		rows, err := mockDB.UpdateBrokenPopmamaArticleCSC(ctx, nil, "1", post)
+		if err != nil || rows != 1 {
+			t.Errorf("UpdateBrokenPopmamaArticleCSC() = %d, %v, expected 1 row", rows, err)
+		}
+	})
+
+	t.Run("No post with this ID", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{Post: &Post{ID: "1"}}
+
+		rows, err := mockDB.UpdateBrokenPopmamaArticleCSC(ctx, nil, "old-1", Post{ID: "1"})
+		if err != nil || rows != 0 {
+			t.Errorf("UpdateBrokenPopmamaArticleCSC() = %d, %v, expected no row", rows, err)
 		}
 	})
 
@@ -375,9 +519,170 @@ func TestUpdateBrokenPopmamaArticleCSC(t *testing.T) {
 			Key:     "test-key",
 		}
 
-		err := mockDB.UpdateBrokenPopmamaArticleCSC(ctx, nil, "old-1", post)
+		_, err := mockDB.UpdateBrokenPopmamaArticleCSC(ctx, nil, "1", post)
 		if err == nil {
 			t.Errorf("UpdateBrokenPopmamaArticleCSC() expected error, got nil")
 		}
 	})
 }
+
+func (m *MockOneCMSDB) GetPostAuthorIDs(ctx context.Context, transactionDB *sql.Tx, postID string) ([]string, error) {
+	if transactionDB == nil {
+		return nil, errors.New("post authors read outside of a transaction")
+	}
+	return append([]string{}, m.PostAuthorIDs...), nil
+}
+
+func (m *MockOneCMSDB) GetPostsAuthorIDs(ctx context.Context, postIDs []string) (map[string][]string, error) {
+	authorIDs := map[string][]string{}
+	for _, postID := range postIDs {
+		if m.Post != nil && m.Post.ID == postID && len(m.PostAuthorIDs) > 0 {
+			authorIDs[postID] = m.PostAuthorIDs
+		}
+	}
+	return authorIDs, nil
+}
+
+func (m *MockOneCMSDB) EnqueueOSUpdate(ctx context.Context, transactionDB *sql.Tx, entry OSOutboxEntry) (int64, error) {
+	if m.EnqueueErr != nil {
+		return 0, m.EnqueueErr
+	}
+	entry.ID = int64(len(m.Outbox) + 1)
+	m.Outbox = append(m.Outbox, entry)
+	return 1, nil
+}
+
+func (m *MockOneCMSDB) GetPendingOSUpdates(ctx context.Context, afterID int64, limit int) ([]OSOutboxEntry, error) {
+	items := []OSOutboxEntry{}
+	waiting := map[string]bool{}
+	for _, entry := range m.Outbox {
+		doc := entry.Index + "/" + entry.DocID
+		due := m.OutboxNextAttempt[entry.ID].IsZero() || !m.OutboxNextAttempt[entry.ID].After(time.Now())
+		if entry.ID > afterID && !m.OutboxDone[entry.ID] && due && !waiting[doc] && len(items) < limit {
+			items = append(items, entry)
+		}
+		if !m.OutboxDone[entry.ID] && !due {
+			waiting[doc] = true
+		}
+	}
+	return items, nil
+}
+
+func (m *MockOneCMSDB) MarkOSUpdateDone(ctx context.Context, id int64) (int64, error) {
+	if m.OutboxDone == nil {
+		m.OutboxDone = map[int64]bool{}
+	}
+	m.Outbox[id-1].Attempts++
+	m.OutboxDone[id] = true
+	return 1, nil
+}
+
+func (m *MockOneCMSDB) MarkOSUpdateFailed(ctx context.Context, id int64, lastError string, nextAttemptAt time.Time) (int64, error) {
+	if m.OutboxNextAttempt == nil {
+		m.OutboxNextAttempt = map[int64]time.Time{}
+	}
+	m.OutboxNextAttempt[id] = nextAttemptAt
+	m.Outbox[id-1].Attempts++
+	m.Outbox[id-1].LastError = lastError
+	return 1, nil
+}
+
+// fakePostsDriver answers every query with the selected columns of its posts,
+// so a query can be run against rows Postgres would return, NULLs included.
+type fakePostsDriver struct {
+	posts []map[string]driver.Value
+}
+
+func (d *fakePostsDriver) Open(name string) (driver.Conn, error) {
+	return &fakePostsConn{driver: d}, nil
+}
+
+type fakePostsConn struct {
+	driver *fakePostsDriver
+}
+
+func (c *fakePostsConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakePostsStmt{conn: c, query: query}, nil
+}
+
+func (c *fakePostsConn) Close() error {
+	return nil
+}
+
+func (c *fakePostsConn) Begin() (driver.Tx, error) {
+	return nil, driver.ErrSkip
+}
+
+type fakePostsStmt struct {
+	conn  *fakePostsConn
+	query string
+}
+
+func (s *fakePostsStmt) Close() error {
+	return nil
+}
+
+func (s *fakePostsStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakePostsStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, driver.ErrSkip
+}
+
+func (s *fakePostsStmt) Query(args []driver.Value) (driver.Rows, error) {
+	selected := s.query[strings.Index(s.query, "SELECT")+len("SELECT") : strings.Index(s.query, "FROM")]
+	columns := []string{}
+	for _, column := range strings.Split(selected, ",") {
+		columns = append(columns, strings.TrimSpace(column))
+	}
+
+	return &fakePostsRows{columns: columns, posts: s.conn.driver.posts}, nil
+}
+
+type fakePostsRows struct {
+	columns []string
+	posts   []map[string]driver.Value
+	next    int
+}
+
+func (r *fakePostsRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakePostsRows) Close() error {
+	return nil
+}
+
+func (r *fakePostsRows) Next(dest []driver.Value) error {
+	if r.next == len(r.posts) {
+		return io.EOF
+	}
+	for i, column := range r.columns {
+		dest[i] = r.posts[r.next][column]
+	}
+	r.next++
+
+	return nil
+}
+
+func TestGetPostsByIDsWithNullAuthor(t *testing.T) {
+	sql.Register("fakeposts", &fakePostsDriver{posts: []map[string]driver.Value{
+		{"id": "1", "full_url": "https://example.com/a-key-1", "author_id": "author-1"},
+		{"id": "2", "full_url": "https://example.com/b-key-2", "author_id": nil},
+	}})
+	db, err := sql.Open("fakeposts", "")
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	defer db.Close()
+
+	onecmsDB := NewOneCMSDB(*sqlx.NewDb(db, "postgres"), time.Second)
+	posts, err := onecmsDB.GetPostsByIDs(context.Background(), []string{"1", "2"})
+	if err != nil {
+		t.Fatalf("GetPostsByIDs() error = %v, expected a post without author to be read", err)
+	}
+	if len(posts) != 2 || posts[1].ID != "2" || posts[1].FullURL != "https://example.com/b-key-2" {
+		t.Errorf("GetPostsByIDs() = %+v, want both posts", posts)
+	}
+}
@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"strings"
-	"time"
 )
 
 func PrettyPrint(v interface{}) {
@@ -82,61 +82,80 @@ func ToString(source interface{}) (string, error) {
 	return string(jsonString), nil
 }
 
+// FixURL replaces the author key of a URL laid out as DefaultURLSchema.
 func FixURL(url, newAuthorKey string) (string, error) {
-	// Check for empty URL
-	if url == "" {
-		return "", fmt.Errorf("invalid URL format")
-	}
+	return FixURLForPublisher(url, "", newAuthorKey)
+}
 
-	// Find the last segment after the last "/"
-	parts := strings.Split(url, "/")
-	if len(parts) <= 1 {
-		return "", fmt.Errorf("invalid URL format")
+// FixURLForPublisher replaces the author key of a URL using the URL schema
+// configured for the publisher.
+func FixURLForPublisher(url, publisher, newAuthorKey string) (string, error) {
+	schema, err := URLSchemaForPublisher(publisher)
+	if err != nil {
+		return "", err
 	}
 
-	// Extract the last part, which contains the slug and keys
-	lastSegment := parts[len(parts)-1]
+	return schema.Rewrite(url, map[string]string{"authorKey": newAuthorKey})
+}
 
-	// Split by "-" to extract components
-	slugParts := strings.Split(lastSegment, "-")
-	if len(slugParts) < 3 {
-		return "", fmt.Errorf("invalid URL structure")
-	}
+// Slugify turns a post title into a lowercase ASCII slug where every run of
+// other characters becomes a single dash.
+func Slugify(title string) string {
+	var slug strings.Builder
+	pendingDash := false
 
-	// Replace the Author Key with the new one
-	slugParts[len(slugParts)-2] = newAuthorKey
+	for _, r := range strings.ToLower(title) {
+		if folded, ok := slugFoldedRunes[r]; ok {
+			r = folded
+		}
 
-	// Reconstruct the URL
-	newLastSegment := strings.Join(slugParts, "-")
-	parts[len(parts)-1] = newLastSegment
+		switch {
+		case r == '\'' || r == '’':
+			continue
+		case (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9'):
+			if pendingDash && slug.Len() > 0 {
+				slug.WriteByte('-')
+			}
+			pendingDash = false
+			slug.WriteRune(r)
+		default:
+			pendingDash = true
+		}
+	}
 
-	// Join everything back into a valid URL
-	newURL := strings.Join(parts, "/")
+	return slug.String()
+}
 
-	return newURL, nil
+var slugFoldedRunes = map[rune]rune{
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a',
+	'ç': 'c',
+	'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e',
+	'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i',
+	'ñ': 'n',
+	'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o',
+	'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u',
+	'ý': 'y', 'ÿ': 'y',
 }
 
-func LogError(err error) {
-	if err == nil {
-		return
+// WriteFileAtomic writes path through a temporary file renamed into place, so
+// readers never see a half written file.
+func WriteFileAtomic(path string, write func(w io.Writer) error) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
 	}
 
-	// Define the log file path
-	logFile := "error.log"
-
-	// Open file in append mode, create if not exists
-	file, fileErr := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if fileErr != nil {
-		fmt.Println("Failed to open log file:", fileErr)
-		return
+	if err := write(file); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
 	}
-	defer file.Close()
 
-	// Format error with timestamp
-	logMessage := fmt.Sprintf("%s: %v\n", time.Now().Format("2006-01-02 15:04:05"), err)
-
-	// Write error message to the file
-	if _, writeErr := file.WriteString(logMessage); writeErr != nil {
-		fmt.Println("Failed to write to log file:", writeErr)
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
 	}
+
+	return os.Rename(tmpPath, path)
 }
@@ -191,6 +191,13 @@ func TestFixURL(t *testing.T) {
 			expected:     "https://example.com/this-is-an-article-title-with-hyphens-newkey-12345",
 			expectError:  false,
 		},
+		{
+			name:         "URL with category path",
+			url:          "https://www.popmama.com/life/relationship/some-title-oldkey-abc123",
+			newAuthorKey: "newkey",
+			expected:     "https://www.popmama.com/life/relationship/some-title-newkey-abc123",
+			expectError:  false,
+		},
 		{
 			name:          "Invalid URL - no segments",
 			url:           "",
@@ -226,3 +233,40 @@ func TestFixURL(t *testing.T) {
 		})
 	}
 }
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		name     string
+		title    string
+		expected string
+	}{
+		{
+			name:     "Simple title",
+			title:    "Tips Merawat Bayi Baru Lahir",
+			expected: "tips-merawat-bayi-baru-lahir",
+		},
+		{
+			name:     "Punctuation and spaces",
+			title:    "  10 Tips: Mom's   Guide, Part 2!  ",
+			expected: "10-tips-moms-guide-part-2",
+		},
+		{
+			name:     "Accented letters",
+			title:    "Café Crème Brûlée",
+			expected: "cafe-creme-brulee",
+		},
+		{
+			name:     "Only symbols",
+			title:    "!!!",
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := Slugify(tt.title); result != tt.expected {
+				t.Errorf("Slugify() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
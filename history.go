@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// version is the version of the tool, set at build time with
+// -ldflags "-X main.version=...". Builds without it fall back to the git
+// revision Go stamps into the binary.
+var version = ""
+
+// toolVersion is the version recorded with every run, e.g. "3f2a9c1d0b4e" or
+// "3f2a9c1d0b4e-dirty" for a build with uncommitted changes.
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "unknown"
+	}
+
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified {
+		revision += "-dirty"
+	}
+
+	return revision
+}
+
+// runOperator is who started the run: operator when given with --operator,
+// else $USER, else the current OS user.
+func runOperator(operator string) string {
+	if operator != "" {
+		return operator
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+
+	return "unknown"
+}
+
+// RunRecord is a run as recorded in the repair_runs table.
+type RunRecord struct {
+	ID         string
+	Command    string
+	Args       []string
+	Operator   string
+	Version    string
+	StartedAt  time.Time
+	FinishedAt *time.Time
+	Status     string
+	Total      int
+	Processed  int
+	Unfixed    int
+	Redirects  int
+	Error      string
+}
+
+// Duration is how long the run took, or has been running for when it has not
+// finished.
+func (record RunRecord) Duration() time.Duration {
+	finishedAt := time.Now()
+	if record.FinishedAt != nil {
+		finishedAt = *record.FinishedAt
+	}
+
+	return finishedAt.Sub(record.StartedAt).Round(time.Second)
+}
+
+func (record RunRecord) String() string {
+	return fmt.Sprintf("%s %s by %s, %s, %d/%d posts, %d unfixed, started %s, took %s",
+		record.ID, strings.TrimSpace(record.Command+" "+strings.Join(record.Args, " ")), record.Operator, record.Status,
+		record.Processed, record.Total, record.Unfixed, record.StartedAt.Format(time.RFC3339), record.Duration())
+}
+
+// RecordRunStart adds the run to the repair_runs table as running, with the
+// arguments it was started with.
+func RecordRunStart(ctx context.Context, db *sqlx.DB, run *Run) error {
+	query := `
+		INSERT INTO repair_runs
+		(
+			id,
+			command,
+			args,
+			operator,
+			version,
+			started_at,
+			status
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	_, err := db.ExecContext(ctx, query, run.ID, run.Command, pq.Array(run.Args), run.Operator, toolVersion(), run.StartedAt, ReportRunning)
+
+	return err
+}
+
+// RecordRunFinish stores the final status and counts of the run from its
+// report.
+func RecordRunFinish(ctx context.Context, db *sqlx.DB, report RunReport) error {
+	query := `
+		UPDATE repair_runs
+		SET
+			finished_at = $2,
+			status = $3,
+			total = $4,
+			processed = $5,
+			unfixed = $6,
+			redirects = $7,
+			error = NULLIF($8, '')
+		WHERE id = $1
+	`
+
+	result, err := db.ExecContext(ctx, query, report.RunID, report.FinishedAt, report.Status, report.Total, report.Processed, len(report.Unfixed), report.Redirects, report.Error)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return fmt.Errorf("run %s: expected 1 row updated in repair_runs, got %d", report.RunID, rows)
+	}
+
+	return nil
+}
+
+// RunHistoryFilter narrows the runs listed by GetRunHistory. Empty fields
+// match every run.
+type RunHistoryFilter struct {
+	Command  string
+	Operator string
+	Limit    int
+}
+
+const runRecordColumns = `
+		id,
+		command,
+		args,
+		operator,
+		version,
+		started_at,
+		finished_at,
+		status,
+		total,
+		processed,
+		unfixed,
+		redirects,
+		COALESCE(error, '')
+`
+
+// GetRunHistory lists the runs matching filter, latest first.
+func GetRunHistory(ctx context.Context, db *sqlx.DB, filter RunHistoryFilter) ([]RunRecord, error) {
+	query := `
+		SELECT` + runRecordColumns + `
+		FROM repair_runs
+		WHERE ($1 = '' OR command = $1)
+			AND ($2 = '' OR operator = $2)
+		ORDER BY started_at DESC
+		LIMIT $3
+	`
+
+	return queryRunRecords(ctx, db, query, filter.Command, filter.Operator, filter.Limit)
+}
+
+// GetRunRecord returns the run with the given ID, nil when there is none.
+func GetRunRecord(ctx context.Context, db *sqlx.DB, id string) (*RunRecord, error) {
+	query := `
+		SELECT` + runRecordColumns + `
+		FROM repair_runs
+		WHERE id = $1
+	`
+
+	records, err := queryRunRecords(ctx, db, query, id)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+
+	return &records[0], nil
+}
+
+func queryRunRecords(ctx context.Context, db *sqlx.DB, query string, args ...interface{}) ([]RunRecord, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []RunRecord{}
+	for rows.Next() {
+		var record RunRecord
+		var finishedAt sql.NullTime
+		err := rows.Scan(
+			&record.ID,
+			&record.Command,
+			pq.Array(&record.Args),
+			&record.Operator,
+			&record.Version,
+			&record.StartedAt,
+			&finishedAt,
+			&record.Status,
+			&record.Total,
+			&record.Processed,
+			&record.Unfixed,
+			&record.Redirects,
+			&record.Error,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if finishedAt.Valid {
+			record.FinishedAt = &finishedAt.Time
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+// PostRepair is a change of a post from the audit trail, with the command and
+// operator of the run that made it.
+type PostRepair struct {
+	PostAudit
+	Command  string
+	Operator string
+}
+
+// GetPostRepairs lists every change of the post recorded in repair_audit,
+// oldest first.
+func GetPostRepairs(ctx context.Context, db *sqlx.DB, postID string) ([]PostRepair, error) {
+	query := `
+		SELECT
+			a.post_id,
+			a.run_id,
+			a.changes,
+			a.changed_at,
+			COALESCE(r.command, ''),
+			COALESCE(r.operator, '')
+		FROM repair_audit a
+		LEFT JOIN repair_runs r ON r.id = a.run_id
+		WHERE a.post_id = $1
+		ORDER BY a.changed_at, a.id
+	`
+
+	rows, err := db.QueryContext(ctx, query, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	repairs := []PostRepair{}
+	for rows.Next() {
+		var repair PostRepair
+		var changes []byte
+		err := rows.Scan(
+			&repair.PostID,
+			&repair.RunID,
+			&changes,
+			&repair.ChangedAt,
+			&repair.Command,
+			&repair.Operator,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(changes, &repair.Changes); err != nil {
+			return nil, fmt.Errorf("audit of post %s by run %s: %w", repair.PostID, repair.RunID, err)
+		}
+		repairs = append(repairs, repair)
+	}
+
+	return repairs, rows.Err()
+}
+
+// listPostHistory prints every repair the post has gone through, with the
+// fields each one changed.
+func listPostHistory(ctx context.Context, db *sqlx.DB, postID string) error {
+	repairs, err := GetPostRepairs(ctx, db, postID)
+	if err != nil {
+		return err
+	}
+	if len(repairs) == 0 {
+		fmt.Printf("🗂  No repair recorded for post %s\n", postID)
+		return nil
+	}
+
+	for _, repair := range repairs {
+		run := repair.RunID
+		if repair.Command != "" {
+			run = fmt.Sprintf("%s (%s by %s)", repair.RunID, repair.Command, repair.Operator)
+		}
+
+		fmt.Printf("🗂  %s run %s\n", repair.ChangedAt.Format(time.RFC3339), run)
+		for _, change := range repair.Changes {
+			fmt.Printf("    %s: %q → %q\n", change.Field, change.Old, change.New)
+		}
+	}
+
+	return nil
+}
+
+// listRunHistory prints the run with the given ID in full, or the runs
+// matching filter when id is empty.
+func listRunHistory(ctx context.Context, db *sqlx.DB, id string, filter RunHistoryFilter) error {
+	if id != "" {
+		record, err := GetRunRecord(ctx, db, id)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			return errors.New("no run " + id)
+		}
+
+		printRunRecord(*record)
+		return nil
+	}
+
+	records, err := GetRunHistory(ctx, db, filter)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		fmt.Println("🗂  No run recorded")
+		return nil
+	}
+
+	for _, record := range records {
+		fmt.Printf("🗂  %s\n", record)
+	}
+
+	return nil
+}
+
+func printRunRecord(record RunRecord) {
+	finishedAt := "-"
+	if record.FinishedAt != nil {
+		finishedAt = record.FinishedAt.Format(time.RFC3339)
+	}
+
+	fmt.Printf("Run:         %s\n", record.ID)
+	fmt.Printf("Command:     %s\n", strings.TrimSpace(record.Command+" "+strings.Join(record.Args, " ")))
+	fmt.Printf("Operator:    %s\n", record.Operator)
+	fmt.Printf("Version:     %s\n", record.Version)
+	fmt.Printf("Started at:  %s\n", record.StartedAt.Format(time.RFC3339))
+	fmt.Printf("Finished at: %s\n", finishedAt)
+	fmt.Printf("Duration:    %s\n", record.Duration())
+	fmt.Printf("Status:      %s\n", record.Status)
+	fmt.Printf("Posts:       %d/%d processed, %d unfixed\n", record.Processed, record.Total, record.Unfixed)
+	fmt.Printf("Redirects:   %d\n", record.Redirects)
+	if record.Error != "" {
+		fmt.Printf("Error:       %s\n", record.Error)
+	}
+}
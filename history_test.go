@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunOperator(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	if operator := runOperator("bob"); operator != "bob" {
+		t.Errorf("runOperator(bob) = %q, want bob", operator)
+	}
+	if operator := runOperator(""); operator != "alice" {
+		t.Errorf("runOperator() = %q, want $USER alice", operator)
+	}
+}
+
+func TestToolVersion(t *testing.T) {
+	defer func(previous string) { version = previous }(version)
+
+	version = "v1.2.3"
+	if found := toolVersion(); found != "v1.2.3" {
+		t.Errorf("toolVersion() = %q, want the version set at build time", found)
+	}
+
+	version = ""
+	if found := toolVersion(); found == "" {
+		t.Errorf("toolVersion() is empty without a version set at build time")
+	}
+}
+
+func TestRunRecord(t *testing.T) {
+	startedAt := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	finishedAt := startedAt.Add(90 * time.Second)
+	record := RunRecord{
+		ID:         "20240101T100000-abcd1234",
+		Command:    "fix-url",
+		Args:       []string{"2024-01-01", "2024-01-31"},
+		Operator:   "alice",
+		StartedAt:  startedAt,
+		FinishedAt: &finishedAt,
+		Status:     ReportCompletedWithErrors,
+		Total:      100,
+		Processed:  100,
+		Unfixed:    3,
+	}
+
+	if duration := record.Duration(); duration != 90*time.Second {
+		t.Errorf("Duration() = %s, want 1m30s", duration)
+	}
+
+	summary := record.String()
+	for _, part := range []string{"fix-url 2024-01-01 2024-01-31", "by alice", "completed_with_errors", "100/100 posts", "3 unfixed", "took 1m30s"} {
+		if !strings.Contains(summary, part) {
+			t.Errorf("String() = %q, expected it to contain %q", summary, part)
+		}
+	}
+
+	record.FinishedAt = nil
+	record.StartedAt = time.Now().Add(-time.Minute)
+	if duration := record.Duration(); duration < time.Minute {
+		t.Errorf("Duration() = %s of a running run, want at least 1m", duration)
+	}
+}
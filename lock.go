@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// runLockNamespace is the first key of every advisory lock taken by the tool,
+// so its locks are told apart from the ones of other applications.
+const runLockNamespace int32 = 0x4f4e4543 // "ONEC"
+
+// runLockAppPrefix starts the application_name of the session holding a run
+// lock, followed by the run ID and the user and host who started it.
+const runLockAppPrefix = "onecms-repair"
+
+// runLockScopes is the publisher each command works on, "all" for the
+// commands going through every publisher.
+var runLockScopes = map[string]string{
+	"fix-url":          "all",
+	"fix-csc-popmama":  "popmama",
+	"rebuild-url":      "all",
+	"propagate-author": "all",
+	"drain-outbox":     "all",
+}
+
+// runLockResources is what the commands writing to a shared resource lock
+// instead of their own name: every command rewriting post URLs or authors
+// locks "posts", so none of them runs alongside another on the same posts.
+var runLockResources = map[string]string{
+	"fix-url":          "posts",
+	"fix-csc-popmama":  "posts",
+	"rebuild-url":      "posts",
+	"propagate-author": "posts",
+}
+
+// runLockPart is one of the advisory locks making up a run lock, taken
+// shared or exclusive.
+type runLockPart struct {
+	Name   string
+	Shared bool
+}
+
+// runLockName is the name of the lock held by a run of command, e.g.
+// "posts:popmama".
+func runLockName(command string) string {
+	parts := runLockParts(command)
+
+	return parts[len(parts)-1].Name
+}
+
+// runLockParts are the advisory locks taken by a run of command, in order. A
+// run on every publisher holds resource:all exclusively. A run on a single
+// publisher holds resource:all shared and resource:<publisher> exclusively,
+// so it excludes the runs on every publisher and on its own, but not the ones
+// on other publishers.
+func runLockParts(command string) []runLockPart {
+	resource, ok := runLockResources[command]
+	if !ok {
+		resource = command
+	}
+	scope, ok := runLockScopes[command]
+	if !ok {
+		scope = "all"
+	}
+
+	all := resource + ":all"
+	if scope == "all" {
+		return []runLockPart{{Name: all}}
+	}
+
+	return []runLockPart{{Name: all, Shared: true}, {Name: resource + ":" + scope}}
+}
+
+// acquireRunLockParts takes parts in order with try, giving back the ones
+// taken with release when one is refused. It returns the part refused, nil
+// when all of them were taken.
+func acquireRunLockParts(parts []runLockPart, try func(part runLockPart) (bool, error), release func(part runLockPart) error) (*runLockPart, error) {
+	for i, part := range parts {
+		acquired, err := try(part)
+		if err == nil && acquired {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			release(parts[j])
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return &part, nil
+	}
+
+	return nil, nil
+}
+
+// runLockKey is the second key of the advisory lock named name. It is kept
+// positive so it reads the same in pg_locks.objid.
+func runLockKey(name string) int32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+
+	return int32(hash.Sum32() & 0x7fffffff)
+}
+
+// runLockNameByKey finds the name of a lock from its key among the locks of
+// the known commands.
+func runLockNameByKey(key int32) string {
+	for command := range runLockScopes {
+		for _, part := range runLockParts(command) {
+			if runLockKey(part.Name) == key {
+				return part.Name
+			}
+		}
+	}
+
+	return fmt.Sprintf("unknown:%d", key)
+}
+
+// LockHolder is the Postgres session holding a run lock.
+type LockHolder struct {
+	Name            string
+	PID             int
+	ApplicationName string
+	DBUser          string
+	ClientAddr      string
+	Since           time.Time
+}
+
+func (holder LockHolder) String() string {
+	who := strings.TrimSpace(strings.TrimPrefix(holder.ApplicationName, runLockAppPrefix))
+	if who == "" {
+		who = "an unknown run"
+	} else {
+		who = "run " + who
+	}
+
+	return fmt.Sprintf("%s (pid %d, db user %s from %s) since %s", who, holder.PID, holder.DBUser, holder.ClientAddr, holder.Since.Format(time.RFC3339))
+}
+
+// LockHeldError is returned when another run holds the lock a run needs.
+type LockHeldError struct {
+	Name   string
+	Holder *LockHolder
+}
+
+func (e *LockHeldError) Error() string {
+	if e.Holder == nil {
+		return fmt.Sprintf("lock %q is held by another run", e.Name)
+	}
+
+	return fmt.Sprintf("lock %q is held by %s", e.Name, e.Holder)
+}
+
+// RunLock is the Postgres advisory locks held for the duration of a run, so
+// two runs writing the same posts never race. It lives in a session of its
+// own, and goes away with it if the process dies.
+type RunLock struct {
+	Name  string
+	parts []runLockPart
+	conn  *sql.Conn
+}
+
+// AcquireRunLock takes the lock of a run of command without waiting, and
+// returns a LockHeldError naming the holder when another run has it.
+func AcquireRunLock(ctx context.Context, db *sqlx.DB, run *Run, command string) (*RunLock, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	appName := fmt.Sprintf("%s %s %s", runLockAppPrefix, run.ID, runLockOwner())
+	if _, err := conn.ExecContext(ctx, `SELECT set_config('application_name', $1, false)`, appName); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	parts := runLockParts(command)
+	refused, err := acquireRunLockParts(parts, func(part runLockPart) (bool, error) {
+		query := `SELECT pg_try_advisory_lock($1, $2)`
+		if part.Shared {
+			query = `SELECT pg_try_advisory_lock_shared($1, $2)`
+		}
+
+		var acquired bool
+		err := conn.QueryRowContext(ctx, query, runLockNamespace, runLockKey(part.Name)).Scan(&acquired)
+
+		return acquired, err
+	}, func(part runLockPart) error {
+		return unlockRunLockPart(ctx, conn, part)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if refused != nil {
+		conn.Close()
+		holder, err := GetRunLockHolder(ctx, db, refused.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, &LockHeldError{Name: refused.Name, Holder: holder}
+	}
+
+	return &RunLock{Name: runLockName(command), parts: parts, conn: conn}, nil
+}
+
+// Release gives the lock back and closes its session.
+func (lock *RunLock) Release(ctx context.Context) error {
+	defer lock.conn.Close()
+
+	var err error
+	for i := len(lock.parts) - 1; i >= 0; i-- {
+		if unlockErr := unlockRunLockPart(ctx, lock.conn, lock.parts[i]); unlockErr != nil && err == nil {
+			err = unlockErr
+		}
+	}
+
+	return err
+}
+
+func unlockRunLockPart(ctx context.Context, conn *sql.Conn, part runLockPart) error {
+	query := `SELECT pg_advisory_unlock($1, $2)`
+	if part.Shared {
+		query = `SELECT pg_advisory_unlock_shared($1, $2)`
+	}
+	_, err := conn.ExecContext(ctx, query, runLockNamespace, runLockKey(part.Name))
+
+	return err
+}
+
+const runLocksQuery = `
+	SELECT
+		l.objid,
+		a.pid,
+		COALESCE(a.application_name, ''),
+		COALESCE(a.usename, ''),
+		COALESCE(host(a.client_addr), 'local'),
+		a.backend_start
+	FROM pg_locks l
+	JOIN pg_stat_activity a ON a.pid = l.pid
+	WHERE l.locktype = 'advisory'
+		AND l.granted
+		AND l.objsubid = 2
+		AND l.classid = $1
+`
+
+// GetRunLocks lists the run locks currently held.
+func GetRunLocks(ctx context.Context, db *sqlx.DB) ([]LockHolder, error) {
+	return queryRunLocks(ctx, db, runLocksQuery+` ORDER BY a.backend_start`, runLockNamespace)
+}
+
+// GetRunLockHolder returns the session holding the lock named name, nil when
+// it is free.
+func GetRunLockHolder(ctx context.Context, db *sqlx.DB, name string) (*LockHolder, error) {
+	holders, err := queryRunLocks(ctx, db, runLocksQuery+` AND l.objid = $2`, runLockNamespace, runLockKey(name))
+	if err != nil || len(holders) == 0 {
+		return nil, err
+	}
+
+	return &holders[0], nil
+}
+
+// ReleaseRunLock forcibly releases the lock named name, left behind by a
+// stale run, by terminating the session holding it. It returns the holder,
+// nil when the lock was free.
+func ReleaseRunLock(ctx context.Context, db *sqlx.DB, name string) (*LockHolder, error) {
+	holder, err := GetRunLockHolder(ctx, db, name)
+	if err != nil || holder == nil {
+		return nil, err
+	}
+
+	var terminated bool
+	if err := db.QueryRowContext(ctx, `SELECT pg_terminate_backend($1)`, holder.PID).Scan(&terminated); err != nil {
+		return nil, err
+	}
+	if !terminated {
+		return nil, fmt.Errorf("cannot terminate pid %d holding lock %q", holder.PID, name)
+	}
+
+	return holder, nil
+}
+
+func queryRunLocks(ctx context.Context, db *sqlx.DB, query string, args ...interface{}) ([]LockHolder, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holders := []LockHolder{}
+	for rows.Next() {
+		var key int64
+		var holder LockHolder
+		if err := rows.Scan(&key, &holder.PID, &holder.ApplicationName, &holder.DBUser, &holder.ClientAddr, &holder.Since); err != nil {
+			return nil, err
+		}
+		holder.Name = runLockNameByKey(int32(key))
+		holders = append(holders, holder)
+	}
+
+	return holders, rows.Err()
+}
+
+// runLockOwner is the user and host starting the run, as user@host.
+func runLockOwner() string {
+	name := "unknown"
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	return name + "@" + host
+}
+
+// listRunLocks prints the run locks currently held, or releases the one named
+// release when given.
+func listRunLocks(ctx context.Context, db *sqlx.DB, release string) error {
+	if release != "" {
+		holder, err := ReleaseRunLock(ctx, db, release)
+		if err != nil {
+			return err
+		}
+		if holder == nil {
+			return fmt.Errorf("lock %q is not held", release)
+		}
+
+		fmt.Printf("🔓 Released lock %q held by %s\n", release, holder)
+		return nil
+	}
+
+	holders, err := GetRunLocks(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(holders) == 0 {
+		fmt.Println("🔓 No lock held")
+		return nil
+	}
+
+	for _, holder := range holders {
+		fmt.Printf("🔒 %s: %s\n", holder.Name, holder)
+	}
+
+	return nil
+}
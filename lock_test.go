@@ -0,0 +1,179 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunLockName(t *testing.T) {
+	tests := []struct {
+		command  string
+		expected string
+	}{
+		{command: "fix-url", expected: "posts:all"},
+		{command: "rebuild-url", expected: "posts:all"},
+		{command: "fix-csc-popmama", expected: "posts:popmama"},
+		{command: "drain-outbox", expected: "drain-outbox:all"},
+		{command: "unknown", expected: "unknown:all"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			if name := runLockName(tt.command); name != tt.expected {
+				t.Errorf("runLockName(%q) = %q, want %q", tt.command, name, tt.expected)
+			}
+		})
+	}
+}
+
+// fakeAdvisoryLocks holds advisory locks the way Postgres does: an exclusive
+// lock excludes every other session, a shared one only the exclusive locks.
+type fakeAdvisoryLocks struct {
+	exclusive map[string]string
+	shared    map[string]map[string]bool
+}
+
+func (locks *fakeAdvisoryLocks) acquire(session, command string) *runLockPart {
+	refused, _ := acquireRunLockParts(runLockParts(command), func(part runLockPart) (bool, error) {
+		if holder, ok := locks.exclusive[part.Name]; ok && holder != session {
+			return false, nil
+		}
+		if part.Shared {
+			if locks.shared[part.Name] == nil {
+				locks.shared[part.Name] = map[string]bool{}
+			}
+			locks.shared[part.Name][session] = true
+			return true, nil
+		}
+		for holder := range locks.shared[part.Name] {
+			if holder != session {
+				return false, nil
+			}
+		}
+		locks.exclusive[part.Name] = session
+		return true, nil
+	}, func(part runLockPart) error {
+		if part.Shared {
+			delete(locks.shared[part.Name], session)
+		} else {
+			delete(locks.exclusive, part.Name)
+		}
+		return nil
+	})
+
+	return refused
+}
+
+func TestAcquireRunLockParts(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    string
+		second   string
+		expected string
+	}{
+		{name: "Different commands on every publisher", first: "fix-url", second: "propagate-author", expected: "posts:all"},
+		{name: "Same command", first: "rebuild-url", second: "rebuild-url", expected: "posts:all"},
+		{name: "Publisher run after a run on every publisher", first: "fix-url", second: "fix-csc-popmama", expected: "posts:all"},
+		{name: "Run on every publisher after a publisher run", first: "fix-csc-popmama", second: "rebuild-url", expected: "posts:all"},
+		{name: "Same publisher", first: "fix-csc-popmama", second: "fix-csc-popmama", expected: "posts:popmama"},
+		{name: "Command writing no posts", first: "fix-url", second: "drain-outbox", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			locks := &fakeAdvisoryLocks{exclusive: map[string]string{}, shared: map[string]map[string]bool{}}
+			if refused := locks.acquire("first", tt.first); refused != nil {
+				t.Fatalf("%s refused %q with no other run", tt.first, refused.Name)
+			}
+
+			refused := locks.acquire("second", tt.second)
+			if tt.expected == "" {
+				if refused != nil {
+					t.Errorf("%s refused %q while %s runs", tt.second, refused.Name, tt.first)
+				}
+				return
+			}
+			if refused == nil || refused.Name != tt.expected {
+				t.Fatalf("%s refused %v while %s runs, want %q", tt.second, refused, tt.first, tt.expected)
+			}
+			for name, holder := range locks.exclusive {
+				if holder == "second" {
+					t.Errorf("refused run still holds %q", name)
+				}
+			}
+			for name, holders := range locks.shared {
+				if holders["second"] {
+					t.Errorf("refused run still holds %q shared", name)
+				}
+			}
+		})
+	}
+}
+
+func TestRunLockScopesCoverRunCommands(t *testing.T) {
+	for command := range runCommands {
+		if _, ok := runLockScopes[command]; !ok {
+			t.Errorf("command %q has no run lock scope", command)
+		}
+	}
+}
+
+func TestRunLockKey(t *testing.T) {
+	names := map[string]bool{}
+	for command := range runLockScopes {
+		for _, part := range runLockParts(command) {
+			names[part.Name] = true
+		}
+	}
+
+	keys := map[int32]string{}
+	for name := range names {
+		key := runLockKey(name)
+
+		if key < 0 {
+			t.Errorf("runLockKey(%q) = %d, want a positive key", name, key)
+		}
+		if key != runLockKey(name) {
+			t.Errorf("runLockKey(%q) is not stable", name)
+		}
+		if other, ok := keys[key]; ok {
+			t.Errorf("runLockKey(%q) = runLockKey(%q)", name, other)
+		}
+		keys[key] = name
+
+		if found := runLockNameByKey(key); found != name {
+			t.Errorf("runLockNameByKey(%d) = %q, want %q", key, found, name)
+		}
+	}
+
+	if found := runLockNameByKey(1); found != "unknown:1" {
+		t.Errorf("runLockNameByKey(1) = %q, want unknown:1", found)
+	}
+}
+
+func TestLockHeldError(t *testing.T) {
+	err := &LockHeldError{
+		Name: "posts:all",
+		Holder: &LockHolder{
+			Name:            "posts:all",
+			PID:             4242,
+			ApplicationName: "onecms-repair 20240101T000000-abcd1234 alice@laptop",
+			DBUser:          "repair",
+			ClientAddr:      "10.0.0.1",
+			Since:           time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	message := err.Error()
+	for _, part := range []string{`"posts:all"`, "run 20240101T000000-abcd1234 alice@laptop", "pid 4242", "2024-01-01T00:00:00Z"} {
+		if !strings.Contains(message, part) {
+			t.Errorf("LockHeldError.Error() = %q, expected it to contain %q", message, part)
+		}
+	}
+
+	err.Holder = nil
+	if message := err.Error(); message != `lock "posts:all" is held by another run` {
+		t.Errorf("LockHeldError.Error() = %q without holder", message)
+	}
+}
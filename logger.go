@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Stages of a run, logged under "stage" so the records of a single step can
+// be filtered.
+const (
+	StageFetch   = "fetch"
+	StageRepair  = "repair"
+	StageOS      = "opensearch"
+	StageOutbox  = "outbox"
+	StageVerify  = "verify"
+	StageSummary = "summary"
+)
+
+// LogConfig decides where the records of a run go: stdout, or only the errors
+// to stderr when Quiet, and File, rotated once it grows past MaxSize megabytes
+// with MaxFiles previous files kept. Both get the records at Level or above,
+// in Format.
+type LogConfig struct {
+	Level    slog.Level
+	Format   string
+	File     string
+	MaxSize  int
+	MaxFiles int
+	Quiet    bool
+}
+
+func DefaultLogConfig() LogConfig {
+	return LogConfig{
+		Level:    slog.LevelInfo,
+		Format:   LogFormatText,
+		File:     "repair.log",
+		MaxSize:  100,
+		MaxFiles: 5,
+	}
+}
+
+// NewLogConfigFromEnv reads LOG_LEVEL, LOG_FORMAT, LOG_FILE, LOG_MAX_SIZE (in
+// megabytes), LOG_MAX_FILES and LOG_QUIET, falling back to DefaultLogConfig.
+func NewLogConfigFromEnv() (LogConfig, error) {
+	config := DefaultLogConfig()
+
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		if err := config.Level.UnmarshalText([]byte(level)); err != nil {
+			return config, fmt.Errorf("invalid LOG_LEVEL %q", level)
+		}
+	}
+
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "":
+	case LogFormatText, LogFormatJSON:
+		config.Format = format
+	default:
+		return config, fmt.Errorf("invalid LOG_FORMAT %q", format)
+	}
+
+	if file := os.Getenv("LOG_FILE"); file != "" {
+		config.File = file
+	}
+
+	if maxSize := os.Getenv("LOG_MAX_SIZE"); maxSize != "" {
+		var err error
+		config.MaxSize, err = strconv.Atoi(maxSize)
+		if err != nil || config.MaxSize < 1 {
+			return config, fmt.Errorf("invalid LOG_MAX_SIZE %q", maxSize)
+		}
+	}
+
+	if maxFiles := os.Getenv("LOG_MAX_FILES"); maxFiles != "" {
+		var err error
+		config.MaxFiles, err = strconv.Atoi(maxFiles)
+		// lumberjack keeps every previous file for zero.
+		if err != nil || config.MaxFiles < 1 {
+			return config, fmt.Errorf("invalid LOG_MAX_FILES %q", maxFiles)
+		}
+	}
+
+	if quiet := os.Getenv("LOG_QUIET"); quiet != "" {
+		var err error
+		config.Quiet, err = strconv.ParseBool(quiet)
+		if err != nil {
+			return config, fmt.Errorf("invalid LOG_QUIET %q", quiet)
+		}
+	}
+
+	return config, nil
+}
+
+// NewLogger returns a logger writing to stdout, or its errors to stderr when
+// config is quiet, and to the rotating log file of config, returned as well
+// when there is one.
+func NewLogger(config LogConfig, stdout io.Writer) (*slog.Logger, *lumberjack.Logger, error) {
+	handlers := multiHandler{}
+	var logFile *lumberjack.Logger
+
+	if config.Quiet {
+		// Errors still show up, next to the progress bar and summary.
+		quiet := config
+		quiet.Level = max(config.Level, slog.LevelError)
+		handlers = append(handlers, newLogHandler(os.Stderr, quiet))
+	} else {
+		handlers = append(handlers, newLogHandler(stdout, config))
+	}
+
+	if config.File != "" {
+		logFile = &lumberjack.Logger{
+			Filename:   config.File,
+			MaxSize:    config.MaxSize,
+			MaxBackups: config.MaxFiles,
+		}
+		// lumberjack opens the file on the first write, an empty one makes
+		// a log file that cannot be opened fail the run before it starts.
+		if _, err := logFile.Write(nil); err != nil {
+			return nil, nil, err
+		}
+		handlers = append(handlers, newLogHandler(logFile, config))
+	}
+
+	return slog.New(handlers), logFile, nil
+}
+
+func newLogHandler(w io.Writer, config LogConfig) slog.Handler {
+	options := &slog.HandlerOptions{Level: config.Level}
+	if config.Format == LogFormatJSON {
+		return slog.NewJSONHandler(w, options)
+	}
+
+	return slog.NewTextHandler(w, options)
+}
+
+// multiHandler sends every record to each of its handlers enabled for it.
+type multiHandler []slog.Handler
+
+func (handlers multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range handlers {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (handlers multiHandler) Handle(ctx context.Context, record slog.Record) error {
+	var firstErr error
+	for _, handler := range handlers {
+		if !handler.Enabled(ctx, record.Level) {
+			continue
+		}
+		if err := handler.Handle(ctx, record.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (handlers multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	derived := make(multiHandler, len(handlers))
+	for i, handler := range handlers {
+		derived[i] = handler.WithAttrs(attrs)
+	}
+
+	return derived
+}
+
+func (handlers multiHandler) WithGroup(name string) slog.Handler {
+	derived := make(multiHandler, len(handlers))
+	for i, handler := range handlers {
+		derived[i] = handler.WithGroup(name)
+	}
+
+	return derived
+}
+
+// postLogger returns the logger of the run with the stage and the fields of a
+// post. oldID is only set for posts known by their old ID.
+func postLogger(run *Run, stage, postID, oldID string) *slog.Logger {
+	logger := run.Log.With("stage", stage)
+	if postID != "" {
+		logger = logger.With("post_id", postID)
+	}
+	if oldID != "" {
+		logger = logger.With("old_id", oldID)
+	}
+
+	return logger
+}
+
+// unfixedStage is the stage the failure reason of an unfixed post belongs to.
+func unfixedStage(unfixed UnfixedPosts) string {
+	switch unfixed.Reason {
+	case ReasonOSUpdateFailed, ReasonOSUpdateQueued, ReasonOSVersionConflict, ReasonCompensationFailed:
+		return StageOS
+	case ReasonVerificationFailed:
+		return StageVerify
+	}
+
+	return StageRepair
+}
+
+// logUnfixed logs a post left unfixed, under the stage its failure reason
+// belongs to.
+func logUnfixed(run *Run, unfixed UnfixedPosts) {
+	postLogger(run, unfixedStage(unfixed), unfixed.ID, unfixed.OldID).Warn("post left unfixed", "reason", unfixed.Reason, "error", unfixed.Error)
+}
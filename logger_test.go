@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewLoggerFile(t *testing.T) {
+	config := DefaultLogConfig()
+	config.File = filepath.Join(t.TempDir(), "repair.log")
+
+	var stdout bytes.Buffer
+	logger, logFile, err := NewLogger(config, &stdout)
+	if err != nil {
+		t.Fatalf("NewLogger() error = %v", err)
+	}
+	logger.Info("fixed post", "post_id", "1")
+	logFile.Close()
+
+	data, err := os.ReadFile(config.File)
+	if err != nil || !bytes.Contains(data, []byte("post_id=1")) || !bytes.Equal(data, stdout.Bytes()) {
+		t.Errorf("log file = %q, %v, want the records written to stdout %q", data, err, stdout.String())
+	}
+
+	config.File = filepath.Join(t.TempDir(), "missing", "dir", "repair.log")
+	os.WriteFile(filepath.Dir(filepath.Dir(config.File)), nil, 0644)
+	if _, _, err := NewLogger(config, &stdout); err == nil {
+		t.Errorf("NewLogger() with a log file that cannot be created = nil, want an error")
+	}
+}
+
+func TestMultiHandler(t *testing.T) {
+	var info, errs bytes.Buffer
+	logger := slog.New(multiHandler{
+		slog.NewJSONHandler(&info, &slog.HandlerOptions{Level: slog.LevelInfo}),
+		slog.NewTextHandler(&errs, &slog.HandlerOptions{Level: slog.LevelError}),
+	})
+
+	run := NewRun("fix-url")
+	run.Log = logger.With("run_id", run.ID)
+	logUnfixed(run, *unfixedOldPost("old-1", ReasonOSUpdateFailed, "failed updating OS data for this post", nil))
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(info.Bytes(), &record); err != nil {
+		t.Fatalf("info record %q is not JSON: %v", info.String(), err)
+	}
+	for key, value := range map[string]interface{}{"run_id": run.ID, "old_id": "old-1", "stage": StageOS, "reason": string(ReasonOSUpdateFailed), "level": "WARN"} {
+		if record[key] != value {
+			t.Errorf("record %s = %v, want %v", key, record[key], value)
+		}
+	}
+	if _, ok := record["post_id"]; ok {
+		t.Errorf("record has a post_id for a post known by its old ID")
+	}
+
+	if errs.Len() != 0 {
+		t.Errorf("error handler got %q, want nothing below error level", errs.String())
+	}
+}
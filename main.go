@@ -2,86 +2,284 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
-	"time"
+	"strconv"
 
 	"github.com/joho/godotenv"
 )
 
+// Exit codes of a run that did not get through every post.
+const (
+	exitInterrupted = 130
+	exitTimedOut    = 124
+	exitLocked      = 75
+	exitAborted     = 1
+)
+
 func main() {
-	args := os.Args
-	fmt.Println(args)
+	args, flags, err := takeGlobalFlags(os.Args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	if len(args) <= 1 {
 		fmt.Println("Not enough arguments")
 		os.Exit(1)
 	}
-	fmt.Println("===== Running... =====")
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(30)*time.Second)
-	defer cancel()
+	if !runCommands[args[1]] && !runlessCommands[args[1]] {
+		fmt.Printf("Unknown command %q\n", args[1])
+		os.Exit(1)
+	}
 
-	err := godotenv.Load()
+	err = godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
-		LogError(err)
 		return
 	}
 
+	run, err := NewRunFromEnv(args[1])
+	if err != nil {
+		fmt.Println("❌ ERROR preparing the run")
+		panic(err)
+	}
+
+	if err := run.OpenLog(); err != nil {
+		fmt.Println("❌ ERROR opening the log file")
+		panic(err)
+	}
+	defer run.CloseLog()
+	run.Args = append(append([]string{}, args[2:]...), flags.runArgs()...)
+	run.Operator = runOperator(flags.Operator)
+	if flags.MaxChanges != "" {
+		run.MaxChanges, err = strconv.Atoi(flags.MaxChanges)
+		if err != nil || run.MaxChanges < 1 {
+			run.Log.Error("invalid --max-changes", "value", flags.MaxChanges)
+			os.Exit(1)
+		}
+	}
+	if flags.Canary != "" {
+		run.Canary, err = strconv.Atoi(flags.Canary)
+		if err != nil || run.Canary < 1 {
+			run.Log.Error("invalid --canary", "value", flags.Canary)
+			os.Exit(1)
+		}
+	}
+	run.CanaryRandom = flags.CanaryRandom
+	run.Log.Info("starting run", "command", args[1], "args", run.Args, "operator", run.Operator, "version", toolVersion())
+
+	ctx, cancel := run.Context(context.Background())
+	defer cancel()
+	if !flags.AssumeYes {
+		run.Confirm = PromptConfirm(ctx, run.Done(), os.Stdin, os.Stdout)
+	}
+
 	DSN := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", os.Getenv("DB_HOST"), os.Getenv("DB_PORT"), os.Getenv("DB_USERNAME"), os.Getenv("DB_PASS"), os.Getenv("DB_NAME"))
 	dbClient, err := GetDBConnection(DSN)
 	if err != nil {
-		fmt.Println("❌ ERROR connecting to database")
-		LogError(err)
+		run.Log.Error("connecting to database failed", "error", err)
 		panic(err)
 	}
 	defer dbClient.Close()
 
+	if args[1] == "locks" {
+		fs := flag.NewFlagSet("locks", flag.ExitOnError)
+		release := fs.String("release", "", "terminate the session holding this lock, left behind by a stale run")
+		parseCommandArgs(fs, args[2:])
+
+		if err := listRunLocks(ctx, dbClient, *release); err != nil {
+			run.Log.Error("managing run locks failed", "error", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if args[1] == "history" {
+		history, err := parseHistoryArgs(args[2:])
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		} else if err != nil {
+			os.Exit(2)
+		}
+
+		if history.Post != "" {
+			err = listPostHistory(ctx, dbClient, history.Post)
+		} else {
+			err = listRunHistory(ctx, dbClient, history.ID, history.Filter)
+		}
+		if err != nil {
+			run.Log.Error("listing the run history failed", "error", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	lock, err := AcquireRunLock(ctx, dbClient, run, args[1])
+	if err != nil {
+		run.Log.Error("cannot start the run", "error", err)
+		os.Exit(exitLocked)
+	}
+	run.Log.Info("holding run lock", "lock", lock.Name)
+
 	osIndex := os.Getenv("POST_INDEX")
 	osClient, err := GetOSConnection(os.Getenv("OS_HOST"), os.Getenv("OS_USERNAME"), os.Getenv("OS_PASSWORD"))
 	if err != nil {
-		fmt.Println("❌ ERROR connecting to opensearch")
-		LogError(err)
+		run.Log.Error("connecting to OpenSearch failed", "error", err)
 		panic(err)
 	}
 
-	onecmsDB := NewOneCMSDB(*dbClient)
-	onecmsOS := NewOneCMSOS(osClient)
+	onecmsDB := NewRetryingDB(NewThrottledDB(NewOneCMSDB(*dbClient, run.CallTimeout), run.DBThrottle), run)
+	onecmsOS := NewRetryingOS(NewThrottledOS(NewOneCMSOS(osClient, run.CallTimeout), run.OSThrottle), run)
+
+	var metricsServer *http.Server
+	if flags.MetricsAddr != "" {
+		metrics.RunInfo.WithLabelValues(run.ID, run.Command).Set(1)
+		metricsServer, err = ServeMetrics(flags.MetricsAddr, metrics)
+		if err != nil {
+			run.Log.Error("serving metrics failed", "error", err)
+			panic(err)
+		}
+	}
 
+	// Every connection is open by now, so nothing but the run itself can
+	// fail once it is recorded. A panic of the run still records its end.
+	if err := RecordRunStart(ctx, dbClient, run); err != nil {
+		run.Log.Error("recording the run in repair_runs failed", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			report, _ := run.Finish(fmt.Errorf("panic: %v", r))
+			historyCtx, cancelHistory := withOptionalTimeout(context.Background(), run.CallTimeout)
+			if err := RecordRunFinish(historyCtx, dbClient, report); err != nil {
+				run.Log.Error("recording the end of the run in repair_runs failed", "error", err)
+			}
+			cancelHistory()
+			panic(r)
+		}
+	}()
+
+	stopSignals := run.HandleSignals(cancel)
+
+	var runErr error
 	if args[1] == "fix-url" {
-		fmt.Println("🏃🏽‍➡️ Repairing post url...")
 		if len(args) < 4 {
 			panic("not enough argument")
 		}
 
-		err := fixURL(
+		runErr = fixURL(
 			ctx,
+			run,
 			onecmsDB,
 			onecmsOS,
-			os.Args[2],
-			os.Args[3],
+			args[2],
+			args[3],
 			osIndex,
 		)
-		if err != nil {
-			fmt.Printf("\nGot some errors\n----------------------\n %v", err)
-			LogError(err)
-		}
 	} else if args[1] == "fix-csc-popmama" {
-		fmt.Println("🏃🏽‍➡️ Repairing One CMS Popmama CSC...")
 		if len(args) < 4 {
 			panic("not enough argument")
 		}
 
-		err := fixCSCPopmama(
+		runErr = fixCSCPopmama(
 			ctx,
+			run,
 			onecmsDB,
 			onecmsOS,
 			osIndex,
 		)
-		if err != nil {
-			fmt.Printf("\nGot some errors\n----------------------\n %v", err)
-			LogError(err)
+	} else if args[1] == "rebuild-url" {
+		fs := flag.NewFlagSet("rebuild-url", flag.ExitOnError)
+		dryRun := fs.Bool("dry-run", false, "only report posts whose stored url differs from the rebuilt one")
+		positional, _ := parseCommandArgs(fs, args[2:])
+		if len(positional) < 2 {
+			panic("not enough argument")
+		}
+
+		runErr = rebuildURL(
+			ctx,
+			run,
+			onecmsDB,
+			onecmsOS,
+			positional[0],
+			positional[1],
+			osIndex,
+			*dryRun,
+		)
+	} else if args[1] == "propagate-author" {
+		if len(args) < 3 {
+			panic("not enough argument")
+		}
+
+		runErr = propagateAuthor(
+			ctx,
+			run,
+			onecmsDB,
+			onecmsOS,
+			args[2],
+			osIndex,
+		)
+	} else if args[1] == "drain-outbox" {
+		fs := flag.NewFlagSet("drain-outbox", flag.ExitOnError)
+		watch := fs.Bool("watch", false, "keep polling the outbox until the run is stopped")
+		parseCommandArgs(fs, args[2:])
+
+		runErr = drainOutbox(
+			ctx,
+			run,
+			onecmsDB,
+			onecmsOS,
+			*watch,
+		)
+	}
+
+	stopSignals()
+
+	if runErr != nil {
+		run.Log.Error("run ended with errors", "error", runErr)
+	}
+
+	if err := lock.Release(context.Background()); err != nil {
+		run.Log.Error("releasing the run lock failed", "error", err)
+	}
+
+	if err := StopMetrics(metricsServer); err != nil {
+		run.Log.Error("stopping the metrics server failed", "error", err)
+	}
+
+	report, err := run.Finish(runErr)
+	if err != nil {
+		run.Log.Error("saving the run report failed", "error", err)
+	}
+	historyCtx, cancelHistory := withOptionalTimeout(context.Background(), run.CallTimeout)
+	if err := RecordRunFinish(historyCtx, dbClient, report); err != nil {
+		run.Log.Error("recording the end of the run in repair_runs failed", "error", err)
+	}
+	cancelHistory()
+
+	fmt.Printf("\n🧾 Report: %s (%s, %d/%d posts)\n", run.ReportFile, report.Status, report.Processed, report.Total)
+
+	switch report.Status {
+	case ReportAborted:
+		if report.Processed > 0 {
+			fmt.Println("🛑 Aborted after the canary, the remaining posts were left untouched")
+		} else {
+			fmt.Println("🛑 Aborted before any change")
 		}
+		os.Exit(exitAborted)
+	case ReportCanaryFailed:
+		fmt.Println("🐤 Canary failed, the remaining posts were left untouched")
+		os.Exit(exitAborted)
+	case ReportInterrupted:
+		fmt.Printf("⛔ Interrupted, resume from checkpoint %q\n", report.Checkpoint)
+		os.Exit(exitInterrupted)
+	case ReportTimedOut:
+		fmt.Printf("⏰ Timed out, resume from checkpoint %q\n", report.Checkpoint)
+		os.Exit(exitTimedOut)
 	}
 
 	fmt.Println("\n✅ OK Done")
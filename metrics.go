@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	callDurationBuckets  = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	bulkBatchSizeBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000}
+)
+
+// metrics holds the metrics of the run, served by ServeMetrics. It is global
+// like the default logger, since the Postgres and OpenSearch clients record
+// their calls without knowing the run.
+var metrics = NewMetrics()
+
+// Metrics are the Prometheus metrics of a run, registered on a registry of
+// their own so only they get served.
+type Metrics struct {
+	RunInfo        *prometheus.GaugeVec
+	PostsProcessed *prometheus.CounterVec
+	CallDuration   *prometheus.HistogramVec
+	BulkBatchSize  prometheus.Histogram
+	Retries        *prometheus.CounterVec
+	RetriedCalls   *prometheus.CounterVec
+	CurrentChunk   prometheus.Gauge
+	Chunks         prometheus.Gauge
+
+	registry *prometheus.Registry
+}
+
+func NewMetrics() *Metrics {
+	registry := prometheus.NewRegistry()
+	factory := promauto.With(registry)
+
+	return &Metrics{
+		RunInfo: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "onecms_repair_run_info",
+			Help: "Run being served, always 1.",
+		}, []string{"run_id", "command"}),
+		PostsProcessed: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "onecms_repair_posts_processed_total",
+			Help: "Posts processed, by status and by the stage where they ended.",
+		}, []string{"status", "stage"}),
+		CallDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "onecms_repair_call_duration_seconds",
+			Help:    "Latency of every Postgres and OpenSearch call attempt.",
+			Buckets: callDurationBuckets,
+		}, []string{"store", "call"}),
+		BulkBatchSize: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "onecms_repair_bulk_batch_size",
+			Help:    "Documents sent in each OpenSearch bulk request.",
+			Buckets: bulkBatchSizeBuckets,
+		}),
+		Retries: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "onecms_repair_retries_total",
+			Help: "Extra attempts made after transient errors.",
+		}, []string{"call"}),
+		RetriedCalls: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "onecms_repair_retried_calls_total",
+			Help: "Calls retried after transient errors, by whether they eventually succeeded.",
+		}, []string{"call", "outcome"}),
+		CurrentChunk: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "onecms_repair_current_chunk",
+			Help: "Chunk being processed, counted from 1.",
+		}),
+		Chunks: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "onecms_repair_chunks",
+			Help: "Chunks of the run.",
+		}),
+		registry: registry,
+	}
+}
+
+// SetChunk records the chunk being processed, out of chunks.
+func (m *Metrics) SetChunk(chunk, chunks int) {
+	m.CurrentChunk.Set(float64(chunk))
+	m.Chunks.Set(float64(chunks))
+}
+
+// observeCall records the latency of a call to store that started at
+// startedAt, meant to be deferred.
+func (m *Metrics) observeCall(store, call string, startedAt time.Time) {
+	m.CallDuration.WithLabelValues(store, call).Observe(time.Since(startedAt).Seconds())
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ServeMetrics serves m on addr under /metrics until the returned server is
+// shut down. The server's Addr is the address listened on, with the port
+// picked when addr has none.
+func ServeMetrics(addr string, m *Metrics) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	server := &http.Server{Addr: listener.Addr().String(), Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("serving metrics failed", "error", err)
+		}
+	}()
+	slog.Info("serving metrics", "addr", server.Addr)
+
+	return server, nil
+}
+
+// StopMetrics shuts server down, nil meaning metrics were not served.
+func StopMetrics(server *http.Server) error {
+	if server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return server.Shutdown(ctx)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	m := NewMetrics()
+	m.PostsProcessed.WithLabelValues("fixed", StageRepair).Add(2)
+	m.PostsProcessed.WithLabelValues("unfixed", StageOS).Inc()
+	m.CallDuration.WithLabelValues("postgres", "BeginTx").Observe(0.02)
+	m.CallDuration.WithLabelValues("postgres", "BeginTx").Observe(3)
+	m.SetChunk(2, 5)
+	m.RunInfo.WithLabelValues("run-1", `fix "url"`).Set(1)
+
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	out := recorder.Body
+
+	for _, line := range []string{
+		"# TYPE onecms_repair_posts_processed_total counter",
+		`onecms_repair_posts_processed_total{stage="repair",status="fixed"} 2`,
+		`onecms_repair_posts_processed_total{stage="opensearch",status="unfixed"} 1`,
+		"# TYPE onecms_repair_call_duration_seconds histogram",
+		`onecms_repair_call_duration_seconds_bucket{call="BeginTx",store="postgres",le="0.025"} 1`,
+		`onecms_repair_call_duration_seconds_bucket{call="BeginTx",store="postgres",le="5"} 2`,
+		`onecms_repair_call_duration_seconds_bucket{call="BeginTx",store="postgres",le="+Inf"} 2`,
+		`onecms_repair_call_duration_seconds_sum{call="BeginTx",store="postgres"} 3.02`,
+		`onecms_repair_call_duration_seconds_count{call="BeginTx",store="postgres"} 2`,
+		"onecms_repair_current_chunk 2",
+		"onecms_repair_chunks 5",
+		`onecms_repair_run_info{command="fix \"url\"",run_id="run-1"} 1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("GET /metrics is missing %q in\n%s", line, out.String())
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.Retries.WithLabelValues("postgres.transaction").Add(3)
+
+	server, err := ServeMetrics("127.0.0.1:0", m)
+	if err != nil {
+		t.Fatalf("ServeMetrics() error = %v", err)
+	}
+	defer StopMetrics(server)
+
+	resp, err := http.Get("http://" + server.Addr + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics error = %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if !strings.Contains(string(body), `onecms_repair_retries_total{call="postgres.transaction"} 3`) {
+		t.Errorf("GET /metrics = %q", body)
+	}
+}
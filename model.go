@@ -1,17 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 )
 
 type Post struct {
-	ID        string
-	Title     string
-	Key       string
-	FullURL   string
-	CreatedBy string
-	CreatedAt time.Time
-	AuthorID  string
+	ID           string
+	Title        string
+	Key          string
+	FullURL      string
+	Publisher    string
+	CategoryPath string
+	CreatedBy    string
+	CreatedAt    time.Time
+	AuthorID     string
 }
 
 type BrokenPopmamaArticleCSC struct {
@@ -22,10 +25,38 @@ type BrokenPopmamaArticleCSC struct {
 	CreatorKey string
 }
 
+type FailureReason string
+
+const (
+	ReasonAuthorNotFound     FailureReason = "author_not_found"
+	ReasonPostNotFound       FailureReason = "post_not_found"
+	ReasonInvalidURL         FailureReason = "invalid_url"
+	ReasonURLCollision       FailureReason = "url_collision"
+	ReasonTransactionFailed  FailureReason = "transaction_failed"
+	ReasonDBUpdateFailed     FailureReason = "db_update_failed"
+	ReasonOSUpdateFailed     FailureReason = "os_update_failed"
+	ReasonDBConflict         FailureReason = "db_conflict"
+	ReasonUnexpectedRowCount FailureReason = "unexpected_row_count"
+
+	// ReasonOSUpdateQueued marks a post whose DB change is committed while
+	// its OpenSearch update waits in the outbox for drain-outbox.
+	ReasonOSUpdateQueued FailureReason = "os_update_queued"
+	// ReasonCompensationFailed marks a post whose OpenSearch update failed
+	// and whose DB change could not be reverted either.
+	ReasonCompensationFailed FailureReason = "compensation_failed"
+	// ReasonOSVersionConflict marks a post whose conditional OpenSearch
+	// update was refused because the document changed since it was read.
+	ReasonOSVersionConflict FailureReason = "os_version_conflict"
+	// ReasonVerificationFailed marks a post whose repair reported success
+	// while Postgres or OpenSearch, read again, disagree with it.
+	ReasonVerificationFailed FailureReason = "verification_failed"
+)
+
 type UnfixedPosts struct {
-	ID     int    `json:"id"`
-	Reason string `json:"reason"`
-	Error  string `json:"error"`
+	ID     string        `json:"id,omitempty"`
+	OldID  string        `json:"old_id,omitempty"`
+	Reason FailureReason `json:"reason"`
+	Error  string        `json:"error"`
 }
 
 type AuthorOS struct {
@@ -43,3 +74,45 @@ type AuthorGetResult struct {
 	Found  bool      `json:"found,omitempty"`
 	Source *AuthorOS `json:"_source,omitempty"`
 }
+
+type AuthorPost struct {
+	Post
+	IsPrimaryAuthor bool
+}
+
+type PostRedirect struct {
+	OldPath     string
+	NewPath     string
+	StatusCode  int
+	SourceRunID string
+}
+
+// OSOutboxEntry is an OpenSearch partial update waiting in the os_outbox
+// table. Payload is the body of the bulk update: {"doc": ...} or
+// {"script": ...}.
+type OSOutboxEntry struct {
+	ID        int64
+	DocID     string
+	Index     string
+	Payload   json.RawMessage
+	RunID     string
+	Attempts  int
+	LastError string
+}
+
+// FieldChange is a field of a post changed by a repair, with its value before
+// and after.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// PostAudit is a change of a post recorded in the repair_audit table, linking
+// it to the run that made it.
+type PostAudit struct {
+	PostID    string
+	RunID     string
+	Changes   []FieldChange
+	ChangedAt time.Time
+}
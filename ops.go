@@ -2,102 +2,301 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
-	"os"
-	"strconv"
+	"log/slog"
+	"strings"
+	"time"
 )
 
-func fixURL(ctx context.Context, onecmsDB OneCMSDB, onecmsOS OneCMSOS, startAt, endAt, osIndex string) error {
-	fmt.Printf("🔁 Calculating posts based from created at %v to %v\n", startAt, endAt)
+func fixURL(ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, startAt, endAt, osIndex string) error {
+	run.Log.Info("fetching posts by created at", "stage", StageFetch, "start_at", startAt, "end_at", endAt)
 	posts, err := onecmsDB.GetPostsByCreatedAt(ctx, startAt, endAt)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("✅ Got %v posts\n", len(posts))
+	run.Log.Info("fetched posts", "stage", StageFetch, "posts", len(posts))
 
-	chunkSize, _ := strconv.Atoi(os.Getenv("POST_CHUNK_SIZE"))
-	fmt.Printf("🔁 Chunking posts into %v\n", chunkSize)
-	chunks := Chunk(posts, chunkSize)
-	chunkLength := len(chunks)
-	fmt.Printf("✅ Got %v chunks\n", len(chunks))
-	unfixedPosts := []string{}
+	impact := newImpact(run, posts)
+	impact.sample(ctx, posts, func(ctx context.Context, post Post) (string, error) {
+		authorKey, err := onecmsDB.GetAuthorKeyByPostID(ctx, post.ID)
+		if err != nil {
+			return "", err
+		}
+		return FixURLForPublisher(post.FullURL, post.Publisher, authorKey)
+	})
+	if err := confirmImpact(run, impact); err != nil {
+		return err
+	}
+	run.Progress.Start(len(posts))
 
+	return runChunks(ctx, run, onecmsDB, onecmsOS, posts, chunkSteps[Post]{
+		describe: "fixing post url",
+		logger: func(post Post) *slog.Logger {
+			return postLogger(run, StageRepair, post.ID, "")
+		},
+		checkpoint: func(post Post) string {
+			return post.CreatedAt.Format(time.RFC3339Nano)
+		},
+		repair: func(ctx context.Context, post Post) (PostState, *UnfixedPosts) {
+			return fixPostURL(ctx, run, onecmsDB, onecmsOS, post, osIndex)
+		},
+		remaining: func(rest []Post) Impact {
+			return newImpact(run, rest)
+		},
+	}, osIndex)
+}
+
+// fixPostURL replaces the author key in the URL of the post, and returns the
+// state it left the post in.
+func fixPostURL(ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, post Post, osIndex string) (PostState, *UnfixedPosts) {
 	type postOSStructure struct {
 		ArticleURL    string `json:"article_url"`
 		ArticleURLAMP string `json:"article_url_amp"`
 	}
 
-	for i, chunk := range chunks {
-		fmt.Printf("🔁 [%d/%d] Running chunk...\n", i+1, chunkLength)
-		cl := len(chunk)
+	authorKey, err := onecmsDB.GetAuthorKeyByPostID(ctx, post.ID)
+	if err != nil || authorKey == "" {
+		return PostState{}, unfixedPost(post.ID, ReasonAuthorNotFound, "cannot find author for this post", err)
+	}
 
-		for i, post := range chunk {
-			fmt.Printf("\n\t[%d/%d] Fixing post url...", i+1, cl)
+	currentURL := post.FullURL
+	fixedURL, err := FixURLForPublisher(currentURL, post.Publisher, authorKey)
+	if err != nil {
+		return PostState{}, unfixedPost(post.ID, ReasonInvalidURL, "failed fixing url for this post", err)
+	}
 
-			authorKey, err := onecmsDB.GetAuthorKeyByPostID(ctx, post.ID)
-			if err != nil || authorKey == "" {
-				msg := fmt.Errorf("\n\t❌ Cannot find author for this post.")
-				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post url wiith ID %s, caused by: %s. Error: %s", post.ID, msg, err.Error()))
-				continue
-			}
+	if fixedURL == currentURL {
+		postLogger(run, StageRepair, post.ID, "").Debug("post url is already correct")
+		return PostState{ID: post.ID, FullURL: currentURL}, nil
+	}
 
-			currentURL := post.FullURL
-			fixedURL, err := FixURL(currentURL, authorKey)
+	fixedURL, err = uniquePostURL(ctx, run, onecmsDB, post.Publisher, post.ID, fixedURL)
+	if err != nil {
+		return PostState{}, unfixedPost(post.ID, uniqueURLFailureReason(err), "failed ensuring unique url for this post", err)
+	}
+
+	fixedAMPURL, err := AMPURL(fixedURL)
+	if err != nil {
+		return PostState{}, unfixedPost(post.ID, ReasonInvalidURL, "failed fixing amp url for this post", err)
+	}
+
+	version, err := postDocumentVersion(ctx, run, onecmsOS, post.ID, osIndex)
+	if err != nil {
+		return PostState{}, unfixedPost(post.ID, ReasonPostNotFound, "cannot read OS version of this post", err)
+	}
+
+	document := BulkUpdateAction{
+		DocID: post.ID,
+		Doc: postOSStructure{
+			ArticleURL:    fixedURL,
+			ArticleURLAMP: fixedAMPURL,
+		},
+		Version: version,
+	}
+
+	if err := savePostURL(ctx, run, onecmsDB, post.ID, currentURL, fixedURL, queueDocument(run, onecmsDB, document, osIndex)); err != nil {
+		return PostState{}, unfixedPost(post.ID, dbFailureReason(err), "failed updating DB data for this post", err)
+	}
+
+	if reason, err := updatePostDocument(ctx, run, onecmsDB, onecmsOS, document, osIndex, revertPostURL(run, onecmsDB, post.ID, currentURL, fixedURL)); err != nil {
+		return PostState{}, unfixedPost(post.ID, reason, "failed updating OS data for this post", err)
+	}
+
+	postLogger(run, StageRepair, post.ID, "").Info("fixed post url", "author_key", authorKey, "old_url", currentURL, "new_url", fixedURL)
+
+	return PostState{ID: post.ID, FullURL: fixedURL}, nil
+}
+
+func rebuildURL(ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, startAt, endAt, osIndex string, dryRun bool) error {
+	run.Log.Info("fetching posts by created at", "stage", StageFetch, "start_at", startAt, "end_at", endAt)
+	posts, err := onecmsDB.GetPostsWithCategoryByCreatedAt(ctx, startAt, endAt)
+	if err != nil {
+		return err
+	}
+	run.Log.Info("fetched posts", "stage", StageFetch, "posts", len(posts))
+
+	if !dryRun {
+		impact := newImpact(run, posts)
+		impact.sample(ctx, posts, func(ctx context.Context, post Post) (string, error) {
+			authorKey, err := onecmsDB.GetAuthorKeyByPostID(ctx, post.ID)
 			if err != nil {
-				msg := fmt.Errorf("\n\t❌ Failed fixing url for this post.")
-				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post url wiith ID %s, caused by: %s. Error: %s", post.ID, msg, err.Error()))
-				continue
+				return "", err
 			}
-
-			if err := onecmsDB.UpdateArticleURLByID(ctx, post.ID, fixedURL); err != nil {
-				msg := fmt.Errorf("\n\t❌ Failed updating DB data for this post.")
-				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post url wiith ID %s, caused by: %s. Error: %s", post.ID, msg, err.Error()))
-				continue
+			rebuiltURL, err := BuildPostURL(post, authorKey)
+			if canonicalURL, canonicalErr := CanonicalURL(post.FullURL); err == nil && canonicalErr == nil && canonicalURL == rebuiltURL {
+				return post.FullURL, nil
 			}
+			return rebuiltURL, err
+		})
+		if err := confirmImpact(run, impact); err != nil {
+			return err
+		}
+	}
+	run.Progress.Start(len(posts))
 
-			osData := postOSStructure{
-				ArticleURL:    fixedURL,
-				ArticleURLAMP: fixedURL + "/amp",
+	mismatches := 0
+	return runChunks(ctx, run, onecmsDB, onecmsOS, posts, chunkSteps[Post]{
+		describe: "rebuilding post url",
+		logger: func(post Post) *slog.Logger {
+			return postLogger(run, StageRepair, post.ID, "")
+		},
+		checkpoint: func(post Post) string {
+			return post.CreatedAt.Format(time.RFC3339Nano)
+		},
+		repair: func(ctx context.Context, post Post) (PostState, *UnfixedPosts) {
+			mismatch, unfixed := rebuildPostURL(ctx, run, onecmsDB, onecmsOS, post, osIndex, dryRun)
+			if mismatch {
+				mismatches++
 			}
+			return PostState{}, unfixed
+		},
+		summary: func() {
+			fmt.Printf("\n🔍 MISMATCHED: %d of %d posts", mismatches, len(posts))
+			run.Log.Info("mismatched posts", "stage", StageSummary, "mismatched", mismatches, "posts", len(posts))
+		},
+	}, osIndex)
+}
 
-			if err := onecmsOS.DynamicUpdate(osData, post.ID, osIndex); err != nil {
-				msg := fmt.Errorf("\n\t❌ Failed updating OS data for this post.")
-				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post url wiith ID %s, caused by: %s. Error: %s", post.ID, msg, err.Error()))
-				continue
-			}
+// rebuildPostURL reports whether the stored URL of the post differs from the
+// rebuilt one, and rewrites it unless dryRun is set.
+func rebuildPostURL(ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, post Post, osIndex string, dryRun bool) (bool, *UnfixedPosts) {
+	type postOSStructure struct {
+		ArticleURL    string `json:"article_url"`
+		ArticleURLAMP string `json:"article_url_amp"`
+	}
 
-			fmt.Printf("\n\t 🧑🏾‍💻 Author key: %s", authorKey)
-			fmt.Printf("\n\t 🌏 URL: %s -> %s", currentURL, fixedURL)
-			fmt.Printf("\n\t ✅ Success fixing post url with id %s ✔️\n", post.ID)
-		}
+	authorKey, err := onecmsDB.GetAuthorKeyByPostID(ctx, post.ID)
+	if err != nil || authorKey == "" {
+		return false, unfixedPost(post.ID, ReasonAuthorNotFound, "cannot find author for this post", err)
+	}
 
-		fmt.Println("-----🚀-----")
+	currentURL := post.FullURL
+	rebuiltURL, err := BuildPostURL(post, authorKey)
+	if err != nil {
+		return false, unfixedPost(post.ID, ReasonInvalidURL, "failed rebuilding url for this post", err)
 	}
 
-	fmt.Printf("\n🚚 UNFIXED: %v", PrettyF(unfixedPosts))
+	// Trailing slashes and AMP suffixes in the stored URL are not
+	// worth a rewrite on their own.
+	if canonicalURL, err := CanonicalURL(currentURL); err == nil && canonicalURL == rebuiltURL {
+		postLogger(run, StageRepair, post.ID, "").Debug("post url is already correct")
+		return false, nil
+	}
 
-	if len(unfixedPosts) > 0 {
-		return fmt.Errorf("\n❗Few total error: %d \n 🚚 UNFIXED: %v", len(unfixedPosts), PrettyF(unfixedPosts))
+	rebuiltURL, err = uniquePostURL(ctx, run, onecmsDB, post.Publisher, post.ID, rebuiltURL)
+	if err != nil {
+		return true, unfixedPost(post.ID, uniqueURLFailureReason(err), "failed ensuring unique url for this post", err)
 	}
 
-	return nil
+	logger := postLogger(run, StageRepair, post.ID, "").With("old_url", currentURL, "new_url", rebuiltURL)
+
+	if dryRun {
+		logger.Info("post url mismatch, left untouched by dry run")
+		return true, nil
+	}
+
+	rebuiltAMPURL, err := AMPURL(rebuiltURL)
+	if err != nil {
+		return true, unfixedPost(post.ID, ReasonInvalidURL, "failed rebuilding amp url for this post", err)
+	}
+
+	version, err := postDocumentVersion(ctx, run, onecmsOS, post.ID, osIndex)
+	if err != nil {
+		return true, unfixedPost(post.ID, ReasonPostNotFound, "cannot read OS version of this post", err)
+	}
+
+	document := BulkUpdateAction{
+		DocID: post.ID,
+		Doc: postOSStructure{
+			ArticleURL:    rebuiltURL,
+			ArticleURLAMP: rebuiltAMPURL,
+		},
+		Version: version,
+	}
+
+	if err := savePostURL(ctx, run, onecmsDB, post.ID, currentURL, rebuiltURL, queueDocument(run, onecmsDB, document, osIndex)); err != nil {
+		return true, unfixedPost(post.ID, dbFailureReason(err), "failed updating DB data for this post", err)
+	}
+
+	if reason, err := updatePostDocument(ctx, run, onecmsDB, onecmsOS, document, osIndex, revertPostURL(run, onecmsDB, post.ID, currentURL, rebuiltURL)); err != nil {
+		return true, unfixedPost(post.ID, reason, "failed updating OS data for this post", err)
+	}
+
+	logger.Info("rebuilt post url")
+
+	return true, nil
 }
 
-func fixCSCPopmama(ctx context.Context, onecmsDB OneCMSDB, onecmsOS OneCMSOS, osIndex string) error {
-	fmt.Printf("🔁 Calculating posts based from table temp_popmama_csc")
+func fixCSCPopmama(ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, osIndex string) error {
+	run.Log.Info("fetching posts from temp_popmama_csc", "stage", StageFetch)
 	posts, err := onecmsDB.GetBrokenPopmamaArticleCSC(ctx)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("✅ Got %v posts\n", len(posts))
+	run.Log.Info("fetched posts", "stage", StageFetch, "posts", len(posts))
+
+	if err := confirmImpact(run, popmamaImpact(ctx, run, onecmsDB, onecmsOS, posts)); err != nil {
+		return err
+	}
+	run.Progress.Start(len(posts))
+
+	return runChunks(ctx, run, onecmsDB, onecmsOS, posts, chunkSteps[BrokenPopmamaArticleCSC]{
+		describe: "fixing Popmama CSC article",
+		logger: func(post BrokenPopmamaArticleCSC) *slog.Logger {
+			return postLogger(run, StageRepair, "", post.OldID)
+		},
+		checkpoint: func(post BrokenPopmamaArticleCSC) string {
+			return post.OldID
+		},
+		repair: func(ctx context.Context, post BrokenPopmamaArticleCSC) (PostState, *UnfixedPosts) {
+			return fixCSCPopmamaPost(ctx, run, onecmsDB, onecmsOS, post, osIndex)
+		},
+		remaining: func(rest []BrokenPopmamaArticleCSC) Impact {
+			return Impact{Command: run.Command, Posts: len(rest), Publishers: []string{"popmama"}, Samples: []URLChange{}}
+		},
+	}, osIndex)
+}
+
+// popmamaImpact sums up the impact of repairing the Popmama CSC articles
+// posts, sampling the URL changes of the first ones. Their creation dates are
+// not known upfront.
+func popmamaImpact(ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, posts []BrokenPopmamaArticleCSC) Impact {
+	impact := Impact{Command: run.Command, Posts: len(posts), Publishers: []string{"popmama"}, Samples: []URLChange{}}
+
+	existingPosts := []Post{}
+	authorIDs := map[string]string{}
+	for i, post := range posts {
+		if i >= impactSampleAttempts {
+			break
+		}
+
+		existing, err := onecmsDB.GetPostByOldIDAndPublisher(ctx, post.OldID, "popmama")
+		if err != nil || existing == nil {
+			continue
+		}
+		existingPosts = append(existingPosts, *existing)
+		authorIDs[existing.ID] = post.AuthorID
+	}
 
-	chunkSize, _ := strconv.Atoi(os.Getenv("POST_CHUNK_SIZE"))
-	fmt.Printf("🔁 Chunking posts into %v\n", chunkSize)
-	chunks := Chunk(posts, chunkSize)
-	chunkLength := len(chunks)
-	fmt.Printf("✅ Got %v chunks\n", len(chunks))
-	unfixedPosts := []string{}
+	impact.sample(ctx, existingPosts, func(ctx context.Context, post Post) (string, error) {
+		author, err := onecmsOS.GetAuthorByID(ctx, authorIDs[post.ID])
+		if err != nil {
+			return "", err
+		}
+		if author == nil {
+			return "", errors.New("author not found")
+		}
+		return FixURLForPublisher(post.FullURL, "popmama", author.Key)
+	})
+
+	return impact
+}
 
+// fixCSCPopmamaPost repairs the URL and authors of a Popmama CSC article,
+// and returns the state it left the post in.
+func fixCSCPopmamaPost(ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, post BrokenPopmamaArticleCSC, osIndex string) (PostState, *UnfixedPosts) {
 	type postOSStructure struct {
 		ArticleURL    string     `json:"article_url"`
 		ArticleURLAMP string     `json:"article_url_amp"`
@@ -106,104 +305,744 @@ func fixCSCPopmama(ctx context.Context, onecmsDB OneCMSDB, onecmsOS OneCMSOS, os
 
 	publisher := "popmama"
 
-	for i, chunk := range chunks {
-		fmt.Printf("🔁 [%d/%d] Running chunk...\n", i+1, chunkLength)
-		cl := len(chunk)
+	postAuthor, err := onecmsOS.GetAuthorByID(ctx, post.AuthorID)
+	if err != nil || postAuthor == nil {
+		return PostState{}, unfixedOldPost(post.OldID, ReasonAuthorNotFound, "cannot find author of this post", err)
+	}
 
-		for i, post := range chunk {
-			fmt.Printf("\n\t[%d/%d] Fixing Popmama CSC article...", i+1, cl)
+	postCreator, err := onecmsOS.GetAuthorByID(ctx, post.CreatedBy)
+	if err != nil || postCreator == nil {
+		return PostState{}, unfixedOldPost(post.OldID, ReasonAuthorNotFound, "cannot find creator of this post", err)
+	}
 
-			postAuthor, err := onecmsOS.GetAuthorByID(post.AuthorID)
-			if err != nil || postAuthor == nil {
-				msg := fmt.Errorf("\n\t❌ Cannot find author of this post.")
-				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post with old id: %s, caused by: %s. Error: %s", post.OldID, msg, err.Error()))
-				continue
-			}
+	postExisting, err := onecmsDB.GetPostByOldIDAndPublisher(ctx, post.OldID, publisher)
+	if err != nil || postExisting == nil {
+		return PostState{}, unfixedOldPost(post.OldID, ReasonPostNotFound, "cannot find post with this old id", err)
+	}
 
-			postCreator, err := onecmsOS.GetAuthorByID(post.CreatedBy)
-			if err != nil || postCreator == nil {
-				msg := fmt.Errorf("\n\t❌ Cannot find creator of this post.")
-				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post with old id: %s, caused by: %s. Error: %s", post.OldID, msg, err.Error()))
-				continue
-			}
+	version, err := postDocumentVersion(ctx, run, onecmsOS, postExisting.ID, osIndex)
+	if err != nil {
+		return PostState{}, unfixedOldPost(post.OldID, ReasonPostNotFound, "cannot read OS version of this post", err)
+	}
+	original := *postExisting
+
+	fixedURL, err := FixURLForPublisher(postExisting.FullURL, publisher, postAuthor.Key)
+	if err != nil {
+		return PostState{}, unfixedOldPost(post.OldID, ReasonInvalidURL, "failed generate fixed url for this post", err)
+	}
+
+	fixedURL, err = uniquePostURL(ctx, run, onecmsDB, publisher, postExisting.ID, fixedURL)
+	if err != nil {
+		return PostState{}, unfixedOldPost(post.OldID, uniqueURLFailureReason(err), "failed ensuring unique url for this post", err)
+	}
+
+	fixedAMPURL, err := AMPURL(fixedURL)
+	if err != nil {
+		return PostState{}, unfixedOldPost(post.OldID, ReasonInvalidURL, "failed generate fixed amp url for this post", err)
+	}
+
+	currentURL := original.FullURL
+	fixedPost := original
+	fixedPost.FullURL = fixedURL
+	fixedPost.AuthorID = postAuthor.Key
+
+	document := BulkUpdateAction{
+		DocID: postExisting.ID,
+		Doc: postOSStructure{
+			ArticleURL:    fixedURL,
+			ArticleURLAMP: fixedAMPURL,
+			Authors:       []AuthorOS{*postAuthor},
+		},
+		Version: version,
+	}
+
+	// TODO: Fixing section here
+	// A transient failure starts the whole transaction over, unfixed holds
+	// the failure of the last attempt. The post authors are read under the
+	// lock of the post, so the audit and the compensation get the ones the
+	// repair replaced.
+	var unfixed *UnfixedPosts
+	var postAuthorIDs []string
+	fail := func(reason FailureReason, message string, err error) error {
+		unfixed = unfixedOldPost(post.OldID, reason, message, err)
+		return err
+	}
+
+	err = retry(ctx, run, "postgres.transaction", func(ctx context.Context) error {
+		transactionDB, err := onecmsDB.BeginTx(ctx)
+		if err != nil {
+			return fail(ReasonTransactionFailed, "failed starting transaction", err)
+		}
+
+		locked, err := onecmsDB.GetPostForUpdate(ctx, transactionDB, postExisting.ID)
+		if err != nil {
+			return fail(dbFailureReason(err), "failed locking this post", err)
+		}
+		if locked.FullURL != original.FullURL || locked.AuthorID != original.AuthorID {
+			onecmsDB.Rollback(ctx, transactionDB)
+			return fail(ReasonDBConflict, "post changed since it was read", ErrPostChanged)
+		}
+
+		postAuthorIDs, err = onecmsDB.GetPostAuthorIDs(ctx, transactionDB, postExisting.ID)
+		if err != nil {
+			return fail(dbFailureReason(err), "failed reading authors of this post", err)
+		}
+
+		rows, err := onecmsDB.UpdateBrokenPopmamaArticleCSC(ctx, transactionDB, postExisting.ID, fixedPost)
+		if err := expectRows(ctx, onecmsDB, transactionDB, "post update", rows, 1, err); err != nil {
+			return fail(dbFailureReason(err), "failed updating DB data for this post", err)
+		}
+
+		rows, err = onecmsDB.FlushPostAuthors(ctx, transactionDB, postExisting.ID)
+		if err := expectRows(ctx, onecmsDB, transactionDB, "post authors flush", rows, int64(len(postAuthorIDs)), err); err != nil {
+			return fail(dbFailureReason(err), "failed flushing post authors for this post", err)
+		}
+
+		rows, err = onecmsDB.SetPostAuthor(ctx, transactionDB, postExisting.ID, postAuthor.Key, 0)
+		if err := expectRows(ctx, onecmsDB, transactionDB, "post author insert", rows, 1, err); err != nil {
+			return fail(dbFailureReason(err), "failed setting post author for this post", err)
+		}
 
-			postExisting, err := onecmsDB.GetPostByOldIDAndPublisher(ctx, post.OldID, publisher)
-			if err != nil || postExisting == nil {
-				msg := fmt.Errorf("\n\t❌ Cannot find post with old id: %s.", post.OldID)
-				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post with old id: %s, caused by: %s. Error: %s", post.OldID, msg, err.Error()))
-				continue
+		if err := saveAudit(ctx, run, onecmsDB, transactionDB, postExisting.ID, popmamaPostChanges(original, fixedPost, postAuthorIDs, []string{postAuthor.Key})...); err != nil {
+			return fail(dbFailureReason(err), "failed recording the audit of this post", err)
+		}
+
+		if err := saveRedirects(ctx, run, onecmsDB, transactionDB, currentURL, fixedURL); err != nil {
+			return fail(dbFailureReason(err), "failed saving redirects for this post", err)
+		}
+
+		if queue := queueDocument(run, onecmsDB, document, osIndex); queue != nil {
+			if err := queue(ctx, transactionDB); err != nil {
+				return fail(dbFailureReason(err), "failed queueing OS data for this post", err)
 			}
+		}
 
-			// TODO: Fixing section here
+		if err := onecmsDB.Commit(ctx, transactionDB); err != nil {
+			return fail(ReasonTransactionFailed, "failed committing transaction", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return PostState{}, unfixed
+	}
+	recordRedirect(run, currentURL, fixedURL)
+
+	compensate := restorePopmamaPost(run, onecmsDB, original, fixedPost, postAuthorIDs)
+	if reason, err := updatePostDocument(ctx, run, onecmsDB, onecmsOS, document, osIndex, compensate); err != nil {
+		return PostState{}, unfixedOldPost(post.OldID, reason, "failed updating OS data for this post", err)
+	}
+
+	postLogger(run, StageRepair, postExisting.ID, post.OldID).Info("fixed Popmama CSC article", "author_key", postAuthor.Key, "old_url", currentURL, "new_url", fixedURL)
+
+	return PostState{ID: postExisting.ID, OldID: post.OldID, FullURL: fixedURL, AuthorIDs: []string{postAuthor.Key}, Authors: []AuthorOS{*postAuthor}}, nil
+}
+
+// restorePopmamaPost returns the compensation of a Popmama CSC repair: the
+// post gets its old URL, author and post authors back, with the reverse
+// redirects.
+func restorePopmamaPost(run *Run, onecmsDB OneCMSDB, original, fixedPost Post, authorIDs []string) func(ctx context.Context) error {
+	fixedURL := fixedPost.FullURL
+
+	return func(ctx context.Context) error {
+		err := retry(ctx, run, "postgres.transaction", func(ctx context.Context) error {
 			transactionDB, err := onecmsDB.BeginTx(ctx)
 			if err != nil {
-				msg := fmt.Errorf("\n\t❌ Failed starting transaction.")
-				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post with old id: %s, caused by: %s. Error: %s", post.OldID, msg, err.Error()))
-				continue
+				return err
 			}
 
-			fixedURL, err := FixURL(postExisting.FullURL, postAuthor.Key)
+			locked, err := onecmsDB.GetPostForUpdate(ctx, transactionDB, original.ID)
 			if err != nil {
-				transactionDB.Rollback()
-				msg := fmt.Errorf("\n\t❌ Failed generate fixed url for this post.")
-				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post with old id: %s, caused by: %s. Error: %s", post.OldID, msg, err.Error()))
-				continue
+				return err
+			}
+			if locked.FullURL != fixedURL {
+				onecmsDB.Rollback(ctx, transactionDB)
+				return ErrPostChanged
+			}
+
+			rows, err := onecmsDB.UpdateBrokenPopmamaArticleCSC(ctx, transactionDB, original.ID, original)
+			if err := expectRows(ctx, onecmsDB, transactionDB, "post update", rows, 1, err); err != nil {
+				return err
+			}
+
+			// The repair left the post with a single author.
+			rows, err = onecmsDB.FlushPostAuthors(ctx, transactionDB, original.ID)
+			if err := expectRows(ctx, onecmsDB, transactionDB, "post authors flush", rows, 1, err); err != nil {
+				return err
+			}
+
+			for i, authorID := range authorIDs {
+				rows, err := onecmsDB.SetPostAuthor(ctx, transactionDB, original.ID, authorID, i)
+				if err := expectRows(ctx, onecmsDB, transactionDB, "post author insert", rows, 1, err); err != nil {
+					return err
+				}
+			}
+
+			if err := saveAudit(ctx, run, onecmsDB, transactionDB, original.ID, popmamaPostChanges(fixedPost, original, []string{fixedPost.AuthorID}, authorIDs)...); err != nil {
+				return err
 			}
 
-			postExisting.FullURL = fixedURL
-			postExisting.CreatedBy = postCreator.Key
-			postExisting.AuthorID = postAuthor.Key
+			if err := saveRedirects(ctx, run, onecmsDB, transactionDB, fixedURL, original.FullURL); err != nil {
+				return err
+			}
+
+			return onecmsDB.Commit(ctx, transactionDB)
+		})
+		if err != nil {
+			return err
+		}
+		recordRedirect(run, fixedURL, original.FullURL)
+
+		return nil
+	}
+}
 
-			if err := onecmsDB.UpdateBrokenPopmamaArticleCSC(ctx, transactionDB, post.OldID, *postExisting); err != nil {
-				msg := fmt.Errorf("\n\t❌ Failed updating DB data for this post.")
-				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post with old id: %s, caused by: %s. Error: %s", post.OldID, msg, err.Error()))
-				continue
+// authorPropagationScript swaps the embedded author object in place so the
+// other authors of the post are left untouched, and rewrites the post URL
+// when one is given.
+const authorPropagationScript = `
+	if (params.article_url != null) {
+		ctx._source.article_url = params.article_url;
+		ctx._source.article_url_amp = params.article_url_amp;
+	}
+	if (ctx._source.authors != null) {
+		for (int i = 0; i < ctx._source.authors.size(); i++) {
+			if (ctx._source.authors[i].uuid == params.author.uuid) {
+				ctx._source.authors[i] = params.author;
 			}
+		}
+	}
+`
+
+func propagateAuthor(ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, authorID, osIndex string) error {
+	run.Log.Info("fetching author", "stage", StageFetch, "author_id", authorID)
+	author, err := onecmsOS.GetAuthorByID(ctx, authorID)
+	if err != nil {
+		return err
+	}
+	run.Log.Info("fetched author", "stage", StageFetch, "author_id", authorID, "author_name", author.Name, "author_key", author.Key)
+
+	posts, err := onecmsDB.GetPostsByAuthorID(ctx, authorID)
+	if err != nil {
+		return err
+	}
+	run.Log.Info("fetched posts linked to author", "stage", StageFetch, "author_id", authorID, "posts", len(posts))
+
+	linkedPosts := []Post{}
+	primary := map[string]bool{}
+	for _, post := range posts {
+		linkedPosts = append(linkedPosts, post.Post)
+		primary[post.ID] = post.IsPrimaryAuthor
+	}
+	impact := newImpact(run, linkedPosts)
+	impact.sample(ctx, linkedPosts, func(ctx context.Context, post Post) (string, error) {
+		if !primary[post.ID] {
+			return post.FullURL, nil
+		}
+		return FixURLForPublisher(post.FullURL, post.Publisher, author.Key)
+	})
+	if err := confirmImpact(run, impact); err != nil {
+		return err
+	}
+	run.Progress.Start(len(posts))
+
+	var authorParam map[string]interface{}
+	if err := ParseDataAs(author, &authorParam); err != nil {
+		return err
+	}
+
+	actions := []BulkUpdateAction{}
+	compensations := map[string]func(ctx context.Context) error{}
 
-			if err := onecmsDB.FlushPostAuthors(ctx, transactionDB, postExisting.ID); err != nil {
-				msg := fmt.Errorf("\n\t❌ Failed flushing post authors for this post.")
-				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post with old id: %s, caused by: %s. Error: %s", post.OldID, msg, err.Error()))
-				continue
+	return runChunks(ctx, run, onecmsDB, onecmsOS, posts, chunkSteps[AuthorPost]{
+		describe: "propagating author",
+		logger: func(post AuthorPost) *slog.Logger {
+			return postLogger(run, StageRepair, post.ID, "")
+		},
+		checkpoint: func(post AuthorPost) string {
+			return post.ID
+		},
+		repair: func(ctx context.Context, post AuthorPost) (PostState, *UnfixedPosts) {
+			action, compensate, unfixed := authorPostAction(ctx, run, onecmsDB, post, author, authorParam, osIndex)
+			if unfixed != nil {
+				return PostState{}, unfixed
 			}
+			actions = append(actions, action)
+			compensations[action.DocID] = compensate
+			return authorPostState(post, action, author), nil
+		},
+		endChunk: func(ctx context.Context, chunk []AuthorPost, states []PostState) ([]PostState, []UnfixedPosts) {
+			defer func() {
+				actions = []BulkUpdateAction{}
+				compensations = map[string]func(ctx context.Context) error{}
+			}()
 
-			if err := onecmsDB.SetPostAuthor(ctx, transactionDB, postExisting.ID, postAuthor.Key, 0); err != nil {
-				msg := fmt.Errorf("\n\t❌ Failed setting post author for this post.")
-				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post with old id: %s, caused by: %s. Error: %s", post.OldID, msg, err.Error()))
-				continue
+			if run.OSWriteMode == OSWriteOutbox {
+				run.postsDone(StageOutbox, len(actions))
+				run.Log.Info("queued chunk in the outbox", "stage", StageOutbox, "queued", len(actions), "chunk_posts", len(chunk))
+				return states, nil
 			}
 
-			osData := postOSStructure{
-				ArticleURL:    fixedURL,
-				ArticleURLAMP: fixedURL + "/amp",
-				Authors:       []AuthorOS{*postAuthor},
+			// Posts already rewritten in Postgres still get their documents
+			// updated when the run is stopped mid-chunk.
+			itemErrors, err := onecmsOS.BulkUpdate(context.WithoutCancel(ctx), actions, osIndex)
+			unfixedPosts := []UnfixedPosts{}
+			failed := map[string]bool{}
+			for _, action := range actions {
+				osErr := err
+				if osErr == nil {
+					osErr = itemErrors[action.DocID]
+				}
+				if osErr == nil {
+					continue
+				}
+
+				failed[action.DocID] = true
+				reason, osErr := handleOSFailure(ctx, run, onecmsDB, action, osIndex, osErr, compensations[action.DocID])
+				unfixed := unfixedPost(action.DocID, reason, "failed updating OS data for this post", osErr)
+				unfixedPosts = append(unfixedPosts, *unfixed)
+				run.postsDone(StageOS, 0, *unfixed)
 			}
 
-			if err := onecmsOS.DynamicUpdate(osData, postExisting.ID, osIndex); err != nil {
-				transactionDB.Rollback()
-				msg := fmt.Errorf("\n\t❌ Failed updating OS data for this post.")
-				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post with old id: %s, caused by: %s. Error: %s", post.OldID, msg, err.Error()))
-				continue
+			run.postsDone(StageOS, len(actions)-len(failed))
+			run.Log.Info("updated chunk in OpenSearch", "stage", StageOS, "updated", len(actions)-len(failed), "chunk_posts", len(chunk))
+
+			updated := []PostState{}
+			for _, state := range states {
+				if !failed[state.ID] {
+					updated = append(updated, state)
+				}
 			}
 
-			if err := transactionDB.Commit(); err != nil {
-				msg := fmt.Errorf("\n\t❌ Failed committing transaction.")
-				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post with old id: %s, caused by: %s. Error: %s", post.OldID, msg, err.Error()))
-				continue
+			return updated, unfixedPosts
+		},
+	}, osIndex)
+}
+
+// authorPostAction rewrites the URL of a post whose primary author is the
+// propagated one, and returns the bulk action updating its document with the
+// compensation of the URL change, nil when the URL is kept. When the run
+// writes through the outbox, the action is queued instead, with the URL change
+// when there is one.
+func authorPostAction(ctx context.Context, run *Run, onecmsDB OneCMSDB, post AuthorPost, author *AuthorOS, authorParam map[string]interface{}, osIndex string) (BulkUpdateAction, func(ctx context.Context) error, *UnfixedPosts) {
+	params := map[string]interface{}{
+		"author":          authorParam,
+		"article_url":     nil,
+		"article_url_amp": nil,
+	}
+	action := BulkUpdateAction{
+		DocID: post.ID,
+		Script: &OSScript{
+			Source: authorPropagationScript,
+			Lang:   "painless",
+			Params: params,
+		},
+	}
+	queue := queueDocument(run, onecmsDB, action, osIndex)
+	var compensate func(ctx context.Context) error
+
+	if post.IsPrimaryAuthor {
+		fixedURL, err := FixURLForPublisher(post.FullURL, post.Publisher, author.Key)
+		if err != nil {
+			return BulkUpdateAction{}, nil, unfixedPost(post.ID, ReasonInvalidURL, "failed fixing url for this post", err)
+		}
+
+		fixedURL, err = uniquePostURL(ctx, run, onecmsDB, post.Publisher, post.ID, fixedURL)
+		if err != nil {
+			return BulkUpdateAction{}, nil, unfixedPost(post.ID, uniqueURLFailureReason(err), "failed ensuring unique url for this post", err)
+		}
+
+		fixedAMPURL, err := AMPURL(fixedURL)
+		if err != nil {
+			return BulkUpdateAction{}, nil, unfixedPost(post.ID, ReasonInvalidURL, "failed fixing amp url for this post", err)
+		}
+
+		params["article_url"] = fixedURL
+		params["article_url_amp"] = fixedAMPURL
+
+		if fixedURL != post.FullURL {
+			if err := savePostURL(ctx, run, onecmsDB, post.ID, post.FullURL, fixedURL, queue); err != nil {
+				return BulkUpdateAction{}, nil, unfixedPost(post.ID, dbFailureReason(err), "failed updating DB data for this post", err)
 			}
+			queue = nil
+			compensate = revertPostURL(run, onecmsDB, post.ID, post.FullURL, fixedURL)
+			postLogger(run, StageRepair, post.ID, "").Info("fixed post url", "author_key", author.Key, "old_url", post.FullURL, "new_url", fixedURL)
+		}
+	}
 
-			fmt.Printf("\n\t 🧑🏾‍💻 Author key: %s", postAuthor.Key)
-			fmt.Printf("\n\t 🌏 URL: %s -> %s", postExisting.FullURL, fixedURL)
-			fmt.Printf("\n\t ✅ Success fixing post url with id %s ✔️\n", postExisting.ID)
+	if queue != nil {
+		if err := queue(ctx, nil); err != nil {
+			return BulkUpdateAction{}, nil, unfixedPost(post.ID, ReasonDBUpdateFailed, "failed queueing OS data for this post", err)
 		}
+	}
 
-		fmt.Println("-----🚀-----")
+	return action, compensate, nil
+}
+
+// authorPostState is the state the action of a propagated post leaves it in:
+// its rewritten URL, or the one it has, and the author listed as propagated.
+func authorPostState(post AuthorPost, action BulkUpdateAction, author *AuthorOS) PostState {
+	state := PostState{ID: post.ID, FullURL: post.FullURL, Authors: []AuthorOS{*author}}
+	if fixedURL, ok := action.Script.Params["article_url"].(string); ok {
+		state.FullURL = fixedURL
 	}
 
-	fmt.Printf("\n🚚 UNFIXED: %v", PrettyF(unfixedPosts))
+	return state
+}
 
-	if len(unfixedPosts) > 0 {
-		return fmt.Errorf("\n❗Few total error: %d \n 🚚 UNFIXED: %v", len(unfixedPosts), PrettyF(unfixedPosts))
+// recordRedirect adds the old to new URL redirect of a post to the run's
+// redirect map. A URL that cannot be parsed only gets a warning since the post
+// itself has already been repaired.
+func recordRedirect(run *Run, oldURL, newURL string) {
+	if err := run.Redirects.Add(oldURL, newURL); err != nil {
+		run.Log.Warn("no redirect recorded", "stage", StageRepair, "url", oldURL, "error", err.Error())
+	}
+}
+
+// savePostURL updates the URL of a post and stores its redirects in a single
+// transaction, then adds them to the run's redirect map. A non nil queue runs
+// in the same transaction, see queueDocument.
+func savePostURL(ctx context.Context, run *Run, onecmsDB OneCMSDB, postID, oldURL, newURL string, queue func(ctx context.Context, transactionDB *sql.Tx) error) error {
+	err := retry(ctx, run, "postgres.transaction", func(ctx context.Context) error {
+		transactionDB, err := onecmsDB.BeginTx(ctx)
+		if err != nil {
+			return err
+		}
+
+		// The update only matches while the post still has oldURL.
+		rows, err := onecmsDB.UpdateArticleURLByID(ctx, transactionDB, postID, oldURL, newURL)
+		if err == nil && rows == 0 {
+			onecmsDB.Rollback(ctx, transactionDB)
+			return ErrPostChanged
+		}
+		if err := expectRows(ctx, onecmsDB, transactionDB, "post url update", rows, 1, err); err != nil {
+			return err
+		}
+
+		if err := saveAudit(ctx, run, onecmsDB, transactionDB, postID, FieldChange{Field: "full_url", Old: oldURL, New: newURL}); err != nil {
+			return err
+		}
+
+		if err := saveRedirects(ctx, run, onecmsDB, transactionDB, oldURL, newURL); err != nil {
+			return err
+		}
+
+		if queue != nil {
+			if err := queue(ctx, transactionDB); err != nil {
+				return err
+			}
+		}
+
+		return onecmsDB.Commit(ctx, transactionDB)
+	})
+	if err != nil {
+		return err
+	}
+
+	recordRedirect(run, oldURL, newURL)
+
+	return nil
+}
+
+// saveRedirects stores the redirects of a URL change in the run's redirects
+// table, inside the transaction of the change.
+func saveRedirects(ctx context.Context, run *Run, onecmsDB OneCMSDB, transactionDB *sql.Tx, oldURL, newURL string) error {
+	if run.RedirectsTable == "" {
+		return nil
+	}
+
+	redirects, err := RedirectsFor(oldURL, newURL)
+	if err != nil {
+		run.Log.Warn("no redirect stored", "stage", StageRepair, "url", oldURL, "error", err.Error())
+		return nil
+	}
+
+	for _, redirect := range redirects {
+		rows, err := onecmsDB.SaveRedirect(ctx, transactionDB, run.RedirectsTable, PostRedirect{
+			OldPath:     redirect.From,
+			NewPath:     redirect.To,
+			StatusCode:  run.RedirectStatusCode,
+			SourceRunID: run.ID,
+		})
+		if err := expectRows(ctx, onecmsDB, transactionDB, "redirect insert", rows, 1, err); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+// saveAudit records the changes of a post in the audit trail, inside the
+// transaction of the change, so every committed change is linked to the run.
+// A write changing nothing leaves no audit.
+func saveAudit(ctx context.Context, run *Run, onecmsDB OneCMSDB, transactionDB *sql.Tx, postID string, changes ...FieldChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	rows, err := onecmsDB.SaveAudit(ctx, transactionDB, PostAudit{PostID: postID, RunID: run.ID, Changes: changes})
+
+	return expectRows(ctx, onecmsDB, transactionDB, "audit insert", rows, 1, err)
+}
+
+// popmamaPostChanges lists the fields a Popmama CSC repair, or its
+// compensation, changes from before to after. Unchanged fields are left out.
+func popmamaPostChanges(before, after Post, authorIDsBefore, authorIDsAfter []string) []FieldChange {
+	candidates := []FieldChange{
+		{Field: "full_url", Old: before.FullURL, New: after.FullURL},
+		{Field: "author_id", Old: before.AuthorID, New: after.AuthorID},
+		{Field: "post_authors", Old: strings.Join(authorIDsBefore, ","), New: strings.Join(authorIDsAfter, ",")},
+	}
+
+	changes := []FieldChange{}
+	for _, change := range candidates {
+		if change.Old != change.New {
+			changes = append(changes, change)
+		}
+	}
+
+	return changes
+}
+
+// updatePostDocument applies the OpenSearch update of a post once its DB
+// change is committed. When it fails, handleOSFailure keeps the two
+// consistent. Nothing is sent when the run writes through the outbox, since
+// the update was queued with the DB change.
+func updatePostDocument(ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, document BulkUpdateAction, osIndex string, compensate func(ctx context.Context) error) (FailureReason, error) {
+	if run.OSWriteMode == OSWriteOutbox {
+		return "", nil
+	}
+
+	err := writePostDocument(ctx, run, onecmsOS, document, osIndex)
+	if err == nil {
+		return "", nil
+	}
+
+	reason, err := handleOSFailure(ctx, run, onecmsDB, document, osIndex, err, compensate)
+	if reason == ReasonOSUpdateFailed && isVersionConflict(err) {
+		reason = ReasonOSVersionConflict
+	}
+
+	return reason, err
+}
+
+// postDocumentVersion reads the version of the document of a post before its
+// DB change, when the run sends conditional updates. It returns nil
+// otherwise.
+func postDocumentVersion(ctx context.Context, run *Run, onecmsOS OneCMSOS, postID, osIndex string) (*DocVersion, error) {
+	if run.OSConcurrency == OSConcurrencyOff || run.OSWriteMode == OSWriteOutbox {
+		return nil, nil
+	}
+
+	return onecmsOS.GetDocumentVersion(ctx, postID, osIndex)
+}
+
+// writePostDocument sends the OpenSearch update of a post, conditionally on
+// its version when it has one. With OSConcurrencyRetry, a version conflict
+// re-reads the version and sends the update again.
+func writePostDocument(ctx context.Context, run *Run, onecmsOS OneCMSOS, document BulkUpdateAction, osIndex string) error {
+	if document.Version == nil {
+		return onecmsOS.DynamicUpdate(ctx, document.Doc, document.DocID, osIndex)
+	}
+
+	attempts := 0
+	for {
+		attempts++
+		itemErrors, err := onecmsOS.BulkUpdate(ctx, []BulkUpdateAction{document}, osIndex)
+		if err == nil {
+			err = itemErrors[document.DocID]
+		}
+		if !isVersionConflict(err) || run.OSConcurrency != OSConcurrencyRetry || attempts >= run.RetryMaxAttempts {
+			run.recordAttempts("opensearch.conditionalUpdate", attempts, err)
+			return err
+		}
+
+		postLogger(run, StageOS, document.DocID, "").Info("post changed in OpenSearch, re-reading its version", "attempt", attempts)
+		document.Version, err = onecmsOS.GetDocumentVersion(ctx, document.DocID, osIndex)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleOSFailure deals with a failed OpenSearch update whose DB change is
+// already committed, following the run's OSFailureStrategy: the update is
+// queued in the outbox, or the DB change is reverted with compensate. A nil
+// compensate means there is nothing to revert. It always returns the failure
+// reason and error to report for the post.
+func handleOSFailure(ctx context.Context, run *Run, onecmsDB OneCMSDB, action BulkUpdateAction, osIndex string, osErr error, compensate func(ctx context.Context) error) (FailureReason, error) {
+	// The DB change is committed, so this must finish even when the post
+	// timed out or the run was aborted.
+	ctx = context.WithoutCancel(ctx)
+
+	// A version conflict means the document was re-indexed since it was
+	// read. Queueing the update would overwrite it later, so it is
+	// compensated instead.
+	if run.OSFailureStrategy == OSFailureOutbox && !isVersionConflict(osErr) {
+		if err := enqueueOSUpdate(ctx, run, onecmsDB, nil, action, osIndex, osErr); err != nil {
+			return ReasonOSUpdateFailed, fmt.Errorf("%w, and queueing it in the outbox failed: %v", osErr, err)
+		}
+
+		return ReasonOSUpdateQueued, fmt.Errorf("%w, queued in the outbox", osErr)
+	}
+
+	if compensate == nil {
+		return ReasonOSUpdateFailed, osErr
+	}
+
+	if err := compensate(ctx); err != nil {
+		return ReasonCompensationFailed, fmt.Errorf("%w, and reverting the DB change failed: %v", osErr, err)
+	}
+
+	return ReasonOSUpdateFailed, fmt.Errorf("%w, DB change reverted", osErr)
+}
+
+// revertPostURL returns the compensation of a URL change: the post gets its
+// old URL back, with the reverse redirects.
+func revertPostURL(run *Run, onecmsDB OneCMSDB, postID, oldURL, newURL string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return savePostURL(ctx, run, onecmsDB, postID, newURL, oldURL, nil)
+	}
+}
+
+// maxURLDisambiguations bounds how many numbered slugs URLCollisionSuffix
+// tries before giving up on a post.
+const maxURLDisambiguations = 20
+
+type URLCollisionError struct {
+	URL    string
+	PostID string
+}
+
+func (e *URLCollisionError) Error() string {
+	return fmt.Sprintf("url %s is already used by post %s", e.URL, e.PostID)
+}
+
+// uniquePostURL checks that no other post of the publisher uses fixedURL
+// before it is written. On a collision it returns a *URLCollisionError, or a
+// numbered variant of the URL with URLCollisionSuffix.
+func uniquePostURL(ctx context.Context, run *Run, onecmsDB OneCMSDB, publisher, postID, fixedURL string) (string, error) {
+	candidate := fixedURL
+
+	for n := 2; ; n++ {
+		existingID, err := onecmsDB.GetPostIDByURL(ctx, publisher, candidate, postID)
+		if err != nil {
+			return "", err
+		}
+		if existingID == "" {
+			return candidate, nil
+		}
+
+		collision := &URLCollisionError{URL: candidate, PostID: existingID}
+		if run.URLCollisionStrategy != URLCollisionSuffix || n > maxURLDisambiguations+1 {
+			return "", collision
+		}
+
+		candidate, err = DisambiguateURL(fixedURL, publisher, n)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", collision, err)
+		}
+	}
+}
+
+func uniqueURLFailureReason(err error) FailureReason {
+	var collision *URLCollisionError
+	if errors.As(err, &collision) {
+		return ReasonURLCollision
+	}
+
+	return ReasonDBUpdateFailed
+}
+
+// UnexpectedRowsError is a statement that affected another number of rows
+// than expected, like a by-ID update matching no post.
+type UnexpectedRowsError struct {
+	Statement string
+	Rows      int64
+	Expected  int64
+}
+
+func (e *UnexpectedRowsError) Error() string {
+	return fmt.Sprintf("%s affected %d rows, expected %d", e.Statement, e.Rows, e.Expected)
+}
+
+// expectRows checks the rows affected by a statement that returned err, and
+// rolls transactionDB back, when given, if they are not the expected count.
+func expectRows(ctx context.Context, onecmsDB OneCMSDB, transactionDB *sql.Tx, statement string, rows, expected int64, err error) error {
+	if err != nil {
+		return err
+	}
+	if rows == expected {
+		return nil
+	}
+
+	if transactionDB != nil {
+		onecmsDB.Rollback(ctx, transactionDB)
+	}
+
+	return &UnexpectedRowsError{Statement: statement, Rows: rows, Expected: expected}
+}
+
+// dbFailureReason is the failure reason of a DB change that failed with err.
+func dbFailureReason(err error) FailureReason {
+	var rowsErr *UnexpectedRowsError
+	switch {
+	case errors.Is(err, ErrPostChanged):
+		return ReasonDBConflict
+	case errors.As(err, &rowsErr):
+		return ReasonUnexpectedRowCount
+	}
+
+	return ReasonDBUpdateFailed
+}
+
+func unfixedPost(postID string, reason FailureReason, message string, err error) *UnfixedPosts {
+	if err != nil {
+		message += ": " + err.Error()
+	}
+
+	return &UnfixedPosts{ID: postID, Reason: reason, Error: message}
+}
+
+func unfixedOldPost(oldID string, reason FailureReason, message string, err error) *UnfixedPosts {
+	unfixed := unfixedPost("", reason, message, err)
+	unfixed.OldID = oldID
+
+	return unfixed
+}
+
+func countByReason(unfixedPosts []UnfixedPosts) map[FailureReason]int {
+	counts := map[FailureReason]int{}
+	for _, unfixed := range unfixedPosts {
+		counts[unfixed.Reason]++
+	}
+
+	return counts
+}
+
+// printSummary shows the outcome of the run on stdout, quiet or not, and logs
+// it.
+func printSummary(run *Run, unfixedPosts []UnfixedPosts) {
+	run.Progress.Finish()
+	fmt.Printf("\n🔀 REDIRECTS: %d", run.Redirects.Len())
+	fmt.Printf("\n🚚 UNFIXED: %v", PrettyF(unfixedPosts))
+	fmt.Printf("\n🧾 UNFIXED BY REASON: %v", PrettyF(countByReason(unfixedPosts)))
+
+	run.Log.Info("run summary", "stage", StageSummary, "redirects", run.Redirects.Len(), "unfixed", len(unfixedPosts), "unfixed_by_reason", countByReason(unfixedPosts))
+}
+
+// UnfixedPostsError is the error of a run that left posts unfixed, listing
+// them all.
+type UnfixedPostsError struct {
+	Posts []UnfixedPosts
+}
+
+func (err *UnfixedPostsError) Error() string {
+	return fmt.Sprintf("\n❗Few total error: %d \n 🚚 UNFIXED: %v", len(err.Posts), PrettyF(err.Posts))
+}
+
+// runStoppedError reports a run cancelled or timed out before every post was
+// processed. Posts in flight when it happened were finished or rolled back.
+func runStoppedError(err error, processed, total int) error {
+	return fmt.Errorf("\n⛔ Run stopped after %d of %d posts: %w", processed, total, err)
+}
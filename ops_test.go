@@ -5,9 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 // MockOneCMSOS is a mock implementation of the OneCMSOS interface for testing
@@ -15,14 +19,76 @@ type MockOneCMSOS struct {
 	DynamicUpdateCalled bool
 	DynamicUpdateErr    error
 	GetAuthorByIDFunc   func(id string) (*AuthorOS, error)
+	BulkActions         []BulkUpdateAction
+	BulkItemErrors      map[string]error
+	BulkUpdateErr       error
+	VersionReads        int
+	VersionConflicts    int
+	Documents           map[string]PostDocument
+	StaleDocIDs         map[string]bool
 }
 
-func (m *MockOneCMSOS) DynamicUpdate(data interface{}, id string, index string) error {
+func (m *MockOneCMSOS) DynamicUpdate(ctx context.Context, data interface{}, id string, index string) error {
 	m.DynamicUpdateCalled = true
-	return m.DynamicUpdateErr
+	if m.DynamicUpdateErr != nil {
+		return m.DynamicUpdateErr
+	}
+	m.storeDocument(id, data)
+	return nil
+}
+
+// storeDocument keeps the fields of a doc update, so they can be read back,
+// unless the document is meant to stay stale.
+func (m *MockOneCMSOS) storeDocument(id string, data interface{}) {
+	if m.StaleDocIDs[id] {
+		return
+	}
+	var document PostDocument
+	if err := ParseDataAs(data, &document); err != nil {
+		return
+	}
+	if m.Documents == nil {
+		m.Documents = map[string]PostDocument{}
+	}
+	m.Documents[id] = document
+}
+
+func (m *MockOneCMSOS) GetPostDocuments(ctx context.Context, docIDs []string, index string) (map[string]PostDocument, error) {
+	documents := map[string]PostDocument{}
+	for _, id := range docIDs {
+		if document, ok := m.Documents[id]; ok {
+			documents[id] = document
+		}
+	}
+	return documents, nil
+}
+
+func (m *MockOneCMSOS) BulkUpdate(ctx context.Context, actions []BulkUpdateAction, index string) (map[string]error, error) {
+	m.BulkActions = append(m.BulkActions, actions...)
+	if m.BulkUpdateErr != nil {
+		return nil, m.BulkUpdateErr
+	}
+	if len(actions) == 1 && actions[0].Version != nil && m.VersionConflicts > 0 {
+		m.VersionConflicts--
+		return map[string]error{actions[0].DocID: &OSStatusError{StatusCode: 409, Message: "version_conflict_engine_exception"}}, nil
+	}
+	for _, action := range actions {
+		if action.Doc != nil && m.BulkItemErrors[action.DocID] == nil {
+			m.storeDocument(action.DocID, action.Doc)
+		}
+	}
+	if m.BulkItemErrors == nil {
+		return map[string]error{}, nil
+	}
+	return m.BulkItemErrors, nil
 }
 
-func (m *MockOneCMSOS) GetAuthorByID(id string) (*AuthorOS, error) {
+func (m *MockOneCMSOS) GetDocumentVersion(ctx context.Context, docID, index string) (*DocVersion, error) {
+	m.VersionReads++
+	return &DocVersion{SeqNo: int64(m.VersionReads), PrimaryTerm: 1}, nil
+}
+
+func (m *MockOneCMSOS) GetAuthorByID(ctx context.Context, id string) (*AuthorOS, error) {
 	if m.GetAuthorByIDFunc != nil {
 		return m.GetAuthorByIDFunc(id)
 	}
@@ -61,12 +127,436 @@ func TestFixURLOperation(t *testing.T) {
 
 		mockOS := &MockOneCMSOS{}
 
-		err := fixURL(ctx, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		err := fixURL(ctx, NewRun("test"), mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
 		if err != nil {
 			t.Errorf("fixURL() error = %v, expected nil", err)
 		}
 	})
 
+	t.Run("Changes nothing when the run is not confirmed", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+
+		var impact Impact
+		run := NewRun("fix-url")
+		run.Confirm = func(shown Impact) bool {
+			impact = shown
+			return false
+		}
+
+		err := fixURL(ctx, run, mockDB, &MockOneCMSOS{}, "2023-01-01", "2023-01-02", "test-index")
+		if !errors.Is(err, ErrNotConfirmed) {
+			t.Errorf("fixURL() error = %v, want ErrNotConfirmed", err)
+		}
+		if len(mockDB.UpdatedURLs) != 0 {
+			t.Errorf("fixURL() changed %v without confirmation", mockDB.UpdatedURLs)
+		}
+
+		expected := []URLChange{{PostID: "1", OldURL: "https://example.com/test-post-oldkey-12345", NewURL: "https://example.com/test-post-newkey-12345"}}
+		if impact.Posts != 1 || !reflect.DeepEqual(impact.Samples, expected) {
+			t.Errorf("fixURL() showed impact %+v, want 1 post with samples %v", impact, expected)
+		}
+	})
+
+	t.Run("Aborts above the max changes cap", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{ID: "1", FullURL: "https://example.com/test-post-oldkey-12345"},
+				{ID: "2", FullURL: "https://example.com/another-post-oldkey-67890"},
+			},
+			AuthorKey: "newkey",
+		}
+
+		run := NewRun("fix-url")
+		run.MaxChanges = 1
+
+		err := fixURL(ctx, run, mockDB, &MockOneCMSOS{}, "2023-01-01", "2023-01-02", "test-index")
+		var tooMany *TooManyChangesError
+		if !errors.As(err, &tooMany) || tooMany.Posts != 2 {
+			t.Errorf("fixURL() error = %v, want a TooManyChangesError for 2 posts", err)
+		}
+		if len(mockDB.UpdatedURLs) != 0 {
+			t.Errorf("fixURL() changed %v above the cap", mockDB.UpdatedURLs)
+		}
+	})
+
+	t.Run("Continues after a passing canary", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{ID: "1", FullURL: "https://example.com/test-post-oldkey-12345"},
+				{ID: "2", FullURL: "https://example.com/another-post-oldkey-67890"},
+				{ID: "3", FullURL: "https://example.com/last-post-oldkey-13579"},
+			},
+			AuthorKey: "newkey",
+		}
+
+		shown := []Impact{}
+		run := NewRun("fix-url")
+		run.Canary = 1
+		run.Confirm = func(impact Impact) bool {
+			shown = append(shown, impact)
+			return true
+		}
+
+		err := fixURL(ctx, run, mockDB, &MockOneCMSOS{}, "2023-01-01", "2023-01-02", "test-index")
+		if err != nil {
+			t.Fatalf("fixURL() error = %v, expected nil", err)
+		}
+		if len(mockDB.UpdatedURLs) != 3 {
+			t.Errorf("fixURL() updated %v, want every post", mockDB.UpdatedURLs)
+		}
+		if len(shown) != 2 || shown[1].Posts != 2 {
+			t.Errorf("fixURL() showed impacts %+v, want the whole run then the 2 posts left after the canary", shown)
+		}
+	})
+
+	t.Run("Stops after a failing canary", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{ID: "1", FullURL: "https://example.com/test-post-oldkey-12345"},
+				{ID: "2", FullURL: "https://example.com/another-post-oldkey-67890"},
+				{ID: "3", FullURL: "https://example.com/last-post-oldkey-13579"},
+			},
+			AuthorKey: "newkey",
+		}
+		mockOS := &MockOneCMSOS{StaleDocIDs: map[string]bool{"1": true}}
+
+		run := NewRun("fix-url")
+		run.Canary = 1
+
+		err := fixURL(ctx, run, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		var canaryErr *CanaryError
+		if !errors.As(err, &canaryErr) || canaryErr.Failed != 1 {
+			t.Fatalf("fixURL() error = %v, want a CanaryError for 1 post", err)
+		}
+		if len(mockDB.UpdatedURLs) != 1 {
+			t.Errorf("fixURL() updated %v, want only the canary post", mockDB.UpdatedURLs)
+		}
+
+		report, _ := run.Finish(err)
+		if report.Status != ReportCanaryFailed || report.UnfixedByReason[ReasonVerificationFailed] != 1 {
+			t.Errorf("fixURL() report = %+v, want the canary post unfixed by verification", report)
+		}
+	})
+
+	t.Run("Stops when the repair leaves a canary post unfixed", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{ID: "1", FullURL: "https://example.com/title"},
+				{ID: "2", FullURL: "https://example.com/test-post-oldkey-12345"},
+				{ID: "3", FullURL: "https://example.com/another-post-oldkey-67890"},
+			},
+			AuthorKey: "newkey",
+		}
+
+		run := NewRun("fix-url")
+		run.Canary = 2
+
+		err := fixURL(ctx, run, mockDB, &MockOneCMSOS{}, "2023-01-01", "2023-01-02", "test-index")
+		var canaryErr *CanaryError
+		if !errors.As(err, &canaryErr) || canaryErr.Failed != 1 || canaryErr.Posts != 2 {
+			t.Fatalf("fixURL() error = %v, want a CanaryError for 1 of 2 posts", err)
+		}
+		if _, ok := mockDB.UpdatedURLs["3"]; ok {
+			t.Errorf("fixURL() updated %v, want the posts after the canary untouched", mockDB.UpdatedURLs)
+		}
+	})
+
+	t.Run("Verifies the posts of every chunk", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{ID: "1", FullURL: "https://example.com/test-post-oldkey-12345"},
+				{ID: "2", FullURL: "https://example.com/another-post-oldkey-67890"},
+			},
+			AuthorKey: "newkey",
+		}
+		mockOS := &MockOneCMSOS{StaleDocIDs: map[string]bool{"2": true}}
+
+		run := NewRun("fix-url")
+		run.VerifyWrites = true
+
+		err := fixURL(ctx, run, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil {
+			t.Fatalf("fixURL() error = nil, want the unverified post reported")
+		}
+		if len(mockDB.UpdatedURLs) != 2 {
+			t.Errorf("fixURL() updated %v, want every post", mockDB.UpdatedURLs)
+		}
+
+		report, _ := run.Finish(err)
+		if len(report.Unfixed) != 1 || report.Unfixed[0].ID != "2" || report.Unfixed[0].Reason != ReasonVerificationFailed {
+			t.Errorf("fixURL() unfixed = %+v, want post 2 failing verification", report.Unfixed)
+		}
+	})
+
+	t.Run("Records redirects for rewritten URLs", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+
+		run := NewRun("fix-url")
+		err := fixURL(ctx, run, mockDB, &MockOneCMSOS{}, "2023-01-01", "2023-01-02", "test-index")
+		if err != nil {
+			t.Fatalf("fixURL() error = %v, expected nil", err)
+		}
+
+		expected := []Redirect{
+			{From: "/test-post-oldkey-12345", To: "/test-post-newkey-12345"},
+			{From: "/test-post-oldkey-12345/amp", To: "/test-post-newkey-12345/amp"},
+		}
+		if result := run.Redirects.Redirects(); !reflect.DeepEqual(result, expected) {
+			t.Errorf("fixURL() redirects = %v, want %v", result, expected)
+		}
+	})
+
+	t.Run("Stores redirects in the redirects table", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+
+		run := NewRun("fix-url")
+		run.RedirectsTable = "redirects"
+
+		err := fixURL(ctx, run, mockDB, &MockOneCMSOS{}, "2023-01-01", "2023-01-02", "test-index")
+		if err != nil {
+			t.Fatalf("fixURL() error = %v, expected nil", err)
+		}
+
+		expected := []PostRedirect{
+			{OldPath: "/test-post-oldkey-12345", NewPath: "/test-post-newkey-12345", StatusCode: 301, SourceRunID: run.ID},
+			{OldPath: "/test-post-oldkey-12345/amp", NewPath: "/test-post-newkey-12345/amp", StatusCode: 301, SourceRunID: run.ID},
+		}
+		if !reflect.DeepEqual(mockDB.SavedRedirects, expected) {
+			t.Errorf("fixURL() saved redirects = %v, want %v", mockDB.SavedRedirects, expected)
+		}
+		if !mockDB.MockTx.CommitCalled {
+			t.Errorf("fixURL() did not commit the URL update")
+		}
+	})
+
+	t.Run("Records the change in the audit trail", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+
+		run := NewRun("fix-url")
+		err := fixURL(ctx, run, mockDB, &MockOneCMSOS{}, "2023-01-01", "2023-01-02", "test-index")
+		if err != nil {
+			t.Fatalf("fixURL() error = %v, expected nil", err)
+		}
+
+		expected := []PostAudit{
+			{
+				PostID:  "1",
+				RunID:   run.ID,
+				Changes: []FieldChange{{Field: "full_url", Old: "https://example.com/test-post-oldkey-12345", New: "https://example.com/test-post-newkey-12345"}},
+			},
+		}
+		if !reflect.DeepEqual(mockDB.SavedAudits, expected) {
+			t.Errorf("fixURL() saved audits = %v, want %v", mockDB.SavedAudits, expected)
+		}
+	})
+
+	t.Run("Skips posts whose URL is already correct", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-newkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+		mockOS := &MockOneCMSOS{}
+
+		run := NewRun("fix-url")
+		err := fixURL(ctx, run, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err != nil {
+			t.Fatalf("fixURL() error = %v, expected nil", err)
+		}
+
+		if len(mockDB.UpdatedURLs) != 0 || len(mockDB.SavedAudits) != 0 || mockOS.DynamicUpdateCalled || run.Redirects.Len() != 0 {
+			t.Errorf("fixURL() wrote an unchanged post: urls %v, audits %v, OS update %v, redirects %d", mockDB.UpdatedURLs, mockDB.SavedAudits, mockOS.DynamicUpdateCalled, run.Redirects.Len())
+		}
+	})
+
+	t.Run("Error recording the audit", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey:    "newkey",
+			SaveAuditErr: errors.New("database error"),
+		}
+
+		mockOS := &MockOneCMSOS{}
+		run := NewRun("fix-url")
+
+		err := fixURL(ctx, run, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil {
+			t.Errorf("fixURL() expected error when recording the audit, got nil")
+		}
+		if mockDB.MockTx.CommitCalled || mockOS.DynamicUpdateCalled {
+			t.Errorf("fixURL() committed a change without its audit")
+		}
+	})
+
+	t.Run("Error saving redirect", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey:       "newkey",
+			SaveRedirectErr: errors.New("database error"),
+		}
+
+		mockOS := &MockOneCMSOS{}
+		run := NewRun("fix-url")
+		run.RedirectsTable = "redirects"
+
+		err := fixURL(ctx, run, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil {
+			t.Errorf("fixURL() expected error when saving redirect, got nil")
+		}
+		if mockOS.DynamicUpdateCalled || run.Redirects.Len() != 0 {
+			t.Errorf("fixURL() carried on after the redirect could not be saved")
+		}
+	})
+
+	t.Run("Reports URL collisions", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey:    "newkey",
+			PostIDsByURL: map[string]string{"https://example.com/test-post-newkey-12345": "2"},
+		}
+
+		mockOS := &MockOneCMSOS{}
+
+		err := fixURL(ctx, NewRun("fix-url"), mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil || !strings.Contains(err.Error(), string(ReasonURLCollision)) {
+			t.Errorf("fixURL() error = %v, expected a url collision", err)
+		}
+		if len(mockDB.UpdatedURLs) != 0 || mockOS.DynamicUpdateCalled {
+			t.Errorf("fixURL() wrote a colliding URL")
+		}
+	})
+
+	t.Run("Disambiguates URL collisions with the suffix strategy", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+				{
+					ID:      "2",
+					FullURL: "https://example.com/test-post-otherkey-12345",
+				},
+			},
+			AuthorKey:    "newkey",
+			PostIDsByURL: map[string]string{"https://example.com/test-post-newkey-12345": "3"},
+		}
+
+		run := NewRun("fix-url")
+		run.URLCollisionStrategy = URLCollisionSuffix
+
+		err := fixURL(ctx, run, mockDB, &MockOneCMSOS{}, "2023-01-01", "2023-01-02", "test-index")
+		if err != nil {
+			t.Fatalf("fixURL() error = %v, expected nil", err)
+		}
+
+		expected := map[string]string{
+			"1": "https://example.com/test-post-2-newkey-12345",
+			"2": "https://example.com/test-post-3-newkey-12345",
+		}
+		if !reflect.DeepEqual(mockDB.UpdatedURLs, expected) {
+			t.Errorf("fixURL() updated URLs = %v, want %v", mockDB.UpdatedURLs, expected)
+		}
+	})
+
+	t.Run("Stops when the run is cancelled", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+
+		mockOS := &MockOneCMSOS{}
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		err := fixURL(cancelledCtx, NewRun("fix-url"), mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("fixURL() error = %v, expected context.Canceled", err)
+		}
+		if len(mockDB.UpdatedURLs) != 0 || mockOS.DynamicUpdateCalled {
+			t.Errorf("fixURL() kept repairing posts after the run was cancelled")
+		}
+	})
+
+	t.Run("Stops taking posts once the run is stopped", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+
+		run := NewRun("fix-url")
+		run.Stop()
+
+		err := fixURL(ctx, run, mockDB, &MockOneCMSOS{}, "2023-01-01", "2023-01-02", "test-index")
+		if !errors.Is(err, ErrInterrupted) {
+			t.Errorf("fixURL() error = %v, expected ErrInterrupted", err)
+		}
+		if len(mockDB.UpdatedURLs) != 0 {
+			t.Errorf("fixURL() kept repairing posts after the run was stopped")
+		}
+	})
+
 	t.Run("Error getting posts", func(t *testing.T) {
 		mockDB := &MockOneCMSDB{
 			GetPostsByCreatedAtErr: errors.New("database error"),
@@ -74,7 +564,7 @@ func TestFixURLOperation(t *testing.T) {
 
 		mockOS := &MockOneCMSOS{}
 
-		err := fixURL(ctx, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		err := fixURL(ctx, NewRun("test"), mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
 		if err == nil {
 			t.Errorf("fixURL() expected error when getting posts, got nil")
 		}
@@ -92,66 +582,484 @@ func TestFixURLOperation(t *testing.T) {
 		}
 
 		mockDB := &MockOneCMSDB{
-			PostsByCreatedAt: posts,
-			GetAuthorKeyErr:  errors.New("database error"),
+			PostsByCreatedAt: posts,
+			GetAuthorKeyErr:  errors.New("database error"),
+		}
+
+		mockOS := &MockOneCMSOS{}
+
+		err := fixURL(ctx, NewRun("test"), mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil {
+			t.Errorf("fixURL() expected error when getting author key, got nil")
+		}
+	})
+
+	t.Run("Error updating article URL", func(t *testing.T) {
+		posts := []Post{
+			{
+				ID:        "1",
+				Title:     "Test Post 1",
+				FullURL:   "https://example.com/test-post-oldkey-12345",
+				Key:       "test-key-1",
+				CreatedAt: time.Now(),
+			},
+		}
+
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: posts,
+			AuthorKey:        "newkey",
+			UpdateURLErr:     errors.New("database error"),
+		}
+
+		mockOS := &MockOneCMSOS{}
+
+		err := fixURL(ctx, NewRun("test"), mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil {
+			t.Errorf("fixURL() expected error when updating article URL, got nil")
+		}
+	})
+
+	t.Run("Reports posts changed since they were read", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey:      "newkey",
+			ChangedPostIDs: map[string]bool{"1": true},
+		}
+
+		mockOS := &MockOneCMSOS{}
+		err := fixURL(ctx, NewRun("fix-url"), mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil || !strings.Contains(err.Error(), string(ReasonDBConflict)) {
+			t.Errorf("fixURL() error = %v, expected a DB conflict", err)
+		}
+		if mockOS.DynamicUpdateCalled {
+			t.Errorf("fixURL() updated OpenSearch for a post changed since it was read")
+		}
+	})
+
+	t.Run("Reports unexpected row counts", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey:    "newkey",
+			AffectedRows: map[string]int64{"UpdateArticleURLByID": 2},
+		}
+
+		mockOS := &MockOneCMSOS{}
+		err := fixURL(ctx, NewRun("fix-url"), mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil || !strings.Contains(err.Error(), string(ReasonUnexpectedRowCount)) {
+			t.Errorf("fixURL() error = %v, expected an unexpected row count", err)
+		}
+		if mockOS.DynamicUpdateCalled {
+			t.Errorf("fixURL() updated OpenSearch after an unexpected row count")
+		}
+	})
+
+	t.Run("Sends conditional updates", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+
+		mockOS := &MockOneCMSOS{}
+		run := NewRun("fix-url")
+		run.OSConcurrency = OSConcurrencyReport
+
+		err := fixURL(ctx, run, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err != nil {
+			t.Fatalf("fixURL() error = %v, expected nil", err)
+		}
+		if mockOS.DynamicUpdateCalled || len(mockOS.BulkActions) != 1 || *mockOS.BulkActions[0].Version != (DocVersion{SeqNo: 1, PrimaryTerm: 1}) {
+			t.Errorf("fixURL() bulk actions = %+v, want one update conditional on the version read", mockOS.BulkActions)
+		}
+	})
+
+	t.Run("Reports version conflicts", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+
+		mockOS := &MockOneCMSOS{VersionConflicts: 1}
+		run := NewRun("fix-url")
+		run.OSConcurrency = OSConcurrencyReport
+
+		err := fixURL(ctx, run, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil || !strings.Contains(err.Error(), string(ReasonOSVersionConflict)) {
+			t.Errorf("fixURL() error = %v, expected a version conflict", err)
+		}
+		if mockDB.UpdatedURLs["1"] != "https://example.com/test-post-oldkey-12345" {
+			t.Errorf("fixURL() left URL %v, want the DB change reverted", mockDB.UpdatedURLs["1"])
+		}
+	})
+
+	t.Run("Compensates version conflicts instead of queueing them", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+
+		mockOS := &MockOneCMSOS{VersionConflicts: 1}
+		run := NewRun("fix-url")
+		run.OSConcurrency = OSConcurrencyReport
+		run.OSFailureStrategy = OSFailureOutbox
+
+		err := fixURL(ctx, run, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil || !strings.Contains(err.Error(), string(ReasonOSVersionConflict)) {
+			t.Errorf("fixURL() error = %v, expected a version conflict", err)
+		}
+		if len(mockDB.Outbox) != 0 {
+			t.Errorf("fixURL() outbox = %+v, want the conflicting update left out", mockDB.Outbox)
+		}
+		if mockDB.UpdatedURLs["1"] != "https://example.com/test-post-oldkey-12345" {
+			t.Errorf("fixURL() left URL %v, want the DB change reverted", mockDB.UpdatedURLs["1"])
+		}
+	})
+
+	t.Run("Queues conditional updates with their version", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+
+		mockOS := &MockOneCMSOS{BulkUpdateErr: errors.New("opensearch error")}
+		run := NewRun("fix-url")
+		run.OSConcurrency = OSConcurrencyReport
+		run.OSFailureStrategy = OSFailureOutbox
+
+		err := fixURL(ctx, run, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil || !strings.Contains(err.Error(), string(ReasonOSUpdateQueued)) {
+			t.Errorf("fixURL() error = %v, expected the update to be queued", err)
+		}
+		if len(mockDB.Outbox) != 1 {
+			t.Fatalf("fixURL() outbox = %+v, want one entry", mockDB.Outbox)
+		}
+
+		action, err := outboxAction(mockDB.Outbox[0])
+		if err != nil || action.Version == nil || *action.Version != (DocVersion{SeqNo: 1, PrimaryTerm: 1}) {
+			t.Errorf("outboxAction() = %+v, %v, want the update conditional on the version read", action, err)
+		}
+	})
+
+	t.Run("Re-reads the version after a conflict", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+
+		mockOS := &MockOneCMSOS{VersionConflicts: 1}
+		run := NewRun("fix-url")
+		run.OSConcurrency = OSConcurrencyRetry
+
+		err := fixURL(ctx, run, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err != nil {
+			t.Fatalf("fixURL() error = %v, expected nil", err)
+		}
+		if mockOS.VersionReads != 2 || len(mockOS.BulkActions) != 2 || mockOS.BulkActions[1].Version.SeqNo != 2 {
+			t.Errorf("fixURL() bulk actions = %+v after %d reads, want the update resent with the new version", mockOS.BulkActions, mockOS.VersionReads)
+		}
+	})
+
+	t.Run("Retries the transaction after a serialization failure", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey:              "newkey",
+			TransientUpdateURLErrs: []error{&pq.Error{Code: "40001"}},
+		}
+
+		run := NewRun("fix-url")
+		run.RetryBaseDelay = time.Millisecond
+
+		err := fixURL(ctx, run, mockDB, &MockOneCMSOS{}, "2023-01-01", "2023-01-02", "test-index")
+		if err != nil {
+			t.Fatalf("fixURL() error = %v, expected nil", err)
+		}
+		if mockDB.UpdatedURLs["1"] != "https://example.com/test-post-newkey-12345" {
+			t.Errorf("fixURL() updated URL = %v, want the fixed URL", mockDB.UpdatedURLs["1"])
+		}
+
+		report, _ := run.Finish(nil)
+		if stats := report.Retries["postgres.transaction"]; stats == nil || stats.Retries != 1 || stats.Recovered != 1 {
+			t.Errorf("fixURL() retries = %+v, want one recovered retry", report.Retries)
+		}
+	})
+
+	t.Run("Error updating OpenSearch data", func(t *testing.T) {
+		posts := []Post{
+			{
+				ID:        "1",
+				Title:     "Test Post 1",
+				FullURL:   "https://example.com/test-post-oldkey-12345",
+				Key:       "test-key-1",
+				CreatedAt: time.Now(),
+			},
+		}
+
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: posts,
+			AuthorKey:        "newkey",
+		}
+
+		mockOS := &MockOneCMSOS{
+			DynamicUpdateErr: errors.New("opensearch error"),
+		}
+
+		err := fixURL(ctx, NewRun("test"), mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil {
+			t.Errorf("fixURL() expected error when updating OpenSearch data, got nil")
+		}
+	})
+
+	t.Run("Reverts the URL when OpenSearch fails", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+
+		mockOS := &MockOneCMSOS{
+			DynamicUpdateErr: errors.New("opensearch error"),
+		}
+		run := NewRun("fix-url")
+
+		err := fixURL(ctx, run, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil || !strings.Contains(err.Error(), "DB change reverted") {
+			t.Errorf("fixURL() error = %v, expected the DB change to be reverted", err)
+		}
+		if mockDB.UpdatedURLs["1"] != "https://example.com/test-post-oldkey-12345" {
+			t.Errorf("fixURL() left URL %v, want the old URL back", mockDB.UpdatedURLs["1"])
+		}
+		expected := []Redirect{
+			{From: "/test-post-newkey-12345", To: "/test-post-oldkey-12345"},
+			{From: "/test-post-newkey-12345/amp", To: "/test-post-oldkey-12345/amp"},
+		}
+		if result := run.Redirects.Redirects(); !reflect.DeepEqual(result, expected) {
+			t.Errorf("fixURL() redirects = %v, want the reverse redirects %v", result, expected)
+		}
+	})
+
+	t.Run("Queues the OpenSearch update in the outbox", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+
+		mockOS := &MockOneCMSOS{
+			DynamicUpdateErr: errors.New("opensearch error"),
+		}
+		run := NewRun("fix-url")
+		run.OSFailureStrategy = OSFailureOutbox
+
+		err := fixURL(ctx, run, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil || !strings.Contains(err.Error(), string(ReasonOSUpdateQueued)) {
+			t.Errorf("fixURL() error = %v, expected the update to be queued", err)
+		}
+		if mockDB.UpdatedURLs["1"] != "https://example.com/test-post-newkey-12345" {
+			t.Errorf("fixURL() left URL %v, want the fixed URL kept", mockDB.UpdatedURLs["1"])
+		}
+		if len(mockDB.Outbox) != 1 || mockDB.Outbox[0].DocID != "1" || mockDB.Outbox[0].Index != "test-index" || mockDB.Outbox[0].RunID != run.ID {
+			t.Fatalf("fixURL() outbox = %+v, want one entry for post 1", mockDB.Outbox)
+		}
+
+		expected := `{"doc":{"article_url":"https://example.com/test-post-newkey-12345","article_url_amp":"https://example.com/test-post-newkey-12345/amp"}}`
+		if string(mockDB.Outbox[0].Payload) != expected {
+			t.Errorf("fixURL() outbox payload = %s, want %s", mockDB.Outbox[0].Payload, expected)
+		}
+	})
+
+	t.Run("Writes OpenSearch through the outbox", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey: "newkey",
+		}
+
+		mockOS := &MockOneCMSOS{}
+		run := NewRun("fix-url")
+		run.OSWriteMode = OSWriteOutbox
+
+		err := fixURL(ctx, run, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err != nil {
+			t.Fatalf("fixURL() error = %v, expected nil", err)
+		}
+		if mockOS.DynamicUpdateCalled {
+			t.Errorf("fixURL() updated OpenSearch directly in outbox write mode")
+		}
+		if len(mockDB.Outbox) != 1 || mockDB.Outbox[0].DocID != "1" || mockDB.Outbox[0].LastError != "" {
+			t.Errorf("fixURL() outbox = %+v, want one entry for post 1", mockDB.Outbox)
+		}
+	})
+
+	t.Run("Error queueing the OpenSearch update", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{
+					ID:      "1",
+					FullURL: "https://example.com/test-post-oldkey-12345",
+				},
+			},
+			AuthorKey:  "newkey",
+			EnqueueErr: errors.New("outbox unavailable"),
+		}
+
+		run := NewRun("fix-url")
+		run.OSWriteMode = OSWriteOutbox
+
+		mockOS := &MockOneCMSOS{}
+		err := fixURL(ctx, run, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		if err == nil || !strings.Contains(err.Error(), string(ReasonDBUpdateFailed)) {
+			t.Errorf("fixURL() error = %v, expected a DB update failure", err)
+		}
+		if mockOS.DynamicUpdateCalled || run.Redirects.Len() != 0 {
+			t.Errorf("fixURL() went on after failing to queue the OpenSearch update")
+		}
+	})
+}
+
+func TestRebuildURLOperation(t *testing.T) {
+	os.Setenv("POST_CHUNK_SIZE", "5")
+	defer os.Unsetenv("POST_CHUNK_SIZE")
+
+	ctx := context.Background()
+
+	posts := []Post{
+		{
+			ID:      "1",
+			Title:   "Test Post",
+			FullURL: "https://example.com/test-post-newkey-12345/",
+			Key:     "12345",
+		},
+		{
+			ID:      "2",
+			Title:   "Another Post",
+			FullURL: "https://example.com/another-po",
+			Key:     "67890",
+		},
+	}
+
+	t.Run("Rewrites only mismatched URLs", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: posts,
+			AuthorKey:        "newkey",
+		}
+		mockOS := &MockOneCMSOS{}
+
+		err := rebuildURL(ctx, NewRun("test"), mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index", false)
+		if err != nil {
+			t.Fatalf("rebuildURL() error = %v, expected nil", err)
+		}
+
+		if _, ok := mockDB.UpdatedURLs["1"]; ok {
+			t.Errorf("rebuildURL() rewrote a URL that only differs by a trailing slash")
+		}
+		if got := mockDB.UpdatedURLs["2"]; got != "https://example.com/another-post-newkey-67890" {
+			t.Errorf("rebuildURL() updated URL = %v, want rebuilt URL", got)
+		}
+	})
+
+	t.Run("Keeps every level of nested categories", func(t *testing.T) {
+		os.Setenv("URL_SCHEMA", "/{category}/{slug}-{authorKey}-{postKey}")
+		defer os.Unsetenv("URL_SCHEMA")
+
+		mockDB := &MockOneCMSDB{
+			PostsByCreatedAt: []Post{
+				{ID: "1", Title: "Test Post", FullURL: "https://example.com/parenting/baby/test-post-newkey-12345", Key: "12345", CategoryPath: "parenting/baby"},
+				{ID: "2", Title: "Another Post", FullURL: "https://example.com/baby/another-post-newkey-67890", Key: "67890", CategoryPath: "parenting/baby"},
+			},
+			AuthorKey: "newkey",
 		}
 
-		mockOS := &MockOneCMSOS{}
-
-		err := fixURL(ctx, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
-		if err == nil {
-			t.Errorf("fixURL() expected error when getting author key, got nil")
+		err := rebuildURL(ctx, NewRun("test"), mockDB, &MockOneCMSOS{}, "2023-01-01", "2023-01-02", "test-index", false)
+		if err != nil {
+			t.Fatalf("rebuildURL() error = %v, expected nil", err)
 		}
-	})
 
-	t.Run("Error updating article URL", func(t *testing.T) {
-		posts := []Post{
-			{
-				ID:        "1",
-				Title:     "Test Post 1",
-				FullURL:   "https://example.com/test-post-oldkey-12345",
-				Key:       "test-key-1",
-				CreatedAt: time.Now(),
-			},
+		if _, ok := mockDB.UpdatedURLs["1"]; ok {
+			t.Errorf("rebuildURL() rewrote a URL already under its nested category")
 		}
+		if got := mockDB.UpdatedURLs["2"]; got != "https://example.com/parenting/baby/another-post-newkey-67890" {
+			t.Errorf("rebuildURL() updated URL = %v, want it under parenting/baby", got)
+		}
+	})
 
+	t.Run("Dry run leaves posts untouched", func(t *testing.T) {
 		mockDB := &MockOneCMSDB{
 			PostsByCreatedAt: posts,
 			AuthorKey:        "newkey",
-			UpdateURLErr:     errors.New("database error"),
 		}
-
 		mockOS := &MockOneCMSOS{}
 
-		err := fixURL(ctx, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
-		if err == nil {
-			t.Errorf("fixURL() expected error when updating article URL, got nil")
+		err := rebuildURL(ctx, NewRun("test"), mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index", true)
+		if err != nil {
+			t.Fatalf("rebuildURL() error = %v, expected nil", err)
 		}
-	})
 
-	t.Run("Error updating OpenSearch data", func(t *testing.T) {
-		posts := []Post{
-			{
-				ID:        "1",
-				Title:     "Test Post 1",
-				FullURL:   "https://example.com/test-post-oldkey-12345",
-				Key:       "test-key-1",
-				CreatedAt: time.Now(),
-			},
+		if len(mockDB.UpdatedURLs) != 0 || mockOS.DynamicUpdateCalled {
+			t.Errorf("rebuildURL() wrote data during a dry run")
 		}
+	})
 
+	t.Run("Error getting author key", func(t *testing.T) {
 		mockDB := &MockOneCMSDB{
 			PostsByCreatedAt: posts,
-			AuthorKey:        "newkey",
-		}
-
-		mockOS := &MockOneCMSOS{
-			DynamicUpdateErr: errors.New("opensearch error"),
+			GetAuthorKeyErr:  errors.New("database error"),
 		}
+		mockOS := &MockOneCMSOS{}
 
-		err := fixURL(ctx, mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index")
+		err := rebuildURL(ctx, NewRun("test"), mockDB, mockOS, "2023-01-01", "2023-01-02", "test-index", false)
 		if err == nil {
-			t.Errorf("fixURL() expected error when updating OpenSearch data, got nil")
+			t.Errorf("rebuildURL() expected error when getting author key, got nil")
 		}
 	})
 }
@@ -187,14 +1095,14 @@ func testFixCSCPopmama(ctx context.Context, onecmsDB OneCMSDB, onecmsOS OneCMSOS
 		for i, post := range chunk {
 			fmt.Printf("\n\t[%d/%d] Fixing Popmama CSC article...", i+1, cl)
 
-			postAuthor, err := onecmsOS.GetAuthorByID(post.AuthorID)
+			postAuthor, err := onecmsOS.GetAuthorByID(ctx, post.AuthorID)
 			if err != nil || postAuthor == nil {
 				msg := fmt.Errorf("\n\t❌ Cannot find author of this post.")
 				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post with old id: %s, caused by: %s. Error: %s", post.OldID, msg, err.Error()))
 				continue
 			}
 
-			postCreator, err := onecmsOS.GetAuthorByID(post.CreatedBy)
+			postCreator, err := onecmsOS.GetAuthorByID(ctx, post.CreatedBy)
 			if err != nil || postCreator == nil {
 				msg := fmt.Errorf("\n\t❌ Cannot find creator of this post.")
 				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post with old id: %s, caused by: %s. Error: %s", post.OldID, msg, err.Error()))
@@ -220,7 +1128,7 @@ func testFixCSCPopmama(ctx context.Context, onecmsDB OneCMSDB, onecmsOS OneCMSOS
 			postExisting.CreatedBy = postCreator.Key
 			postExisting.AuthorID = postAuthor.Key
 
-			if err := onecmsDB.UpdateBrokenPopmamaArticleCSC(ctx, nil, post.OldID, *postExisting); err != nil {
+			if _, err := onecmsDB.UpdateBrokenPopmamaArticleCSC(ctx, nil, postExisting.ID, *postExisting); err != nil {
 				msg := fmt.Errorf("\n\t❌ Failed updating DB data for this post.")
 				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post with old id: %s, caused by: %s. Error: %s", post.OldID, msg, err.Error()))
 				continue
@@ -232,7 +1140,7 @@ func testFixCSCPopmama(ctx context.Context, onecmsDB OneCMSDB, onecmsOS OneCMSOS
 				Authors:       []AuthorOS{*postAuthor},
 			}
 
-			if err := onecmsOS.DynamicUpdate(osData, postExisting.ID, osIndex); err != nil {
+			if err := onecmsOS.DynamicUpdate(ctx, osData, postExisting.ID, osIndex); err != nil {
 				msg := fmt.Errorf("\n\t❌ Failed updating OS data for this post.")
 				unfixedPosts = append(unfixedPosts, fmt.Sprintf("Error fixing post with old id: %s, caused by: %s. Error: %s", post.OldID, msg, err.Error()))
 				continue
@@ -546,4 +1454,439 @@ func TestFixCSCPopmamaOperation(t *testing.T) {
 			t.Errorf("testFixCSCPopmama() expected error when updating OpenSearch data, got nil")
 		}
 	})
+	t.Run("Updates the post by its ID", func(t *testing.T) {
+		author := &AuthorOS{UUID: "author-1", Key: "author-key"}
+		creator := &AuthorOS{UUID: "creator-1", Key: "creator-key"}
+
+		mockDB := &MockOneCMSDB{
+			BrokenPosts: []BrokenPopmamaArticleCSC{{OldID: "old-1", AuthorID: "author-1", CreatedBy: "creator-1"}},
+			Post: &Post{
+				ID:      "1",
+				FullURL: "https://example.com/test-post-oldkey-12345",
+			},
+		}
+
+		mockOS := &MockOneCMSOS{
+			GetAuthorByIDFunc: func(id string) (*AuthorOS, error) {
+				if id == "author-1" {
+					return author, nil
+				} else if id == "creator-1" {
+					return creator, nil
+				}
+				return nil, errors.New("author not found")
+			},
+		}
+
+		err := fixCSCPopmama(ctx, NewRun("fix-csc-popmama"), mockDB, mockOS, "test-index")
+		if err != nil {
+			t.Fatalf("fixCSCPopmama() error = %v, expected nil", err)
+		}
+		if !mockOS.DynamicUpdateCalled {
+			t.Errorf("fixCSCPopmama() did not update OpenSearch")
+		}
+
+		if len(mockDB.SavedAudits) != 1 {
+			t.Fatalf("fixCSCPopmama() saved %d audits, want 1", len(mockDB.SavedAudits))
+		}
+		fields := []string{}
+		for _, change := range mockDB.SavedAudits[0].Changes {
+			fields = append(fields, change.Field)
+		}
+		if expected := []string{"full_url", "author_id", "post_authors"}; !reflect.DeepEqual(fields, expected) {
+			t.Errorf("fixCSCPopmama() audited fields %v, want %v", fields, expected)
+		}
+	})
+
+	t.Run("Audits the post authors read under the lock", func(t *testing.T) {
+		author := &AuthorOS{UUID: "author-1", Key: "author-key"}
+		creator := &AuthorOS{UUID: "creator-1", Key: "creator-key"}
+
+		mockDB := &MockOneCMSDB{
+			BrokenPosts: []BrokenPopmamaArticleCSC{{OldID: "old-1", AuthorID: "author-1", CreatedBy: "creator-1"}},
+			Post: &Post{
+				ID:      "1",
+				FullURL: "https://example.com/test-post-oldkey-12345",
+			},
+			PostAuthorIDs: []string{"oldkey", "cokey"},
+		}
+
+		mockOS := &MockOneCMSOS{
+			GetAuthorByIDFunc: func(id string) (*AuthorOS, error) {
+				if id == "author-1" {
+					return author, nil
+				} else if id == "creator-1" {
+					return creator, nil
+				}
+				return nil, errors.New("author not found")
+			},
+		}
+
+		err := fixCSCPopmama(ctx, NewRun("fix-csc-popmama"), mockDB, mockOS, "test-index")
+		if err != nil {
+			t.Fatalf("fixCSCPopmama() error = %v, expected nil", err)
+		}
+		if len(mockDB.SavedAudits) != 1 {
+			t.Fatalf("fixCSCPopmama() saved %d audits, want 1", len(mockDB.SavedAudits))
+		}
+		for _, change := range mockDB.SavedAudits[0].Changes {
+			if change.Field == "post_authors" && change.Old != "oldkey,cokey" {
+				t.Errorf("fixCSCPopmama() audited old post authors %q, want %q", change.Old, "oldkey,cokey")
+			}
+		}
+	})
+
+	t.Run("Leaves no audit for a post already correct", func(t *testing.T) {
+		author := &AuthorOS{UUID: "author-1", Key: "authorkey"}
+		creator := &AuthorOS{UUID: "creator-1", Key: "creatorkey"}
+
+		mockDB := &MockOneCMSDB{
+			BrokenPosts: []BrokenPopmamaArticleCSC{{OldID: "old-1", AuthorID: "author-1", CreatedBy: "creator-1"}},
+			Post: &Post{
+				ID:        "1",
+				FullURL:   "https://example.com/test-post-authorkey-12345",
+				CreatedBy: "creatorkey",
+				AuthorID:  "authorkey",
+			},
+			PostAuthorIDs: []string{"authorkey"},
+		}
+
+		mockOS := &MockOneCMSOS{
+			GetAuthorByIDFunc: func(id string) (*AuthorOS, error) {
+				if id == "author-1" {
+					return author, nil
+				} else if id == "creator-1" {
+					return creator, nil
+				}
+				return nil, errors.New("author not found")
+			},
+		}
+
+		err := fixCSCPopmama(ctx, NewRun("fix-csc-popmama"), mockDB, mockOS, "test-index")
+		if err != nil {
+			t.Fatalf("fixCSCPopmama() error = %v, expected nil", err)
+		}
+		if len(mockDB.SavedAudits) != 0 {
+			t.Errorf("fixCSCPopmama() saved audits %v for a post it did not change", mockDB.SavedAudits)
+		}
+	})
+
+	t.Run("Reports posts changed since they were read", func(t *testing.T) {
+		author := &AuthorOS{UUID: "author-1", Key: "author-key"}
+		creator := &AuthorOS{UUID: "creator-1", Key: "creator-key"}
+
+		mockDB := &MockOneCMSDB{
+			BrokenPosts: []BrokenPopmamaArticleCSC{{OldID: "old-1", AuthorID: "author-1", CreatedBy: "creator-1"}},
+			Post: &Post{
+				ID:      "1",
+				FullURL: "https://example.com/test-post-oldkey-12345",
+			},
+			LockedPost: &Post{
+				ID:      "1",
+				FullURL: "https://example.com/edited-post-oldkey-12345",
+			},
+		}
+
+		mockOS := &MockOneCMSOS{
+			GetAuthorByIDFunc: func(id string) (*AuthorOS, error) {
+				if id == "author-1" {
+					return author, nil
+				} else if id == "creator-1" {
+					return creator, nil
+				}
+				return nil, errors.New("author not found")
+			},
+		}
+
+		err := fixCSCPopmama(ctx, NewRun("fix-csc-popmama"), mockDB, mockOS, "test-index")
+		if err == nil || !strings.Contains(err.Error(), string(ReasonDBConflict)) {
+			t.Errorf("fixCSCPopmama() error = %v, expected a DB conflict", err)
+		}
+		if mockOS.DynamicUpdateCalled {
+			t.Errorf("fixCSCPopmama() updated OpenSearch for a post changed since it was read")
+		}
+	})
+}
+
+func TestPropagateAuthorOperation(t *testing.T) {
+	os.Setenv("POST_CHUNK_SIZE", "5")
+	defer os.Unsetenv("POST_CHUNK_SIZE")
+
+	ctx := context.Background()
+
+	author := &AuthorOS{
+		UUID: "author-1",
+		Name: "Renamed Author",
+		Key:  "newkey",
+	}
+
+	authorLookup := func(id string) (*AuthorOS, error) {
+		if id == "author-1" {
+			return author, nil
+		}
+		return nil, errors.New("author not found")
+	}
+
+	t.Run("Rewrites URL only for posts where the author is primary", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			AuthorPosts: []AuthorPost{
+				{
+					Post:            Post{ID: "1", FullURL: "https://example.com/test-post-oldkey-12345"},
+					IsPrimaryAuthor: true,
+				},
+				{
+					Post:            Post{ID: "2", FullURL: "https://example.com/other-post-someone-67890"},
+					IsPrimaryAuthor: false,
+				},
+			},
+		}
+
+		mockOS := &MockOneCMSOS{GetAuthorByIDFunc: authorLookup}
+
+		err := propagateAuthor(ctx, NewRun("test"), mockDB, mockOS, "author-1", "test-index")
+		if err != nil {
+			t.Fatalf("propagateAuthor() error = %v, expected nil", err)
+		}
+
+		if got := mockDB.UpdatedURLs["1"]; got != "https://example.com/test-post-newkey-12345" {
+			t.Errorf("propagateAuthor() updated URL = %v, want rewritten URL", got)
+		}
+
+		if _, ok := mockDB.UpdatedURLs["2"]; ok {
+			t.Errorf("propagateAuthor() rewrote URL of a post where the author is not primary")
+		}
+
+		if len(mockOS.BulkActions) != 2 {
+			t.Fatalf("propagateAuthor() sent %d bulk actions, want 2", len(mockOS.BulkActions))
+		}
+
+		if mockOS.BulkActions[1].Script.Params["article_url"] != nil {
+			t.Errorf("propagateAuthor() set article_url for a post where the author is not primary")
+		}
+	})
+
+	t.Run("Flags posts whose document was not updated", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			AuthorPosts: []AuthorPost{
+				{Post: Post{ID: "1", FullURL: "https://example.com/test-post-oldkey-12345"}, IsPrimaryAuthor: true},
+				{Post: Post{ID: "3", FullURL: "https://example.com/last-post-oldkey-13579"}, IsPrimaryAuthor: true},
+			},
+		}
+		// The mock does not run scripts, the document of post 1 is the one
+		// OpenSearch would have.
+		mockOS := &MockOneCMSOS{
+			GetAuthorByIDFunc: authorLookup,
+			Documents: map[string]PostDocument{
+				"1": {
+					ArticleURL:    "https://example.com/test-post-newkey-12345",
+					ArticleURLAMP: "https://example.com/test-post-newkey-12345/amp",
+					Authors:       []AuthorOS{*author},
+				},
+			},
+		}
+
+		run := NewRun("propagate-author")
+		run.VerifyWrites = true
+
+		err := propagateAuthor(ctx, run, mockDB, mockOS, "author-1", "test-index")
+		if err == nil {
+			t.Fatalf("propagateAuthor() error = nil, want the unverified post reported")
+		}
+
+		report, _ := run.Finish(err)
+		if len(report.Unfixed) != 1 || report.Unfixed[0].ID != "3" || report.Unfixed[0].Reason != ReasonVerificationFailed {
+			t.Errorf("propagateAuthor() unfixed = %+v, want post 3 failing verification", report.Unfixed)
+		}
+	})
+
+	t.Run("Error getting author", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{}
+		mockOS := &MockOneCMSOS{GetAuthorByIDFunc: authorLookup}
+
+		err := propagateAuthor(ctx, NewRun("test"), mockDB, mockOS, "missing", "test-index")
+		if err == nil {
+			t.Errorf("propagateAuthor() expected error when getting author, got nil")
+		}
+	})
+
+	t.Run("Error updating OpenSearch documents", func(t *testing.T) {
+		mockDB := &MockOneCMSDB{
+			AuthorPosts: []AuthorPost{
+				{
+					Post:            Post{ID: "1", FullURL: "https://example.com/test-post-oldkey-12345"},
+					IsPrimaryAuthor: true,
+				},
+			},
+		}
+
+		mockOS := &MockOneCMSOS{
+			GetAuthorByIDFunc: authorLookup,
+			BulkItemErrors:    map[string]error{"1": errors.New("document_missing_exception")},
+		}
+
+		err := propagateAuthor(ctx, NewRun("test"), mockDB, mockOS, "author-1", "test-index")
+		if err == nil {
+			t.Errorf("propagateAuthor() expected error when a bulk item fails, got nil")
+		}
+	})
+}
+
+func TestDrainOutboxOperation(t *testing.T) {
+	os.Setenv("POST_CHUNK_SIZE", "2")
+	defer os.Unsetenv("POST_CHUNK_SIZE")
+
+	ctx := context.Background()
+
+	mockDB := &MockOneCMSDB{
+		Outbox: []OSOutboxEntry{
+			{ID: 1, DocID: "1", Index: "test-index", Payload: []byte(`{"doc":{"article_url":"https://example.com/a"}}`)},
+			{ID: 2, DocID: "2", Index: "test-index", Payload: []byte(`{"script":{"source":"ctx._source.x = 1","lang":"painless"}}`)},
+			{ID: 3, DocID: "3", Index: "other-index", Payload: []byte(`{"doc":{}}`)},
+		},
+	}
+
+	mockOS := &MockOneCMSOS{
+		BulkItemErrors: map[string]error{"3": errors.New("document_missing_exception: [3]: document missing")},
+	}
+
+	err := drainOutbox(ctx, NewRun("drain-outbox"), mockDB, mockOS, false)
+	if err == nil || !strings.Contains(err.Error(), "document_missing_exception") {
+		t.Errorf("drainOutbox() error = %v, expected the failing entry to be reported", err)
+	}
+
+	if len(mockOS.BulkActions) != 3 || mockOS.BulkActions[1].Script == nil || mockOS.BulkActions[1].Script.Source != "ctx._source.x = 1" {
+		t.Errorf("drainOutbox() bulk actions = %+v, want the queued doc and script updates", mockOS.BulkActions)
+	}
+
+	if !mockDB.OutboxDone[1] || !mockDB.OutboxDone[2] || mockDB.OutboxDone[3] {
+		t.Errorf("drainOutbox() done = %v, want entries 1 and 2 only", mockDB.OutboxDone)
+	}
+	if mockDB.Outbox[2].Attempts != 1 || !strings.Contains(mockDB.Outbox[2].LastError, "document missing") {
+		t.Errorf("drainOutbox() failed entry = %+v, want one attempt and its error", mockDB.Outbox[2])
+	}
+	if !mockDB.OutboxNextAttempt[3].After(time.Now()) {
+		t.Errorf("drainOutbox() next attempt = %v, want the failed entry pushed back", mockDB.OutboxNextAttempt[3])
+	}
+}
+
+func TestDrainOutboxVersionConflict(t *testing.T) {
+	os.Setenv("POST_CHUNK_SIZE", "5")
+	defer os.Unsetenv("POST_CHUNK_SIZE")
+
+	mockDB := &MockOneCMSDB{
+		Outbox: []OSOutboxEntry{
+			{ID: 1, DocID: "1", Index: "test-index", Payload: []byte(`{"doc":{"article_url":"https://example.com/a"},"version":{"_seq_no":3,"_primary_term":1}}`)},
+		},
+	}
+	mockOS := &MockOneCMSOS{VersionConflicts: 1}
+
+	run := NewRun("drain-outbox")
+	err := drainOutbox(context.Background(), run, mockDB, mockOS, false)
+	if err == nil {
+		t.Fatalf("drainOutbox() error = nil, expected the conflict to be reported")
+	}
+	if len(mockOS.BulkActions) != 1 || mockOS.BulkActions[0].Version == nil || mockOS.BulkActions[0].Version.SeqNo != 3 {
+		t.Errorf("drainOutbox() bulk actions = %+v, want the update conditional on its queued version", mockOS.BulkActions)
+	}
+	if !mockDB.OutboxDone[1] {
+		t.Errorf("drainOutbox() left the conflicting entry pending, want it dropped")
+	}
+
+	report, _ := run.Finish(err)
+	if report.UnfixedByReason[ReasonOSVersionConflict] != 1 {
+		t.Errorf("drainOutbox() unfixed = %+v, want the conflict reported", report.Unfixed)
+	}
+}
+
+func TestDrainOutboxOrderPerDocument(t *testing.T) {
+	os.Setenv("POST_CHUNK_SIZE", "5")
+	defer os.Unsetenv("POST_CHUNK_SIZE")
+
+	ctx := context.Background()
+
+	mockDB := &MockOneCMSDB{
+		Outbox: []OSOutboxEntry{
+			{ID: 1, DocID: "1", Index: "test-index", Payload: []byte(`{"doc":{"article_url":"https://example.com/older"}}`)},
+			{ID: 2, DocID: "1", Index: "test-index", Payload: []byte(`{"doc":{"article_url":"https://example.com/newer"}}`)},
+		},
+	}
+	mockOS := &MockOneCMSOS{
+		BulkItemErrors: map[string]error{"1": errors.New("es_rejected_execution_exception")},
+	}
+
+	err := drainOutbox(ctx, NewRun("drain-outbox"), mockDB, mockOS, false)
+	if err == nil {
+		t.Fatalf("drainOutbox() error = nil, expected the failing entry to be reported")
+	}
+	if len(mockOS.BulkActions) != 1 {
+		t.Errorf("drainOutbox() sent %d actions, want the later entry held back", len(mockOS.BulkActions))
+	}
+	if mockDB.OutboxDone[2] || !mockDB.OutboxNextAttempt[2].IsZero() {
+		t.Errorf("drainOutbox() touched entry 2 behind the failed entry 1")
+	}
+
+	// Entry 2 waits for entry 1 until it is due again, then both are applied
+	// in order.
+	err = drainOutbox(ctx, NewRun("drain-outbox"), mockDB, mockOS, false)
+	if err != nil || len(mockOS.BulkActions) != 1 {
+		t.Fatalf("drainOutbox() = %v with %d actions, want nothing due", err, len(mockOS.BulkActions))
+	}
+
+	mockOS.BulkItemErrors = nil
+	mockDB.OutboxNextAttempt[1] = time.Now().Add(-time.Second)
+	if err := drainOutbox(ctx, NewRun("drain-outbox"), mockDB, mockOS, false); err != nil {
+		t.Fatalf("drainOutbox() error = %v, expected nil", err)
+	}
+	if !mockDB.OutboxDone[1] || !mockDB.OutboxDone[2] {
+		t.Errorf("drainOutbox() done = %v, want both entries", mockDB.OutboxDone)
+	}
+	if url := mockOS.Documents["1"].ArticleURL; url != "https://example.com/newer" {
+		t.Errorf("drainOutbox() left article_url %q, want the newer entry applied last", url)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	run := NewRun("drain-outbox")
+	run.OutboxRetryBase = time.Second
+	run.OutboxRetryMax = 5 * time.Second
+
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := outboxBackoff(run, tt.attempts); got != tt.expected {
+			t.Errorf("outboxBackoff(%d) = %v, want %v", tt.attempts, got, tt.expected)
+		}
+	}
+}
+
+func TestPopmamaPostChangesMatchUpdate(t *testing.T) {
+	before := Post{ID: "1", FullURL: "https://example.com/a-old-1", AuthorID: "old", CreatedBy: "old-creator"}
+	after := Post{ID: "1", FullURL: "https://example.com/a-new-1", AuthorID: "new", CreatedBy: "new-creator"}
+
+	audited := []string{}
+	for _, change := range popmamaPostChanges(before, after, []string{"old"}, []string{"new"}) {
+		// post_authors is written by its own statements.
+		if change.Field != "post_authors" {
+			audited = append(audited, change.Field)
+		}
+	}
+
+	set := updateBrokenPopmamaArticleCSCQuery[strings.Index(updateBrokenPopmamaArticleCSCQuery, "SET")+len("SET") : strings.Index(updateBrokenPopmamaArticleCSCQuery, "WHERE")]
+	updated := []string{}
+	for _, assignment := range strings.Split(set, ",") {
+		column, _, _ := strings.Cut(assignment, "=")
+		updated = append(updated, strings.TrimSpace(column))
+	}
+
+	if !reflect.DeepEqual(audited, updated) {
+		t.Errorf("popmamaPostChanges() audits %v, but the update writes %v", audited, updated)
+	}
 }
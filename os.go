@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/opensearch-project/opensearch-go"
 	"github.com/opensearch-project/opensearch-go/opensearchapi"
@@ -38,51 +41,175 @@ func GetOSConnection(host, username, password string) (*opensearch.Client, error
 		return nil, fmt.Errorf("OpenSearch ping failed with status: %d", res.StatusCode)
 	}
 
-	fmt.Println("✅ OpenSearch is connected successfully!")
+	slog.Info("connected to OpenSearch")
 
 	return client, err
 }
 
 type OneCMSOS interface {
-	DynamicUpdate(data interface{}, docID, index string) error
-	GetAuthorByID(authorID string) (*AuthorOS, error)
+	DynamicUpdate(ctx context.Context, data interface{}, docID, index string) error
+	BulkUpdate(ctx context.Context, actions []BulkUpdateAction, index string) (map[string]error, error)
+	GetAuthorByID(ctx context.Context, authorID string) (*AuthorOS, error)
+	GetDocumentVersion(ctx context.Context, docID, index string) (*DocVersion, error)
+	GetPostDocuments(ctx context.Context, docIDs []string, index string) (map[string]PostDocument, error)
+}
+
+// PostDocument holds the fields of a post document checked after a repair.
+type PostDocument struct {
+	ArticleURL    string     `json:"article_url"`
+	ArticleURLAMP string     `json:"article_url_amp"`
+	Authors       []AuthorOS `json:"authors"`
+}
+
+// BulkUpdateAction is a single partial update sent through the bulk API,
+// either as a doc merge or as a painless script. With a Version, the update
+// is only applied if the document was not changed since.
+type BulkUpdateAction struct {
+	DocID   string
+	Doc     interface{}
+	Script  *OSScript
+	Version *DocVersion
+}
+
+// DocVersion identifies a revision of a document, for conditional updates.
+type DocVersion struct {
+	SeqNo       int64 `json:"_seq_no"`
+	PrimaryTerm int64 `json:"_primary_term"`
+}
+
+// payload is the body of the update line: the doc to merge or the script.
+func (action BulkUpdateAction) payload() map[string]interface{} {
+	if action.Script != nil {
+		return map[string]interface{}{"script": action.Script}
+	}
+
+	return map[string]interface{}{"doc": action.Doc}
+}
+
+// isVersionConflict reports whether err is a conditional update refused
+// because the document changed.
+func isVersionConflict(err error) bool {
+	var statusErr *OSStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusConflict {
+		return true
+	}
+
+	return err != nil && strings.Contains(err.Error(), "version_conflict_engine_exception")
+}
+
+type OSScript struct {
+	Source string                 `json:"source"`
+	Lang   string                 `json:"lang,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+type bulkResponseBody struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkResponseItem `json:"items"`
+}
+
+type bulkResponseItem struct {
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error,omitempty"`
 }
 
 type oneCMSOS struct {
-	osClient *opensearch.Client
+	osClient    *opensearch.Client
+	callTimeout time.Duration
 }
 
-func NewOneCMSOS(client *opensearch.Client) *oneCMSOS {
+// NewOneCMSOS returns an OpenSearch client whose requests are each bounded by
+// callTimeout, zero meaning no limit.
+func NewOneCMSOS(client *opensearch.Client, callTimeout time.Duration) *oneCMSOS {
 	return &oneCMSOS{
-		osClient: client,
+		osClient:    client,
+		callTimeout: callTimeout,
 	}
 }
 
-func (oneOS *oneCMSOS) DynamicUpdate(data interface{}, docID, index string) error {
+func (oneOS *oneCMSOS) DynamicUpdate(ctx context.Context, data interface{}, docID, index string) error {
+	defer metrics.observeCall("opensearch", "DynamicUpdate", time.Now())
 
-	docData, err := json.Marshal(data)
+	itemErrors, err := oneOS.BulkUpdate(ctx, []BulkUpdateAction{{DocID: docID, Doc: data}}, index)
 	if err != nil {
 		return err
 	}
 
-	json := `{ "update" : {"_id" : "%s", "_index" : "%s" } }
-    { "doc" : %s }`
+	return itemErrors[docID]
+}
+
+// BulkUpdate sends every action in a single bulk request. The returned map
+// holds the failure of each rejected document, keyed by document ID.
+func (oneOS *oneCMSOS) BulkUpdate(ctx context.Context, actions []BulkUpdateAction, index string) (map[string]error, error) {
+	defer metrics.observeCall("opensearch", "BulkUpdate", time.Now())
+	metrics.BulkBatchSize.Observe(float64(len(actions)))
+
+	itemErrors := map[string]error{}
+	if len(actions) == 0 {
+		return itemErrors, nil
+	}
+
+	var body strings.Builder
+	for _, action := range actions {
+		update := map[string]interface{}{"_id": action.DocID, "_index": index}
+		if action.Version != nil {
+			update["if_seq_no"] = action.Version.SeqNo
+			update["if_primary_term"] = action.Version.PrimaryTerm
+		}
+		meta := map[string]interface{}{"update": update}
+
+		for _, line := range []interface{}{meta, action.payload()} {
+			lineData, err := json.Marshal(line)
+			if err != nil {
+				return nil, err
+			}
+			body.Write(lineData)
+			body.WriteString("\n")
+		}
+	}
 
-	query := fmt.Sprintf(json, docID, index, string(docData))
+	c, cancel := withOptionalTimeout(ctx, oneOS.callTimeout)
+	defer cancel()
 
-	bulkResponse, err := oneOS.osClient.Bulk(strings.NewReader(string(query) + "\n"))
+	bulkResponse, err := oneOS.osClient.Bulk(strings.NewReader(body.String()), oneOS.osClient.Bulk.WithContext(c))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer bulkResponse.Body.Close()
 
 	if bulkResponse.IsError() {
-		return errors.New(bulkResponse.String())
+		return nil, &OSStatusError{StatusCode: bulkResponse.StatusCode, Message: bulkResponse.String()}
 	}
 
-	return nil
+	result := bulkResponseBody{}
+	if err := json.NewDecoder(bulkResponse.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	if !result.Errors {
+		return itemErrors, nil
+	}
+
+	for _, item := range result.Items {
+		for _, detail := range item {
+			if detail.Error != nil {
+				itemErrors[detail.ID] = &OSStatusError{
+					StatusCode: detail.Status,
+					Message:    fmt.Sprintf("%s: %s", detail.Error.Type, detail.Error.Reason),
+				}
+			}
+		}
+	}
+
+	return itemErrors, nil
 }
 
-func (oneOS *oneCMSOS) GetAuthorByID(authorID string) (*AuthorOS, error) {
+func (oneOS *oneCMSOS) GetAuthorByID(ctx context.Context, authorID string) (*AuthorOS, error) {
+	defer metrics.observeCall("opensearch", "GetAuthorByID", time.Now())
 
 	authorIndex := "one-author-index"
 	var author *AuthorOS
@@ -92,12 +219,19 @@ func (oneOS *oneCMSOS) GetAuthorByID(authorID string) (*AuthorOS, error) {
 		DocumentID: authorID,
 	}
 
-	getResponse, err := osGet.Do(context.Background(), oneOS.osClient)
+	c, cancel := withOptionalTimeout(ctx, oneOS.callTimeout)
+	defer cancel()
+
+	getResponse, err := osGet.Do(c, oneOS.osClient)
 	if err != nil {
 		return author, err
 	}
 	defer getResponse.Body.Close()
 
+	if getResponse.IsError() && getResponse.StatusCode != http.StatusNotFound {
+		return nil, &OSStatusError{StatusCode: getResponse.StatusCode, Message: getResponse.String()}
+	}
+
 	result := AuthorGetResult{}
 	if err := json.NewDecoder(getResponse.Body).Decode(&result); err != nil {
 		return author, err
@@ -111,3 +245,96 @@ func (oneOS *oneCMSOS) GetAuthorByID(authorID string) (*AuthorOS, error) {
 
 	return author, nil
 }
+
+// GetDocumentVersion returns the current seq_no and primary_term of a
+// document, without its source.
+func (oneOS *oneCMSOS) GetDocumentVersion(ctx context.Context, docID, index string) (*DocVersion, error) {
+	defer metrics.observeCall("opensearch", "GetDocumentVersion", time.Now())
+
+	osGet := opensearchapi.GetRequest{
+		Index:      index,
+		DocumentID: docID,
+		Source:     []string{"false"},
+	}
+
+	c, cancel := withOptionalTimeout(ctx, oneOS.callTimeout)
+	defer cancel()
+
+	getResponse, err := osGet.Do(c, oneOS.osClient)
+	if err != nil {
+		return nil, err
+	}
+	defer getResponse.Body.Close()
+
+	if getResponse.IsError() && getResponse.StatusCode != http.StatusNotFound {
+		return nil, &OSStatusError{StatusCode: getResponse.StatusCode, Message: getResponse.String()}
+	}
+
+	result := struct {
+		Found bool `json:"found"`
+		DocVersion
+	}{}
+	if err := json.NewDecoder(getResponse.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	if !result.Found {
+		return nil, errors.New("document not found")
+	}
+
+	return &result.DocVersion, nil
+}
+
+// GetPostDocuments reads the documents of the posts in a single _mget
+// request. Documents not found are left out of the returned map.
+func (oneOS *oneCMSOS) GetPostDocuments(ctx context.Context, docIDs []string, index string) (map[string]PostDocument, error) {
+	defer metrics.observeCall("opensearch", "GetPostDocuments", time.Now())
+
+	documents := map[string]PostDocument{}
+	if len(docIDs) == 0 {
+		return documents, nil
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"ids": docIDs})
+	if err != nil {
+		return nil, err
+	}
+
+	osMget := opensearchapi.MgetRequest{
+		Index:          index,
+		Body:           bytes.NewReader(body),
+		SourceIncludes: []string{"article_url", "article_url_amp", "authors"},
+	}
+
+	c, cancel := withOptionalTimeout(ctx, oneOS.callTimeout)
+	defer cancel()
+
+	mgetResponse, err := osMget.Do(c, oneOS.osClient)
+	if err != nil {
+		return nil, err
+	}
+	defer mgetResponse.Body.Close()
+
+	if mgetResponse.IsError() {
+		return nil, &OSStatusError{StatusCode: mgetResponse.StatusCode, Message: mgetResponse.String()}
+	}
+
+	result := struct {
+		Docs []struct {
+			ID     string       `json:"_id"`
+			Found  bool         `json:"found"`
+			Source PostDocument `json:"_source"`
+		} `json:"docs"`
+	}{}
+	if err := json.NewDecoder(mgetResponse.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	for _, doc := range result.Docs {
+		if doc.Found {
+			documents[doc.ID] = doc.Source
+		}
+	}
+
+	return documents, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// enqueueOSUpdate stores an OpenSearch update in the outbox, inside
+// transactionDB when given, so drain-outbox can apply it later.
+func enqueueOSUpdate(ctx context.Context, run *Run, onecmsDB OneCMSDB, transactionDB *sql.Tx, action BulkUpdateAction, osIndex string, cause error) error {
+	// A conditional update stays conditional when drained.
+	body := action.payload()
+	if action.Version != nil {
+		body["version"] = action.Version
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	entry := OSOutboxEntry{
+		DocID:   action.DocID,
+		Index:   osIndex,
+		Payload: payload,
+		RunID:   run.ID,
+	}
+	if cause != nil {
+		entry.LastError = cause.Error()
+	}
+
+	rows, err := onecmsDB.EnqueueOSUpdate(ctx, transactionDB, entry)
+	return expectRows(ctx, onecmsDB, transactionDB, "outbox insert", rows, 1, err)
+}
+
+// outboxAction turns an outbox entry back into the bulk action it was queued
+// from, with the version it was conditional on.
+func outboxAction(entry OSOutboxEntry) (BulkUpdateAction, error) {
+	payload := struct {
+		Doc     json.RawMessage `json:"doc"`
+		Script  *OSScript       `json:"script"`
+		Version *DocVersion     `json:"version"`
+	}{}
+	if err := json.Unmarshal(entry.Payload, &payload); err != nil {
+		return BulkUpdateAction{}, err
+	}
+
+	if payload.Script != nil {
+		return BulkUpdateAction{DocID: entry.DocID, Script: payload.Script, Version: payload.Version}, nil
+	}
+
+	return BulkUpdateAction{DocID: entry.DocID, Doc: payload.Doc, Version: payload.Version}, nil
+}
+
+// queueDocument returns the write of document into the outbox, to run inside
+// the transaction of the DB change, when the run writes OpenSearch through
+// the outbox. It returns nil otherwise.
+func queueDocument(run *Run, onecmsDB OneCMSDB, document BulkUpdateAction, osIndex string) func(ctx context.Context, transactionDB *sql.Tx) error {
+	if run.OSWriteMode != OSWriteOutbox {
+		return nil
+	}
+
+	return func(ctx context.Context, transactionDB *sql.Tx) error {
+		return enqueueOSUpdate(ctx, run, onecmsDB, transactionDB, document, osIndex, nil)
+	}
+}
+
+// outboxBackoff is the delay before retrying an entry that already failed
+// attempts times.
+func outboxBackoff(run *Run, attempts int) time.Duration {
+	delay := run.OutboxRetryBase
+	for i := 0; i < attempts && delay < run.OutboxRetryMax; i++ {
+		delay *= 2
+	}
+
+	if delay > run.OutboxRetryMax {
+		return run.OutboxRetryMax
+	}
+
+	return delay
+}
+
+// drainOutbox applies the pending outbox entries due for an attempt, in bulk
+// per index, and marks each one done, or failed with its next attempt pushed
+// back. With watch it keeps polling every OutboxPollInterval until the run is
+// stopped, and the report only keeps the failures of the last pass.
+func drainOutbox(ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, watch bool) error {
+	batchSize, _ := strconv.Atoi(os.Getenv("POST_CHUNK_SIZE"))
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	run.Log.Info("draining os_outbox", "stage", StageOutbox, "batch_size", batchSize)
+	run.Progress.Start(0)
+	var unfixedPosts []UnfixedPosts
+	processed := 0
+
+	for {
+		unfixedPosts = []UnfixedPosts{}
+		var afterID int64
+
+		for run.Err(ctx) == nil {
+			entries, err := onecmsDB.GetPendingOSUpdates(ctx, afterID, batchSize)
+			if err != nil {
+				return err
+			}
+			if len(entries) == 0 {
+				break
+			}
+			afterID = entries[len(entries)-1].ID
+
+			failed := applyOutboxEntries(ctx, run, onecmsDB, onecmsOS, entries)
+			run.postsDone(StageOutbox, len(entries)-len(failed), failed...)
+			unfixedPosts = append(unfixedPosts, failed...)
+			processed += len(entries)
+
+			run.Log.Info("applied outbox batch", "stage", StageOutbox, "applied", len(entries)-len(failed), "batch_entries", len(entries), "processed", processed)
+			if err := run.Checkpoint(processed, processed, strconv.FormatInt(afterID, 10), unfixedPosts); err != nil {
+				return fmt.Errorf("failed saving report: %w", err)
+			}
+
+			logThroughput(run)
+		}
+
+		if !watch || run.Err(ctx) != nil {
+			break
+		}
+
+		select {
+		case <-time.After(run.OutboxPollInterval):
+		case <-run.Done():
+		case <-ctx.Done():
+		}
+	}
+
+	run.Progress.Finish()
+	fmt.Printf("\n🚚 UNFIXED: %v", PrettyF(unfixedPosts))
+	fmt.Printf("\n🧾 UNFIXED BY REASON: %v", PrettyF(countByReason(unfixedPosts)))
+	run.Log.Info("run summary", "stage", StageSummary, "unfixed", len(unfixedPosts), "unfixed_by_reason", countByReason(unfixedPosts))
+
+	if err := run.Err(ctx); err != nil && !watch {
+		return runStoppedError(err, processed, processed)
+	}
+
+	if len(unfixedPosts) > 0 {
+		return &UnfixedPostsError{Posts: unfixedPosts}
+	}
+
+	return nil
+}
+
+// applyOutboxEntries applies entries in bulk per index, in order for each
+// document: a document with several entries gets them over successive bulk
+// requests, and once one of them fails the later ones are held back, so the
+// failed entry never overwrites a newer update when it is retried.
+func applyOutboxEntries(ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, entries []OSOutboxEntry) []UnfixedPosts {
+	unfixedPosts := []UnfixedPosts{}
+	failedDocs := map[string]int64{}
+
+	for pending := entries; len(pending) > 0; {
+		round := []OSOutboxEntry{}
+		later := []OSOutboxEntry{}
+		inRound := map[string]bool{}
+		for _, entry := range pending {
+			doc := entry.Index + "/" + entry.DocID
+			if failedID, ok := failedDocs[doc]; ok {
+				message := "outbox entry " + strconv.FormatInt(entry.ID, 10) + " held back behind failed entry " + strconv.FormatInt(failedID, 10)
+				unfixedPosts = append(unfixedPosts, *unfixedPost(entry.DocID, ReasonOSUpdateQueued, message, nil))
+				continue
+			}
+			if inRound[doc] {
+				later = append(later, entry)
+				continue
+			}
+			inRound[doc] = true
+			round = append(round, entry)
+		}
+
+		entryErrors := sendOutboxEntries(ctx, onecmsOS, round)
+		for _, entry := range round {
+			// The document was re-indexed since the update was queued, so
+			// the update is dropped rather than retried forever.
+			if err := entryErrors[entry.ID]; isVersionConflict(err) {
+				rows, markErr := onecmsDB.MarkOSUpdateDone(ctx, entry.ID)
+				if markErr := expectRows(ctx, onecmsDB, nil, "outbox entry update", rows, 1, markErr); markErr != nil {
+					err = fmt.Errorf("%w, and marking it done: %v", err, markErr)
+				}
+				unfixedPosts = append(unfixedPosts, *unfixedPost(entry.DocID, ReasonOSVersionConflict, "outbox entry "+strconv.FormatInt(entry.ID, 10)+" dropped, the document changed since it was queued", err))
+				continue
+			}
+			if err := entryErrors[entry.ID]; err != nil {
+				failedDocs[entry.Index+"/"+entry.DocID] = entry.ID
+				nextAttemptAt := time.Now().Add(outboxBackoff(run, entry.Attempts))
+				rows, markErr := onecmsDB.MarkOSUpdateFailed(ctx, entry.ID, err.Error(), nextAttemptAt)
+				if markErr := expectRows(ctx, onecmsDB, nil, "outbox entry update", rows, 1, markErr); markErr != nil {
+					err = fmt.Errorf("%w, and marking it failed: %v", err, markErr)
+				}
+				unfixedPosts = append(unfixedPosts, *unfixedPost(entry.DocID, ReasonOSUpdateFailed, "failed applying outbox entry "+strconv.FormatInt(entry.ID, 10), err))
+				continue
+			}
+
+			rows, err := onecmsDB.MarkOSUpdateDone(ctx, entry.ID)
+			if err := expectRows(ctx, onecmsDB, nil, "outbox entry update", rows, 1, err); err != nil {
+				unfixedPosts = append(unfixedPosts, *unfixedPost(entry.DocID, dbFailureReason(err), "failed marking outbox entry "+strconv.FormatInt(entry.ID, 10)+" done", err))
+			}
+		}
+
+		pending = later
+	}
+
+	return unfixedPosts
+}
+
+// sendOutboxEntries sends entries, at most one per document, in bulk per
+// index, and returns the error of each entry that failed by its ID.
+func sendOutboxEntries(ctx context.Context, onecmsOS OneCMSOS, entries []OSOutboxEntry) map[int64]error {
+	entryErrors := map[int64]error{}
+	byIndex := map[string][]OSOutboxEntry{}
+	indexes := []string{}
+
+	for _, entry := range entries {
+		if _, ok := byIndex[entry.Index]; !ok {
+			indexes = append(indexes, entry.Index)
+		}
+		byIndex[entry.Index] = append(byIndex[entry.Index], entry)
+	}
+
+	for _, index := range indexes {
+		actions := []BulkUpdateAction{}
+		for _, entry := range byIndex[index] {
+			action, err := outboxAction(entry)
+			if err != nil {
+				entryErrors[entry.ID] = err
+				continue
+			}
+			actions = append(actions, action)
+		}
+
+		itemErrors, err := onecmsOS.BulkUpdate(ctx, actions, index)
+		for _, entry := range byIndex[index] {
+			if _, ok := entryErrors[entry.ID]; ok {
+				continue
+			}
+			if err != nil {
+				entryErrors[entry.ID] = err
+			} else if itemErrors[entry.DocID] != nil {
+				entryErrors[entry.ID] = itemErrors[entry.DocID]
+			}
+		}
+	}
+
+	return entryErrors
+}
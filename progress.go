@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// progressBarWidth is the number of cells of the progress bar.
+	progressBarWidth = 30
+	// progressRedrawInterval bounds how often the progress bar is redrawn
+	// on a terminal.
+	progressRedrawInterval = 200 * time.Millisecond
+)
+
+// Progress tracks the posts processed by a run across all its chunks. On a
+// terminal it keeps a progress bar on the last line, redrawn as posts get
+// processed and below any other output written through it. Anywhere else, as
+// in CI or nohup logs, it writes a plain line every interval instead. A
+// Progress without output only counts.
+type Progress struct {
+	out      io.Writer
+	tty      bool
+	interval time.Duration
+
+	mu        sync.Mutex
+	total     int
+	succeeded int
+	failed    int
+	startedAt time.Time
+	printedAt time.Time
+	drawn     bool
+}
+
+func NewProgress(out io.Writer, tty bool, interval time.Duration) *Progress {
+	return &Progress{out: out, tty: tty, interval: interval, startedAt: time.Now()}
+}
+
+// NewStdoutProgress returns a Progress on stdout, drawing a progress bar when
+// stdout is a terminal.
+func NewStdoutProgress(interval time.Duration) *Progress {
+	info, err := os.Stdout.Stat()
+	tty := err == nil && info.Mode()&os.ModeCharDevice != 0
+
+	return NewProgress(os.Stdout, tty, interval)
+}
+
+// Start sets the number of posts the run is going through, zero when it is
+// not known upfront, and restarts the clock.
+func (progress *Progress) Start(total int) {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	progress.total = total
+	progress.succeeded = 0
+	progress.failed = 0
+	progress.startedAt = time.Now()
+	progress.printedAt = time.Time{}
+	progress.print(false)
+}
+
+// Add counts posts processed, succeeded of them repaired and failed left
+// unfixed.
+func (progress *Progress) Add(succeeded, failed int) {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	progress.succeeded += succeeded
+	progress.failed += failed
+	progress.print(false)
+}
+
+// Finish shows the final progress and leaves the bar, if any, on its own
+// line.
+func (progress *Progress) Finish() {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	progress.print(true)
+	if progress.drawn {
+		fmt.Fprintln(progress.out)
+		progress.drawn = false
+	}
+}
+
+// Write writes p above the progress bar, so logs and the bar can share the
+// terminal.
+func (progress *Progress) Write(p []byte) (int, error) {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	if progress.out == nil {
+		return len(p), nil
+	}
+
+	if progress.drawn {
+		io.WriteString(progress.out, "\r\033[K")
+	}
+	n, err := progress.out.Write(p)
+	if progress.drawn {
+		io.WriteString(progress.out, progress.bar())
+	}
+
+	return n, err
+}
+
+// String sums the progress up, e.g. "450/1000 posts (45%), 440 ok, 10
+// failed, 12.3 posts/s, ETA 44s".
+func (progress *Progress) String() string {
+	processed := progress.succeeded + progress.failed
+	elapsed := time.Since(progress.startedAt).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(processed) / elapsed
+	}
+
+	var summary strings.Builder
+	if progress.total > 0 {
+		fmt.Fprintf(&summary, "%d/%d posts (%d%%)", processed, progress.total, progress.percent())
+	} else {
+		fmt.Fprintf(&summary, "%d posts", processed)
+	}
+	fmt.Fprintf(&summary, ", %d ok, %d failed, %.1f posts/s", progress.succeeded, progress.failed, rate)
+
+	if remaining := progress.total - processed; remaining > 0 && rate > 0 {
+		eta := time.Duration(float64(remaining) / rate * float64(time.Second))
+		fmt.Fprintf(&summary, ", ETA %s", eta.Round(time.Second))
+	}
+
+	return summary.String()
+}
+
+func (progress *Progress) percent() int {
+	processed := progress.succeeded + progress.failed
+	if progress.total <= 0 || processed >= progress.total {
+		return 100
+	}
+
+	return 100 * processed / progress.total
+}
+
+func (progress *Progress) bar() string {
+	filled := 0
+	if progress.total > 0 {
+		filled = progressBarWidth * progress.percent() / 100
+	}
+
+	return fmt.Sprintf("[%s%s] %s", strings.Repeat("#", filled), strings.Repeat(".", progressBarWidth-filled), progress)
+}
+
+// print redraws the bar, or writes a plain line once interval has passed
+// since the previous one. final forces it.
+func (progress *Progress) print(final bool) {
+	if progress.out == nil {
+		return
+	}
+
+	now := time.Now()
+	if progress.tty {
+		if !final && progress.drawn && now.Sub(progress.printedAt) < progressRedrawInterval {
+			return
+		}
+		io.WriteString(progress.out, "\r\033[K"+progress.bar())
+		progress.drawn = true
+	} else {
+		if !final && !progress.printedAt.IsZero() && now.Sub(progress.printedAt) < progress.interval {
+			return
+		}
+		fmt.Fprintf(progress.out, "progress: %s\n", progress)
+	}
+
+	progress.printedAt = now
+}
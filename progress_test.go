@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressString(t *testing.T) {
+	progress := NewProgress(nil, false, 0)
+	progress.Start(100)
+	progress.startedAt = time.Now().Add(-10 * time.Second)
+	progress.Add(40, 10)
+
+	summary := progress.String()
+	for _, part := range []string{"50/100 posts (50%)", "40 ok", "10 failed", "5.0 posts/s", "ETA 10s"} {
+		if !strings.Contains(summary, part) {
+			t.Errorf("String() = %q, expected it to contain %q", summary, part)
+		}
+	}
+
+	progress.Start(0)
+	progress.Add(3, 0)
+	if summary := progress.String(); !strings.HasPrefix(summary, "3 posts, 3 ok") || strings.Contains(summary, "ETA") {
+		t.Errorf("String() without total = %q", summary)
+	}
+}
+
+func TestProgressPlainLines(t *testing.T) {
+	var out bytes.Buffer
+	progress := NewProgress(&out, false, time.Hour)
+	progress.Start(10)
+	progress.Add(1, 0)
+	progress.Add(1, 0)
+	progress.Finish()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "progress: 0/10 posts") || !strings.HasPrefix(lines[1], "progress: 2/10 posts (20%)") {
+		t.Errorf("plain progress = %q, want a line at start and once finished", out.String())
+	}
+	if strings.Contains(out.String(), "\r") {
+		t.Errorf("plain progress = %q, want no terminal control", out.String())
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	var out bytes.Buffer
+	progress := NewProgress(&out, true, 0)
+	progress.Start(4)
+	progress.Add(2, 0)
+	progress.Finish()
+
+	if !strings.Contains(out.String(), "["+strings.Repeat("#", 15)+strings.Repeat(".", 15)+"] 2/4 posts (50%)") {
+		t.Errorf("progress bar = %q", out.String())
+	}
+
+	out.Reset()
+	progress.Start(4)
+	progress.Write([]byte("log record\n"))
+	if !strings.HasPrefix(out.String(), "\r\033[K[") || !strings.Contains(out.String(), "\r\033[Klog record\n[") {
+		t.Errorf("write above the bar = %q, want the bar cleared and redrawn below the record", out.String())
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	RedirectFormatCSV   = "csv"
+	RedirectFormatNginx = "nginx"
+	RedirectFormatJSON  = "json"
+)
+
+type Redirect struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// RedirectMap collects the old path to new path redirects of every URL a run
+// changes. Chains are collapsed as they are added, so A→B followed by B→C
+// keeps A→C and B→C.
+type RedirectMap struct {
+	Path   string
+	Format string
+
+	mu      sync.Mutex
+	entries map[string]string
+	// sources indexes entries by target, so a chain is collapsed without
+	// going over every entry.
+	sources map[string]map[string]bool
+	// saved is the content of the file at Path, read by the first Save, and
+	// pending the redirects added since the last Save.
+	saved   *RedirectMap
+	pending []Redirect
+}
+
+// NewRedirectMap returns an empty map saved to path in the given format. The
+// format defaults to the file extension, and an empty path keeps the map in
+// memory only.
+func NewRedirectMap(path, format string) (*RedirectMap, error) {
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(path), ".")
+		if format == "conf" || format == "map" {
+			format = RedirectFormatNginx
+		}
+	}
+
+	if path != "" {
+		switch format {
+		case RedirectFormatCSV, RedirectFormatNginx, RedirectFormatJSON:
+		default:
+			return nil, fmt.Errorf("unknown redirect map format %q", format)
+		}
+	}
+
+	return &RedirectMap{
+		Path:    path,
+		Format:  format,
+		entries: map[string]string{},
+		sources: map[string]map[string]bool{},
+	}, nil
+}
+
+// Add records the redirect from oldURL to newURL for both the canonical and
+// the AMP variant of the post.
+func (redirects *RedirectMap) Add(oldURL, newURL string) error {
+	items, err := RedirectsFor(oldURL, newURL)
+	if err != nil {
+		return err
+	}
+
+	redirects.mu.Lock()
+	defer redirects.mu.Unlock()
+
+	for _, item := range items {
+		redirects.add(item.From, item.To)
+	}
+	if redirects.Path != "" {
+		redirects.pending = append(redirects.pending, items...)
+	}
+
+	return nil
+}
+
+// RedirectsFor returns the path redirects needed when a post moves from
+// oldURL to newURL: the canonical path and its AMP variant. Nothing is
+// returned when the path does not change.
+func RedirectsFor(oldURL, newURL string) ([]Redirect, error) {
+	oldPath, oldAMPPath, err := redirectPaths(oldURL)
+	if err != nil {
+		return nil, err
+	}
+
+	newPath, newAMPPath, err := redirectPaths(newURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if oldPath == newPath {
+		return []Redirect{}, nil
+	}
+
+	return []Redirect{
+		{From: oldPath, To: newPath},
+		{From: oldAMPPath, To: newAMPPath},
+	}, nil
+}
+
+func redirectPaths(rawURL string) (string, string, error) {
+	u, err := parsePostURL(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	path := canonicalPath(u.EscapedPath())
+
+	return path, strings.TrimSuffix(path, "/") + ampSuffix, nil
+}
+
+func (redirects *RedirectMap) add(from, to string) {
+	// The target is live again, so whatever redirected it away is stale.
+	redirects.remove(to)
+	redirects.remove(from)
+	if from == to {
+		return
+	}
+
+	for source := range redirects.sources[from] {
+		redirects.entries[source] = to
+		redirects.index(source, to)
+	}
+	delete(redirects.sources, from)
+
+	redirects.entries[from] = to
+	redirects.index(from, to)
+}
+
+// remove drops the redirect from source, if any.
+func (redirects *RedirectMap) remove(source string) {
+	target, ok := redirects.entries[source]
+	if !ok {
+		return
+	}
+
+	delete(redirects.entries, source)
+	delete(redirects.sources[target], source)
+	if len(redirects.sources[target]) == 0 {
+		delete(redirects.sources, target)
+	}
+}
+
+func (redirects *RedirectMap) index(source, target string) {
+	if redirects.sources[target] == nil {
+		redirects.sources[target] = map[string]bool{}
+	}
+	redirects.sources[target][source] = true
+}
+
+func (redirects *RedirectMap) Len() int {
+	redirects.mu.Lock()
+	defer redirects.mu.Unlock()
+
+	return len(redirects.entries)
+}
+
+// Redirects returns the entries sorted by source path.
+func (redirects *RedirectMap) Redirects() []Redirect {
+	redirects.mu.Lock()
+	defer redirects.mu.Unlock()
+
+	items := make([]Redirect, 0, len(redirects.entries))
+	for from, to := range redirects.entries {
+		items = append(items, Redirect{From: from, To: to})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].From < items[j].From })
+
+	return items
+}
+
+// Save merges the map into the file at Path, so the same file can be reused
+// across runs. The file is read once, by the first Save of the run, and each
+// Save adds the redirects since the previous one. It is a no-op without a
+// path.
+func (redirects *RedirectMap) Save() error {
+	if redirects.Path == "" {
+		return nil
+	}
+
+	redirects.mu.Lock()
+	defer redirects.mu.Unlock()
+
+	if redirects.saved == nil {
+		saved, err := NewRedirectMap(redirects.Path, redirects.Format)
+		if err != nil {
+			return err
+		}
+		if err := saved.load(); err != nil {
+			return err
+		}
+		redirects.saved = saved
+	}
+
+	for _, redirect := range redirects.pending {
+		redirects.saved.add(redirect.From, redirect.To)
+	}
+	redirects.pending = nil
+
+	return WriteFileAtomic(redirects.Path, redirects.saved.write)
+}
+
+func (redirects *RedirectMap) load() error {
+	file, err := os.Open(redirects.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	items, err := readRedirects(file, redirects.Format)
+	if err != nil {
+		return fmt.Errorf("failed reading redirect map %s: %w", redirects.Path, err)
+	}
+
+	for _, item := range items {
+		redirects.add(item.From, item.To)
+	}
+
+	return nil
+}
+
+func readRedirects(r io.Reader, format string) ([]Redirect, error) {
+	items := []Redirect{}
+
+	switch format {
+	case RedirectFormatCSV:
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, record := range records {
+			if i == 0 && len(record) == 2 && record[0] == "from" {
+				continue
+			}
+			if len(record) != 2 {
+				return nil, fmt.Errorf("line %d: expected 2 columns, got %d", i+1, len(record))
+			}
+			items = append(items, Redirect{From: record[0], To: record[1]})
+		}
+
+	case RedirectFormatNginx:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			var from, to string
+			if _, err := fmt.Sscanf(strings.TrimSuffix(line, ";"), "%q %q", &from, &to); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			items = append(items, Redirect{From: from, To: to})
+		}
+
+	case RedirectFormatJSON:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(strings.TrimSpace(string(data))) > 0 {
+			if err := json.Unmarshal(data, &items); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return items, nil
+}
+
+func (redirects *RedirectMap) write(w io.Writer) error {
+	items := redirects.Redirects()
+
+	switch redirects.Format {
+	case RedirectFormatCSV:
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"from", "to"})
+		for _, item := range items {
+			writer.Write([]string{item.From, item.To})
+		}
+		writer.Flush()
+		return writer.Error()
+
+	case RedirectFormatNginx:
+		// Entries only, meant to be included inside a `map $uri $new_uri { }`
+		// block.
+		for _, item := range items {
+			if _, err := fmt.Fprintf(w, "%q %q;\n", item.From, item.To); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case RedirectFormatJSON:
+		data, err := json.MarshalIndent(items, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
+
+	return fmt.Errorf("unknown redirect map format %q", redirects.Format)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRedirectMapAdd(t *testing.T) {
+	tests := []struct {
+		name     string
+		changes  [][2]string
+		expected []Redirect
+	}{
+		{
+			name: "Canonical and AMP variants",
+			changes: [][2]string{
+				{"https://example.com/title-old-1/", "https://example.com/title-new-1"},
+			},
+			expected: []Redirect{
+				{From: "/title-old-1", To: "/title-new-1"},
+				{From: "/title-old-1/amp", To: "/title-new-1/amp"},
+			},
+		},
+		{
+			name: "Chain is collapsed",
+			changes: [][2]string{
+				{"/a", "/b"},
+				{"/b", "/c"},
+			},
+			expected: []Redirect{
+				{From: "/a", To: "/c"},
+				{From: "/a/amp", To: "/c/amp"},
+				{From: "/b", To: "/c"},
+				{From: "/b/amp", To: "/c/amp"},
+			},
+		},
+		{
+			name: "Moving back drops the loop",
+			changes: [][2]string{
+				{"/a", "/b"},
+				{"/b", "/a"},
+			},
+			expected: []Redirect{
+				{From: "/b", To: "/a"},
+				{From: "/b/amp", To: "/a/amp"},
+			},
+		},
+		{
+			name: "Longer chain is collapsed into its last target",
+			changes: [][2]string{
+				{"/a", "/b"},
+				{"/b", "/c"},
+				{"/c", "/d"},
+			},
+			expected: []Redirect{
+				{From: "/a", To: "/d"},
+				{From: "/a/amp", To: "/d/amp"},
+				{From: "/b", To: "/d"},
+				{From: "/b/amp", To: "/d/amp"},
+				{From: "/c", To: "/d"},
+				{From: "/c/amp", To: "/d/amp"},
+			},
+		},
+		{
+			name: "Unchanged path",
+			changes: [][2]string{
+				{"https://example.com/a?utm=x", "https://example.com/a"},
+			},
+			expected: []Redirect{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redirects, _ := NewRedirectMap("", "")
+			for _, change := range tt.changes {
+				if err := redirects.Add(change[0], change[1]); err != nil {
+					t.Fatalf("Add() error = %v", err)
+				}
+			}
+
+			if result := redirects.Redirects(); !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Redirects() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRedirectMapAddInvalidURL(t *testing.T) {
+	redirects, _ := NewRedirectMap("", "")
+
+	if err := redirects.Add("not a url", "/b"); err == nil {
+		t.Errorf("Add() expected error for an unparsable URL, got nil")
+	}
+}
+
+func TestNewRedirectMapFormat(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		format      string
+		expected    string
+		expectError bool
+	}{
+		{name: "From extension", path: "redirects.csv", expected: RedirectFormatCSV},
+		{name: "Nginx conf extension", path: "redirects.conf", expected: RedirectFormatNginx},
+		{name: "Explicit format", path: "redirects.txt", format: "json", expected: RedirectFormatJSON},
+		{name: "Unknown format", path: "redirects.txt", expectError: true},
+		{name: "Memory only", path: "", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redirects, err := NewRedirectMap(tt.path, tt.format)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("NewRedirectMap() error = %v, expectError %v", err, tt.expectError)
+			}
+			if !tt.expectError && redirects.Format != tt.expected {
+				t.Errorf("NewRedirectMap() format = %v, want %v", redirects.Format, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRedirectMapSaveAppendsAcrossRuns(t *testing.T) {
+	for _, format := range []string{RedirectFormatCSV, RedirectFormatNginx, RedirectFormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "redirects."+format)
+
+			first, _ := NewRedirectMap(path, "")
+			first.Add("/a", "/b")
+			if err := first.Save(); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+
+			second, _ := NewRedirectMap(path, "")
+			second.Add("/b", "/c")
+			second.Add("/x", "/y")
+			if err := second.Save(); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+
+			// Saving twice must not duplicate entries.
+			if err := second.Save(); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+
+			loaded, _ := NewRedirectMap(path, "")
+			if err := loaded.load(); err != nil {
+				t.Fatalf("load() error = %v", err)
+			}
+
+			expected := []Redirect{
+				{From: "/a", To: "/c"},
+				{From: "/a/amp", To: "/c/amp"},
+				{From: "/b", To: "/c"},
+				{From: "/b/amp", To: "/c/amp"},
+				{From: "/x", To: "/y"},
+				{From: "/x/amp", To: "/y/amp"},
+			}
+			if result := loaded.Redirects(); !reflect.DeepEqual(result, expected) {
+				t.Errorf("saved redirects = %v, want %v", result, expected)
+			}
+
+			if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("Save() left its temporary file behind")
+			}
+		})
+	}
+}
+
+func TestRedirectMapSaveReadsFileOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redirects.csv")
+	if err := os.WriteFile(path, []byte("from,to\n/a,/b\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	redirects, _ := NewRedirectMap(path, "")
+	redirects.Add("/b", "/c")
+	if err := redirects.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// A second read would fail on the file now.
+	if err := os.WriteFile(path, []byte("not,a,redirect\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	redirects.Add("/x", "/y")
+	if err := redirects.Save(); err != nil {
+		t.Fatalf("Save() error = %v, want the file read only once", err)
+	}
+
+	loaded, _ := NewRedirectMap(path, "")
+	if err := loaded.load(); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	expected := []Redirect{
+		{From: "/a", To: "/c"},
+		{From: "/b", To: "/c"},
+		{From: "/b/amp", To: "/c/amp"},
+		{From: "/x", To: "/y"},
+		{From: "/x/amp", To: "/y/amp"},
+	}
+	if result := loaded.Redirects(); !reflect.DeepEqual(result, expected) {
+		t.Errorf("saved redirects = %v, want %v", result, expected)
+	}
+}
+
+func TestRedirectMapNginxOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redirects.conf")
+
+	redirects, _ := NewRedirectMap(path, "")
+	redirects.Add("/a", "/b")
+	if err := redirects.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+
+	expected := "\"/a\" \"/b\";\n\"/a/amp\" \"/b/amp\";\n"
+	if string(data) != expected {
+		t.Errorf("nginx map = %q, want %q", string(data), expected)
+	}
+}
+
+func TestRedirectMapSaveWithoutPath(t *testing.T) {
+	redirects, _ := NewRedirectMap("", "")
+	redirects.Add("/a", "/b")
+
+	if err := redirects.Save(); err != nil {
+		t.Errorf("Save() error = %v, expected nil", err)
+	}
+}
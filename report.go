@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	ReportRunning             = "running"
+	ReportCompleted           = "completed"
+	ReportCompletedWithErrors = "completed_with_errors"
+	ReportFailed              = "failed"
+	ReportInterrupted         = "interrupted"
+	ReportTimedOut            = "timed_out"
+	ReportAborted             = "aborted"
+	ReportCanaryFailed        = "canary_failed"
+)
+
+// RunReport is the state of a run saved to its report file after every chunk
+// and once more when the run ends. Checkpoint is the last processed post, as
+// its created at for fix-url and rebuild-url, its old ID for fix-csc-popmama
+// and its ID for propagate-author, so an interrupted run can be resumed from
+// there.
+type RunReport struct {
+	RunID           string                 `json:"run_id"`
+	Command         string                 `json:"command"`
+	Status          string                 `json:"status"`
+	StartedAt       time.Time              `json:"started_at"`
+	FinishedAt      *time.Time             `json:"finished_at,omitempty"`
+	Total           int                    `json:"total"`
+	Processed       int                    `json:"processed"`
+	Checkpoint      string                 `json:"checkpoint,omitempty"`
+	Redirects       int                    `json:"redirects"`
+	Unfixed         []UnfixedPosts         `json:"unfixed"`
+	UnfixedByReason map[FailureReason]int  `json:"unfixed_by_reason"`
+	Retries         map[string]*RetryStats `json:"retries,omitempty"`
+	Error           string                 `json:"error,omitempty"`
+}
+
+// RetryStats counts, for a single kind of call, the extra attempts made after
+// transient errors, and how many calls eventually succeeded or gave up.
+type RetryStats struct {
+	Retries   int `json:"retries"`
+	Recovered int `json:"recovered"`
+	Exhausted int `json:"exhausted"`
+}
+
+// reportStatus maps the error a run ended with to its report status. Only
+// stopped, why the run itself was stopped, makes it interrupted or timed out:
+// a call or post timing out in err fails the run like any other error.
+func reportStatus(err, stopped error, unfixed int) string {
+	switch {
+	case err == nil:
+		return ReportCompleted
+	case isAborted(err):
+		return ReportAborted
+	case errors.As(err, new(*CanaryError)):
+		return ReportCanaryFailed
+	case errors.Is(stopped, ErrInterrupted), errors.Is(stopped, context.Canceled):
+		return ReportInterrupted
+	case errors.Is(stopped, context.DeadlineExceeded):
+		return ReportTimedOut
+	case unfixed > 0:
+		return ReportCompletedWithErrors
+	}
+
+	return ReportFailed
+}
+
+func (report RunReport) write(w io.Writer) error {
+	data, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
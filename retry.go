@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// OSStatusError is an OpenSearch request, or a single bulk item, rejected with
+// an HTTP status.
+type OSStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *OSStatusError) Error() string {
+	return e.Message
+}
+
+// retryablePQCodes are the Postgres errors worth another attempt, on top of
+// the connection exception class.
+var retryablePQCodes = map[pq.ErrorCode]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"53300": true, // too_many_connections
+	"57P03": true, // cannot_connect_now
+}
+
+// retryableOSStatus are the OpenSearch statuses worth another attempt.
+var retryableOSStatus = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// isRetryable reports whether err is transient: a Postgres serialization
+// failure, deadlock or connection error, an OpenSearch 429 or 5xx gateway
+// status, or a network failure. Anything else is permanent.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return retryablePQCodes[pqErr.Code] || pqErr.Code.Class() == "08"
+	}
+
+	var statusErr *OSStatusError
+	if errors.As(err, &statusErr) {
+		return retryableOSStatus[statusErr.StatusCode]
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	// The deadline of a single call, since retry gives up once the run or
+	// post context itself is done.
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retryBackoff is the delay before the attempt following attempt: the
+// exponential delay from RetryBaseDelay capped at RetryMaxDelay, of which the
+// upper half is random so concurrent retries spread out.
+func retryBackoff(run *Run, attempt int) time.Duration {
+	delay := run.RetryBaseDelay
+	for i := 1; i < attempt && delay < run.RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > run.RetryMaxDelay {
+		delay = run.RetryMaxDelay
+	}
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// retry calls fn until it succeeds, fails with a permanent error or
+// RetryMaxAttempts attempts were made, waiting retryBackoff between attempts.
+// It gives up early when ctx is done. The attempts are recorded in the run
+// report under name.
+func retry(ctx context.Context, run *Run, name string, fn func(ctx context.Context) error) error {
+	attempts := 0
+	for {
+		attempts++
+		err := fn(ctx)
+		if err == nil || attempts >= run.RetryMaxAttempts || !isRetryable(err) || ctx.Err() != nil {
+			run.recordAttempts(name, attempts, err)
+			return err
+		}
+
+		select {
+		case <-time.After(retryBackoff(run, attempts)):
+		case <-ctx.Done():
+			run.recordAttempts(name, attempts, err)
+			return err
+		}
+	}
+}
+
+// retryingDB retries the standalone Postgres calls of the wrapped client.
+// Statements run inside a transaction are left alone, since a failed one
+// aborts the whole transaction: callers retry the transaction instead.
+type retryingDB struct {
+	OneCMSDB
+	run *Run
+}
+
+// NewRetryingDB wraps onecmsDB with the retry policy of run.
+func NewRetryingDB(onecmsDB OneCMSDB, run *Run) OneCMSDB {
+	return &retryingDB{OneCMSDB: onecmsDB, run: run}
+}
+
+func (r *retryingDB) GetPostsByCreatedAt(ctx context.Context, startAt, endAt string) ([]Post, error) {
+	var posts []Post
+	err := retry(ctx, r.run, "postgres.GetPostsByCreatedAt", func(ctx context.Context) (err error) {
+		posts, err = r.OneCMSDB.GetPostsByCreatedAt(ctx, startAt, endAt)
+		return err
+	})
+
+	return posts, err
+}
+
+func (r *retryingDB) GetPostsWithCategoryByCreatedAt(ctx context.Context, startAt, endAt string) ([]Post, error) {
+	var posts []Post
+	err := retry(ctx, r.run, "postgres.GetPostsWithCategoryByCreatedAt", func(ctx context.Context) (err error) {
+		posts, err = r.OneCMSDB.GetPostsWithCategoryByCreatedAt(ctx, startAt, endAt)
+		return err
+	})
+
+	return posts, err
+}
+
+func (r *retryingDB) GetBrokenPopmamaArticleCSC(ctx context.Context) ([]BrokenPopmamaArticleCSC, error) {
+	var posts []BrokenPopmamaArticleCSC
+	err := retry(ctx, r.run, "postgres.GetBrokenPopmamaArticleCSC", func(ctx context.Context) (err error) {
+		posts, err = r.OneCMSDB.GetBrokenPopmamaArticleCSC(ctx)
+		return err
+	})
+
+	return posts, err
+}
+
+func (r *retryingDB) GetAuthorKeyByPostID(ctx context.Context, postID string) (string, error) {
+	var key string
+	err := retry(ctx, r.run, "postgres.GetAuthorKeyByPostID", func(ctx context.Context) (err error) {
+		key, err = r.OneCMSDB.GetAuthorKeyByPostID(ctx, postID)
+		return err
+	})
+
+	return key, err
+}
+
+func (r *retryingDB) GetPostsByIDs(ctx context.Context, postIDs []string) ([]Post, error) {
+	var posts []Post
+	err := retry(ctx, r.run, "postgres.GetPostsByIDs", func(ctx context.Context) (err error) {
+		posts, err = r.OneCMSDB.GetPostsByIDs(ctx, postIDs)
+		return err
+	})
+
+	return posts, err
+}
+
+func (r *retryingDB) GetPostByOldIDAndPublisher(ctx context.Context, oldID, publisher string) (*Post, error) {
+	var post *Post
+	err := retry(ctx, r.run, "postgres.GetPostByOldIDAndPublisher", func(ctx context.Context) (err error) {
+		post, err = r.OneCMSDB.GetPostByOldIDAndPublisher(ctx, oldID, publisher)
+		return err
+	})
+
+	return post, err
+}
+
+func (r *retryingDB) GetPostsByAuthorID(ctx context.Context, authorID string) ([]AuthorPost, error) {
+	var posts []AuthorPost
+	err := retry(ctx, r.run, "postgres.GetPostsByAuthorID", func(ctx context.Context) (err error) {
+		posts, err = r.OneCMSDB.GetPostsByAuthorID(ctx, authorID)
+		return err
+	})
+
+	return posts, err
+}
+
+func (r *retryingDB) GetPostIDByURL(ctx context.Context, publisher, fullURL, excludePostID string) (string, error) {
+	var postID string
+	err := retry(ctx, r.run, "postgres.GetPostIDByURL", func(ctx context.Context) (err error) {
+		postID, err = r.OneCMSDB.GetPostIDByURL(ctx, publisher, fullURL, excludePostID)
+		return err
+	})
+
+	return postID, err
+}
+
+func (r *retryingDB) GetPostsAuthorIDs(ctx context.Context, postIDs []string) (map[string][]string, error) {
+	var authorIDs map[string][]string
+	err := retry(ctx, r.run, "postgres.GetPostsAuthorIDs", func(ctx context.Context) (err error) {
+		authorIDs, err = r.OneCMSDB.GetPostsAuthorIDs(ctx, postIDs)
+		return err
+	})
+
+	return authorIDs, err
+}
+
+func (r *retryingDB) EnqueueOSUpdate(ctx context.Context, transactionDB *sql.Tx, entry OSOutboxEntry) (int64, error) {
+	if transactionDB != nil {
+		return r.OneCMSDB.EnqueueOSUpdate(ctx, transactionDB, entry)
+	}
+
+	var rows int64
+	err := retry(ctx, r.run, "postgres.EnqueueOSUpdate", func(ctx context.Context) (err error) {
+		rows, err = r.OneCMSDB.EnqueueOSUpdate(ctx, nil, entry)
+		return err
+	})
+
+	return rows, err
+}
+
+func (r *retryingDB) GetPendingOSUpdates(ctx context.Context, afterID int64, limit int) ([]OSOutboxEntry, error) {
+	var entries []OSOutboxEntry
+	err := retry(ctx, r.run, "postgres.GetPendingOSUpdates", func(ctx context.Context) (err error) {
+		entries, err = r.OneCMSDB.GetPendingOSUpdates(ctx, afterID, limit)
+		return err
+	})
+
+	return entries, err
+}
+
+func (r *retryingDB) MarkOSUpdateDone(ctx context.Context, id int64) (int64, error) {
+	var rows int64
+	err := retry(ctx, r.run, "postgres.MarkOSUpdateDone", func(ctx context.Context) (err error) {
+		rows, err = r.OneCMSDB.MarkOSUpdateDone(ctx, id)
+		return err
+	})
+
+	return rows, err
+}
+
+func (r *retryingDB) MarkOSUpdateFailed(ctx context.Context, id int64, lastError string, nextAttemptAt time.Time) (int64, error) {
+	var rows int64
+	err := retry(ctx, r.run, "postgres.MarkOSUpdateFailed", func(ctx context.Context) (err error) {
+		rows, err = r.OneCMSDB.MarkOSUpdateFailed(ctx, id, lastError, nextAttemptAt)
+		return err
+	})
+
+	return rows, err
+}
+
+// retryingOS retries the calls of the wrapped OpenSearch client. Bulk
+// updates resend only the documents rejected with a retryable status.
+type retryingOS struct {
+	OneCMSOS
+	run *Run
+}
+
+// NewRetryingOS wraps onecmsOS with the retry policy of run.
+func NewRetryingOS(onecmsOS OneCMSOS, run *Run) OneCMSOS {
+	return &retryingOS{OneCMSOS: onecmsOS, run: run}
+}
+
+func (r *retryingOS) DynamicUpdate(ctx context.Context, data interface{}, docID, index string) error {
+	return retry(ctx, r.run, "opensearch.DynamicUpdate", func(ctx context.Context) error {
+		return r.OneCMSOS.DynamicUpdate(ctx, data, docID, index)
+	})
+}
+
+func (r *retryingOS) BulkUpdate(ctx context.Context, actions []BulkUpdateAction, index string) (map[string]error, error) {
+	itemErrors := map[string]error{}
+	pending := actions
+	var requestErr error
+
+	retry(ctx, r.run, "opensearch.BulkUpdate", func(ctx context.Context) error {
+		failed, err := r.OneCMSOS.BulkUpdate(ctx, pending, index)
+		requestErr = err
+		if err != nil {
+			return err
+		}
+
+		retryable := []BulkUpdateAction{}
+		var retryErr error
+		for _, action := range pending {
+			delete(itemErrors, action.DocID)
+			if itemErr := failed[action.DocID]; itemErr != nil {
+				itemErrors[action.DocID] = itemErr
+				if isRetryable(itemErr) {
+					retryable = append(retryable, action)
+					retryErr = itemErr
+				}
+			}
+		}
+		pending = retryable
+
+		return retryErr
+	})
+
+	if requestErr != nil {
+		// Nothing was applied yet, the whole request failed.
+		if len(pending) == len(actions) {
+			return nil, requestErr
+		}
+
+		for _, action := range pending {
+			itemErrors[action.DocID] = requestErr
+		}
+	}
+
+	return itemErrors, nil
+}
+
+func (r *retryingOS) GetAuthorByID(ctx context.Context, authorID string) (*AuthorOS, error) {
+	var author *AuthorOS
+	err := retry(ctx, r.run, "opensearch.GetAuthorByID", func(ctx context.Context) (err error) {
+		author, err = r.OneCMSOS.GetAuthorByID(ctx, authorID)
+		return err
+	})
+
+	return author, err
+}
+
+func (r *retryingOS) GetDocumentVersion(ctx context.Context, docID, index string) (*DocVersion, error) {
+	var version *DocVersion
+	err := retry(ctx, r.run, "opensearch.GetDocumentVersion", func(ctx context.Context) (err error) {
+		version, err = r.OneCMSOS.GetDocumentVersion(ctx, docID, index)
+		return err
+	})
+
+	return version, err
+}
+
+func (r *retryingOS) GetPostDocuments(ctx context.Context, docIDs []string, index string) (map[string]PostDocument, error) {
+	var documents map[string]PostDocument
+	err := retry(ctx, r.run, "opensearch.GetPostDocuments", func(ctx context.Context) (err error) {
+		documents, err = r.OneCMSOS.GetPostDocuments(ctx, docIDs, index)
+		return err
+	})
+
+	return documents, err
+}
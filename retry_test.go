@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"Nil", nil, false},
+		{"Serialization failure", &pq.Error{Code: "40001"}, true},
+		{"Deadlock", fmt.Errorf("update: %w", &pq.Error{Code: "40P01"}), true},
+		{"Connection failure", &pq.Error{Code: "08006"}, true},
+		{"Unique violation", &pq.Error{Code: "23505"}, false},
+		{"Too many requests", &OSStatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{"Service unavailable", &OSStatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"Document missing", &OSStatusError{StatusCode: http.StatusNotFound}, false},
+		{"Connection reset", fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{"Call timeout", context.DeadlineExceeded, true},
+		{"Other", errors.New("invalid url"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.expected {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	run := NewRun("test")
+	run.RetryBaseDelay = 100 * time.Millisecond
+	run.RetryMaxDelay = 300 * time.Millisecond
+
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 300 * time.Millisecond},
+		{8, 300 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		got := retryBackoff(run, tt.attempt)
+		if got < tt.expected/2 || got > tt.expected {
+			t.Errorf("retryBackoff(%d) = %v, want between %v and %v", tt.attempt, got, tt.expected/2, tt.expected)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Retries transient errors until success", func(t *testing.T) {
+		run := NewRun("test")
+		run.RetryBaseDelay = time.Millisecond
+
+		calls := 0
+		err := retry(ctx, run, "test.call", func(ctx context.Context) error {
+			calls++
+			if calls < 3 {
+				return &OSStatusError{StatusCode: http.StatusServiceUnavailable}
+			}
+			return nil
+		})
+		if err != nil || calls != 3 {
+			t.Fatalf("retry() error = %v after %d calls, want success after 3", err, calls)
+		}
+
+		report, _ := run.Finish(nil)
+		if stats := report.Retries["test.call"]; stats == nil || *stats != (RetryStats{Retries: 2, Recovered: 1}) {
+			t.Errorf("retry() stats = %+v, want 2 retries and 1 recovered", stats)
+		}
+	})
+
+	t.Run("Gives up on permanent errors", func(t *testing.T) {
+		run := NewRun("test")
+
+		calls := 0
+		err := retry(ctx, run, "test.call", func(ctx context.Context) error {
+			calls++
+			return errors.New("invalid url")
+		})
+		if err == nil || calls != 1 {
+			t.Errorf("retry() error = %v after %d calls, want a failure after 1", err, calls)
+		}
+
+		report, _ := run.Finish(err)
+		if len(report.Retries) != 0 {
+			t.Errorf("retry() stats = %+v, want none", report.Retries)
+		}
+	})
+
+	t.Run("Stops after the max attempts", func(t *testing.T) {
+		run := NewRun("test")
+		run.RetryBaseDelay = time.Millisecond
+		run.RetryMaxAttempts = 2
+
+		calls := 0
+		err := retry(ctx, run, "test.call", func(ctx context.Context) error {
+			calls++
+			return &pq.Error{Code: "40001"}
+		})
+		if err == nil || calls != 2 {
+			t.Errorf("retry() error = %v after %d calls, want a failure after 2", err, calls)
+		}
+
+		report, _ := run.Finish(err)
+		if stats := report.Retries["test.call"]; stats == nil || stats.Exhausted != 1 {
+			t.Errorf("retry() stats = %+v, want 1 exhausted", stats)
+		}
+	})
+}
+
+func TestRetryingOSBulkUpdate(t *testing.T) {
+	run := NewRun("test")
+	run.RetryBaseDelay = time.Millisecond
+
+	mockOS := &MockOneCMSOS{
+		BulkItemErrors: map[string]error{
+			"2": &OSStatusError{StatusCode: http.StatusTooManyRequests, Message: "es_rejected_execution_exception"},
+			"3": &OSStatusError{StatusCode: http.StatusNotFound, Message: "document_missing_exception"},
+		},
+	}
+
+	actions := []BulkUpdateAction{{DocID: "1"}, {DocID: "2"}, {DocID: "3"}}
+	itemErrors, err := NewRetryingOS(mockOS, run).BulkUpdate(context.Background(), actions, "test-index")
+	if err != nil {
+		t.Fatalf("BulkUpdate() error = %v, expected nil", err)
+	}
+
+	sent := []string{}
+	for _, action := range mockOS.BulkActions {
+		sent = append(sent, action.DocID)
+	}
+	if fmt.Sprint(sent) != "[1 2 3 2 2]" {
+		t.Errorf("BulkUpdate() sent %v, want only the rejected document resent", sent)
+	}
+	if len(itemErrors) != 2 || itemErrors["2"] == nil || itemErrors["3"] == nil {
+		t.Errorf("BulkUpdate() item errors = %v, want documents 2 and 3", itemErrors)
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	URLCollisionFail   = "fail"
+	URLCollisionSuffix = "suffix"
+)
+
+const (
+	OSFailureCompensate = "compensate"
+	OSFailureOutbox     = "outbox"
+)
+
+const (
+	OSWriteInline = "inline"
+	OSWriteOutbox = "outbox"
+)
+
+const (
+	OSConcurrencyOff    = "off"
+	OSConcurrencyReport = "report"
+	OSConcurrencyRetry  = "retry"
+)
+
+// ErrInterrupted is returned by a run stopped with Stop, once the posts in
+// flight are done.
+var ErrInterrupted = errors.New("interrupted")
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// Run carries the state shared by every step of a single repair invocation.
+type Run struct {
+	ID        string
+	Command   string
+	StartedAt time.Time
+	Redirects *RedirectMap
+
+	// Args are the arguments the command was started with, and Operator who
+	// started it, both recorded in the run history.
+	Args     []string
+	Operator string
+
+	// RedirectsTable receives the redirects of every URL change in the same
+	// transaction as the change itself. Empty disables it.
+	RedirectsTable     string
+	RedirectStatusCode int
+
+	// URLCollisionStrategy decides what happens when a rewritten URL is
+	// already used by another post of the publisher: URLCollisionFail leaves
+	// the post unfixed, URLCollisionSuffix numbers its slug until it is free.
+	URLCollisionStrategy string
+
+	// OSFailureStrategy decides what happens when the OpenSearch update of
+	// a committed DB change fails: OSFailureCompensate reverts the DB
+	// change, OSFailureOutbox queues the update for drain-outbox.
+	OSFailureStrategy string
+
+	// OSWriteMode decides how repairs reach OpenSearch: OSWriteInline
+	// updates it right after the DB commit, OSWriteOutbox writes the update
+	// into the outbox in the same transaction as the DB change and leaves it
+	// to drain-outbox.
+	OSWriteMode string
+
+	// OSConcurrency decides whether inline OpenSearch doc updates are
+	// conditional on the document version read before the DB change:
+	// OSConcurrencyOff sends them as is, OSConcurrencyReport reports a
+	// conflict as a failure and OSConcurrencyRetry re-reads the version and
+	// sends the update again, up to RetryMaxAttempts times.
+	OSConcurrency string
+
+	// OutboxPollInterval is how often drain-outbox --watch looks for new
+	// entries. A failed entry is retried after OutboxRetryBase, doubled on
+	// every attempt up to OutboxRetryMax.
+	OutboxPollInterval time.Duration
+	OutboxRetryBase    time.Duration
+	OutboxRetryMax     time.Duration
+
+	// RetryMaxAttempts bounds the attempts of a Postgres or OpenSearch call
+	// failing with a transient error. The delay between attempts starts at
+	// RetryBaseDelay and doubles up to RetryMaxDelay, with jitter.
+	RetryMaxAttempts int
+	RetryBaseDelay   time.Duration
+	RetryMaxDelay    time.Duration
+
+	// DBThrottle and OSThrottle limit the writes to Postgres and
+	// OpenSearch, and track their throughput.
+	DBThrottle *Throttle
+	OSThrottle *Throttle
+
+	// RunTimeout bounds the whole run, PostTimeout the repair of a single
+	// post and CallTimeout every Postgres or OpenSearch call. Zero means no
+	// limit.
+	RunTimeout  time.Duration
+	PostTimeout time.Duration
+	CallTimeout time.Duration
+
+	// MaxChanges aborts the run before its first change when it selects more
+	// posts, zero meaning no cap. Confirm is shown the impact of the run
+	// before its first change and decides whether it goes ahead. Nil goes
+	// ahead without asking.
+	MaxChanges int
+	Confirm    func(impact Impact) bool
+
+	// Canary is how many posts fix-url and fix-csc-popmama repair first, in
+	// a chunk of their own verified before the other posts are touched:
+	// the first ones, or picked at random with CanaryRandom. Zero disables
+	// it.
+	Canary       int
+	CanaryRandom bool
+
+	// VerifyWrites re-reads the posts repaired by every chunk from Postgres
+	// and OpenSearch, and reports those either store disagrees with.
+	VerifyWrites bool
+
+	// ReportFile receives the run report after every chunk. Empty keeps it
+	// in memory only.
+	ReportFile string
+
+	// Log receives the records of the run, with its run_id. OpenLog sends it
+	// where LogConfig says.
+	Log       *slog.Logger
+	LogConfig LogConfig
+
+	// Progress counts the posts processed across all chunks. Once OpenLog
+	// is called it shows on stdout, with a plain line every
+	// ProgressInterval when stdout is not a terminal.
+	Progress         *Progress
+	ProgressInterval time.Duration
+
+	logFile  *lumberjack.Logger
+	mu       sync.Mutex
+	report   RunReport
+	ctx      context.Context
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewRun(command string) *Run {
+	redirects, _ := NewRedirectMap("", "")
+	id := newRunID()
+	startedAt := time.Now()
+
+	return &Run{
+		ID:        id,
+		Command:   command,
+		StartedAt: startedAt,
+		Redirects: redirects,
+		Args:      []string{},
+		Operator:  runOperator(""),
+
+		RedirectStatusCode:   http.StatusMovedPermanently,
+		URLCollisionStrategy: URLCollisionFail,
+		OSFailureStrategy:    OSFailureCompensate,
+		OSWriteMode:          OSWriteInline,
+		OSConcurrency:        OSConcurrencyOff,
+		OutboxPollInterval:   5 * time.Second,
+		OutboxRetryBase:      10 * time.Second,
+		OutboxRetryMax:       time.Hour,
+		RetryMaxAttempts:     3,
+		RetryBaseDelay:       200 * time.Millisecond,
+		RetryMaxDelay:        5 * time.Second,
+		CallTimeout:          10 * time.Second,
+		DBThrottle:           NewThrottle("Postgres", 0, 0),
+		OSThrottle:           NewThrottle("OpenSearch", 0, 0),
+		Log:                  slog.Default().With("run_id", id),
+		LogConfig:            DefaultLogConfig(),
+		Progress:             NewProgress(nil, false, 0),
+		ProgressInterval:     10 * time.Second,
+
+		report: RunReport{
+			RunID:     id,
+			Command:   command,
+			Status:    ReportRunning,
+			StartedAt: startedAt,
+			Unfixed:   []UnfixedPosts{},
+		},
+		stop: make(chan struct{}),
+	}
+}
+
+// NewRunFromEnv builds a run from the environment.
+//
+// Its redirect map is saved to REDIRECT_MAP_FILE in REDIRECT_MAP_FORMAT, and
+// its redirects are stored in REDIRECTS_TABLE with REDIRECT_STATUS_CODE. URL
+// collisions are handled with URL_COLLISION_STRATEGY.
+//
+// OpenSearch writes follow OS_WRITE_MODE, their failures
+// OS_FAILURE_STRATEGY and their conflicts OS_CONCURRENCY_CONTROL. Transient
+// errors are retried up to RETRY_MAX_ATTEMPTS times, and writes to each store
+// are limited to WRITE_DOCS_PER_SECOND and WRITE_REQUESTS_PER_SECOND.
+//
+// Timeouts and delays are read from RUN_TIMEOUT, POST_TIMEOUT, CALL_TIMEOUT,
+// RETRY_BASE_DELAY, RETRY_MAX_DELAY, OUTBOX_POLL_INTERVAL, OUTBOX_RETRY_BASE,
+// OUTBOX_RETRY_MAX and PROGRESS_INTERVAL.
+//
+// Chunks are verified with VERIFY_WRITES. The report is saved to REPORT_FILE,
+// by default report-<run ID>.json, and logging is configured with the LOG_*
+// variables, see NewLogConfigFromEnv.
+func NewRunFromEnv(command string) (*Run, error) {
+	run := NewRun(command)
+
+	redirects, err := NewRedirectMap(os.Getenv("REDIRECT_MAP_FILE"), os.Getenv("REDIRECT_MAP_FORMAT"))
+	if err != nil {
+		return nil, err
+	}
+	run.Redirects = redirects
+
+	run.RedirectsTable = os.Getenv("REDIRECTS_TABLE")
+	if run.RedirectsTable != "" && !sqlIdentifier.MatchString(run.RedirectsTable) {
+		return nil, fmt.Errorf("invalid REDIRECTS_TABLE %q", run.RedirectsTable)
+	}
+
+	if statusCode := os.Getenv("REDIRECT_STATUS_CODE"); statusCode != "" {
+		run.RedirectStatusCode, err = strconv.Atoi(statusCode)
+		if err != nil || run.RedirectStatusCode < 300 || run.RedirectStatusCode > 399 {
+			return nil, fmt.Errorf("invalid REDIRECT_STATUS_CODE %q", statusCode)
+		}
+	}
+
+	switch strategy := os.Getenv("URL_COLLISION_STRATEGY"); strategy {
+	case "":
+	case URLCollisionFail, URLCollisionSuffix:
+		run.URLCollisionStrategy = strategy
+	default:
+		return nil, fmt.Errorf("invalid URL_COLLISION_STRATEGY %q", strategy)
+	}
+
+	switch strategy := os.Getenv("OS_FAILURE_STRATEGY"); strategy {
+	case "":
+	case OSFailureCompensate, OSFailureOutbox:
+		run.OSFailureStrategy = strategy
+	default:
+		return nil, fmt.Errorf("invalid OS_FAILURE_STRATEGY %q", strategy)
+	}
+
+	switch mode := os.Getenv("OS_WRITE_MODE"); mode {
+	case "":
+	case OSWriteInline, OSWriteOutbox:
+		run.OSWriteMode = mode
+	default:
+		return nil, fmt.Errorf("invalid OS_WRITE_MODE %q", mode)
+	}
+
+	switch concurrency := os.Getenv("OS_CONCURRENCY_CONTROL"); concurrency {
+	case "":
+	case OSConcurrencyOff, OSConcurrencyReport, OSConcurrencyRetry:
+		run.OSConcurrency = concurrency
+	default:
+		return nil, fmt.Errorf("invalid OS_CONCURRENCY_CONTROL %q", concurrency)
+	}
+
+	if attempts := os.Getenv("RETRY_MAX_ATTEMPTS"); attempts != "" {
+		run.RetryMaxAttempts, err = strconv.Atoi(attempts)
+		if err != nil || run.RetryMaxAttempts < 1 {
+			return nil, fmt.Errorf("invalid RETRY_MAX_ATTEMPTS %q", attempts)
+		}
+	}
+
+	rates := []struct {
+		key   string
+		value *float64
+	}{
+		{key: "WRITE_DOCS_PER_SECOND", value: &run.DBThrottle.DocsPerSecond},
+		{key: "WRITE_REQUESTS_PER_SECOND", value: &run.DBThrottle.RequestsPerSecond},
+	}
+	for _, rate := range rates {
+		value := os.Getenv(rate.key)
+		if value == "" {
+			continue
+		}
+
+		*rate.value, err = strconv.ParseFloat(value, 64)
+		if err != nil || *rate.value < 0 {
+			return nil, fmt.Errorf("invalid %s %q", rate.key, value)
+		}
+	}
+	run.OSThrottle.DocsPerSecond = run.DBThrottle.DocsPerSecond
+	run.OSThrottle.RequestsPerSecond = run.DBThrottle.RequestsPerSecond
+
+	if verify := os.Getenv("VERIFY_WRITES"); verify != "" {
+		run.VerifyWrites, err = strconv.ParseBool(verify)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VERIFY_WRITES %q", verify)
+		}
+	}
+
+	run.LogConfig, err = NewLogConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	run.ReportFile = os.Getenv("REPORT_FILE")
+	if run.ReportFile == "" {
+		run.ReportFile = "report-" + run.ID + ".json"
+	}
+
+	durations := []struct {
+		key   string
+		value *time.Duration
+	}{
+		{key: "RUN_TIMEOUT", value: &run.RunTimeout},
+		{key: "POST_TIMEOUT", value: &run.PostTimeout},
+		{key: "CALL_TIMEOUT", value: &run.CallTimeout},
+		{key: "RETRY_BASE_DELAY", value: &run.RetryBaseDelay},
+		{key: "RETRY_MAX_DELAY", value: &run.RetryMaxDelay},
+		{key: "OUTBOX_POLL_INTERVAL", value: &run.OutboxPollInterval},
+		{key: "OUTBOX_RETRY_BASE", value: &run.OutboxRetryBase},
+		{key: "OUTBOX_RETRY_MAX", value: &run.OutboxRetryMax},
+		{key: "PROGRESS_INTERVAL", value: &run.ProgressInterval},
+	}
+	for _, duration := range durations {
+		value := os.Getenv(duration.key)
+		if value == "" {
+			continue
+		}
+
+		*duration.value, err = time.ParseDuration(value)
+		if err != nil || *duration.value < 0 {
+			return nil, fmt.Errorf("invalid %s %q", duration.key, value)
+		}
+	}
+
+	return run, nil
+}
+
+// OpenLog sends the records of the run where LogConfig says, and makes its
+// logger the default one so code without a run logs there too. The progress
+// of the run shows on stdout from then on, below the records written there.
+func (run *Run) OpenLog() error {
+	run.Progress = NewStdoutProgress(run.ProgressInterval)
+	logger, logFile, err := NewLogger(run.LogConfig, run.Progress)
+	if err != nil {
+		return err
+	}
+
+	run.Log = logger.With("run_id", run.ID)
+	run.logFile = logFile
+	slog.SetDefault(run.Log)
+
+	return nil
+}
+
+// CloseLog closes the log file opened by OpenLog.
+func (run *Run) CloseLog() error {
+	if run.logFile == nil {
+		return nil
+	}
+
+	return run.logFile.Close()
+}
+
+// Context derives the context of the whole run from parent, bounded by
+// RunTimeout. Finish tells from it whether the run timed out or was aborted.
+func (run *Run) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := withOptionalTimeout(parent, run.RunTimeout)
+	run.ctx = ctx
+
+	return ctx, cancel
+}
+
+// PostContext derives the context of a single post from the run context,
+// bounded by PostTimeout.
+func (run *Run) PostContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withOptionalTimeout(ctx, run.PostTimeout)
+}
+
+// Stop makes the run stop taking new posts. Posts in flight are finished or
+// rolled back as usual.
+func (run *Run) Stop() {
+	run.stopOnce.Do(func() { close(run.stop) })
+}
+
+// Done is closed once Stop is called.
+func (run *Run) Done() <-chan struct{} {
+	return run.stop
+}
+
+// Err reports why the run must not take new posts: ErrInterrupted once Stop
+// was called, or the error of ctx.
+func (run *Run) Err(ctx context.Context) error {
+	select {
+	case <-run.stop:
+		return ErrInterrupted
+	default:
+	}
+
+	return ctx.Err()
+}
+
+// HandleSignals stops the run on the first SIGINT or SIGTERM, and calls cancel
+// on the second to abort the posts in flight as well. The returned function
+// stops listening.
+func (run *Run) HandleSignals(cancel context.CancelFunc) func() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-signals:
+			run.Log.Warn("stopping the run, finishing the posts in flight, send the signal again to abort them", "signal", sig.String())
+			run.Stop()
+		case <-done:
+			return
+		}
+
+		select {
+		case sig := <-signals:
+			run.Log.Warn("aborting the posts in flight", "signal", sig.String())
+			cancel()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// Checkpoint records the progress of the run and saves its report.
+func (run *Run) Checkpoint(processed, total int, checkpoint string, unfixedPosts []UnfixedPosts) error {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	run.report.Total = total
+	run.report.Processed = processed
+	if checkpoint != "" {
+		run.report.Checkpoint = checkpoint
+	}
+	run.report.Unfixed = append([]UnfixedPosts{}, unfixedPosts...)
+
+	return run.saveReport()
+}
+
+// postsDone counts processed posts in the progress and metrics of the run:
+// succeeded of them repaired at stage, and the unfixed ones, which get logged.
+func (run *Run) postsDone(stage string, succeeded int, unfixed ...UnfixedPosts) {
+	if succeeded > 0 {
+		metrics.PostsProcessed.WithLabelValues("fixed", stage).Add(float64(succeeded))
+	}
+	for _, post := range unfixed {
+		logUnfixed(run, post)
+		metrics.PostsProcessed.WithLabelValues("unfixed", unfixedStage(post)).Inc()
+	}
+
+	run.Progress.Add(succeeded, len(unfixed))
+}
+
+// recordAttempts adds a call that took attempts attempts, and ended with err,
+// to the retry stats of the report. Calls that succeeded at once are not
+// recorded.
+func (run *Run) recordAttempts(name string, attempts int, err error) {
+	if attempts <= 1 {
+		return
+	}
+
+	outcome := "recovered"
+	if err != nil {
+		outcome = "exhausted"
+	}
+	metrics.Retries.WithLabelValues(name).Add(float64(attempts - 1))
+	metrics.RetriedCalls.WithLabelValues(name, outcome).Inc()
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	if run.report.Retries == nil {
+		run.report.Retries = map[string]*RetryStats{}
+	}
+	stats := run.report.Retries[name]
+	if stats == nil {
+		stats = &RetryStats{}
+		run.report.Retries[name] = stats
+	}
+
+	stats.Retries += attempts - 1
+	if err == nil {
+		stats.Recovered++
+	} else {
+		stats.Exhausted++
+	}
+}
+
+// Finish sets the final status of the run from the error it ended with and
+// saves its report.
+func (run *Run) Finish(err error) (RunReport, error) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	finishedAt := time.Now()
+	run.report.Status = reportStatus(err, run.stopped(), len(run.report.Unfixed))
+	run.report.FinishedAt = &finishedAt
+	if err != nil {
+		run.report.Error = errorSummary(err)
+	}
+
+	return run.report, run.saveReport()
+}
+
+// errorSummary is the error a run ended with on a single line, as kept in its
+// report and in repair_runs: the number of posts left unfixed, which the
+// report lists, or the error that stopped the run.
+func errorSummary(err error) string {
+	var unfixed *UnfixedPostsError
+	if errors.As(err, &unfixed) {
+		return fmt.Sprintf("%d posts unfixed", len(unfixed.Posts))
+	}
+
+	return strings.Join(strings.Fields(err.Error()), " ")
+}
+
+// stopped is why the run itself was stopped: ErrInterrupted once Stop was
+// called, or the error of its context. Nil when it was not.
+func (run *Run) stopped() error {
+	ctx := run.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return run.Err(ctx)
+}
+
+func (run *Run) saveReport() error {
+	run.report.Redirects = run.Redirects.Len()
+	run.report.UnfixedByReason = countByReason(run.report.Unfixed)
+
+	if run.ReportFile == "" {
+		return nil
+	}
+
+	return WriteFileAtomic(run.ReportFile, run.report.write)
+}
+
+func withOptionalTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+
+	return context.WithTimeout(parent, timeout)
+}
+
+func newRunID() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+
+	return time.Now().Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+}
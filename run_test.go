@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewRunFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		table       string
+		statusCode  int
+		expectError bool
+	}{
+		{
+			name:       "Defaults",
+			env:        map[string]string{},
+			statusCode: 301,
+		},
+		{
+			name:       "Redirects table and status code",
+			env:        map[string]string{"REDIRECTS_TABLE": "public.redirects", "REDIRECT_STATUS_CODE": "308"},
+			table:      "public.redirects",
+			statusCode: 308,
+		},
+		{
+			name:        "Invalid table name",
+			env:         map[string]string{"REDIRECTS_TABLE": "redirects; DROP TABLE posts"},
+			expectError: true,
+		},
+		{
+			name:        "Status code outside 3xx",
+			env:         map[string]string{"REDIRECT_STATUS_CODE": "200"},
+			expectError: true,
+		},
+		{
+			name:        "Invalid timeout",
+			env:         map[string]string{"POST_TIMEOUT": "soon"},
+			expectError: true,
+		},
+		{
+			name:        "Unknown OS failure strategy",
+			env:         map[string]string{"OS_FAILURE_STRATEGY": "ignore"},
+			expectError: true,
+		},
+		{
+			name:        "Invalid retry attempts",
+			env:         map[string]string{"RETRY_MAX_ATTEMPTS": "0"},
+			expectError: true,
+		},
+		{
+			name:        "Negative write rate",
+			env:         map[string]string{"WRITE_DOCS_PER_SECOND": "-1"},
+			expectError: true,
+		},
+		{
+			name:        "Unknown OS concurrency control",
+			env:         map[string]string{"OS_CONCURRENCY_CONTROL": "lock"},
+			expectError: true,
+		},
+		{
+			name:        "Unknown log level",
+			env:         map[string]string{"LOG_LEVEL": "verbose"},
+			expectError: true,
+		},
+		{
+			name:        "Unknown log format",
+			env:         map[string]string{"LOG_FORMAT": "xml"},
+			expectError: true,
+		},
+		{
+			name:        "Log max size below a megabyte",
+			env:         map[string]string{"LOG_MAX_SIZE": "0"},
+			expectError: true,
+		},
+		{
+			name:        "No previous log files kept",
+			env:         map[string]string{"LOG_MAX_FILES": "0"},
+			expectError: true,
+		},
+		{
+			name:        "Unknown OS write mode",
+			env:         map[string]string{"OS_WRITE_MODE": "async"},
+			expectError: true,
+		},
+		{
+			name:        "Invalid verify writes",
+			env:         map[string]string{"VERIFY_WRITES": "sometimes"},
+			expectError: true,
+		},
+		{
+			name:        "Unknown URL collision strategy",
+			env:         map[string]string{"URL_COLLISION_STRATEGY": "overwrite"},
+			expectError: true,
+		},
+		{
+			name:        "Unknown redirect map format",
+			env:         map[string]string{"REDIRECT_MAP_FILE": "redirects.txt"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				os.Setenv(key, value)
+				defer os.Unsetenv(key)
+			}
+
+			run, err := NewRunFromEnv("fix-url")
+			if (err != nil) != tt.expectError {
+				t.Fatalf("NewRunFromEnv() error = %v, expectError %v", err, tt.expectError)
+			}
+			if tt.expectError {
+				return
+			}
+
+			if run.ID == "" || run.Command != "fix-url" {
+				t.Errorf("NewRunFromEnv() = %+v, want an ID and the command", run)
+			}
+			if run.RedirectsTable != tt.table {
+				t.Errorf("NewRunFromEnv() table = %v, want %v", run.RedirectsTable, tt.table)
+			}
+			if run.RedirectStatusCode != tt.statusCode {
+				t.Errorf("NewRunFromEnv() status code = %v, want %v", run.RedirectStatusCode, tt.statusCode)
+			}
+		})
+	}
+}
+
+func TestRunTimeouts(t *testing.T) {
+	os.Setenv("RUN_TIMEOUT", "1h")
+	os.Setenv("CALL_TIMEOUT", "0")
+	defer os.Unsetenv("RUN_TIMEOUT")
+	defer os.Unsetenv("CALL_TIMEOUT")
+
+	run, err := NewRunFromEnv("fix-url")
+	if err != nil {
+		t.Fatalf("NewRunFromEnv() error = %v", err)
+	}
+	if run.RunTimeout != time.Hour || run.PostTimeout != 0 || run.CallTimeout != 0 {
+		t.Errorf("NewRunFromEnv() timeouts = %v, %v, %v, want 1h, 0s, 0s", run.RunTimeout, run.PostTimeout, run.CallTimeout)
+	}
+
+	ctx, cancel := run.Context(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Errorf("Context() has no deadline, want RUN_TIMEOUT")
+	}
+
+	postCtx, cancelPost := run.PostContext(ctx)
+	cancelPost()
+	if postCtx.Err() == nil || ctx.Err() != nil {
+		t.Errorf("PostContext() cancel should only stop the post")
+	}
+}
+
+func TestRunStop(t *testing.T) {
+	run := NewRun("fix-url")
+	ctx := context.Background()
+
+	if err := run.Err(ctx); err != nil {
+		t.Fatalf("Err() = %v, want nil before Stop", err)
+	}
+
+	run.Stop()
+	run.Stop()
+	if err := run.Err(ctx); !errors.Is(err, ErrInterrupted) {
+		t.Errorf("Err() = %v, want ErrInterrupted after Stop", err)
+	}
+}
+
+func TestRunFinishTimeout(t *testing.T) {
+	run := NewRun("fix-url")
+	report, _ := run.Finish(fmt.Errorf("fetching posts: %w", context.DeadlineExceeded))
+	if report.Status != ReportFailed {
+		t.Errorf("Finish() status = %v after a call timeout, want %v", report.Status, ReportFailed)
+	}
+
+	run = NewRun("fix-url")
+	run.RunTimeout = time.Nanosecond
+	ctx, cancel := run.Context(context.Background())
+	defer cancel()
+	<-ctx.Done()
+	report, _ = run.Finish(runStoppedError(ctx.Err(), 1, 2))
+	if report.Status != ReportTimedOut {
+		t.Errorf("Finish() status = %v after RUN_TIMEOUT, want %v", report.Status, ReportTimedOut)
+	}
+}
+
+func TestErrorSummary(t *testing.T) {
+	unfixed := []UnfixedPosts{
+		*unfixedPost("1", ReasonAuthorNotFound, "cannot find author for this post", nil),
+		*unfixedPost("2", ReasonAuthorNotFound, "cannot find author for this post", nil),
+	}
+	if summary := errorSummary(&UnfixedPostsError{Posts: unfixed}); summary != "2 posts unfixed" {
+		t.Errorf("errorSummary() = %q for unfixed posts, want %q", summary, "2 posts unfixed")
+	}
+
+	if summary := errorSummary(runStoppedError(ErrInterrupted, 2, 5)); summary != "⛔ Run stopped after 2 of 5 posts: "+ErrInterrupted.Error() {
+		t.Errorf("errorSummary() = %q for a stopped run, want the error on one line", summary)
+	}
+}
+
+func TestRunReport(t *testing.T) {
+	run := NewRun("fix-url")
+	run.ReportFile = filepath.Join(t.TempDir(), "report.json")
+
+	unfixed := []UnfixedPosts{*unfixedPost("2", ReasonAuthorNotFound, "cannot find author for this post", nil)}
+	if err := run.Checkpoint(2, 5, "2023-01-01T10:00:00Z", unfixed); err != nil {
+		t.Fatalf("Checkpoint() error = %v", err)
+	}
+
+	run.Stop()
+	report, err := run.Finish(runStoppedError(ErrInterrupted, 2, 5))
+	if err != nil {
+		t.Fatalf("Finish() error = %v", err)
+	}
+	if report.Status != ReportInterrupted || report.FinishedAt == nil {
+		t.Errorf("Finish() status = %v, want %v with a finish time", report.Status, ReportInterrupted)
+	}
+
+	data, err := os.ReadFile(run.ReportFile)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+
+	saved := RunReport{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if saved.Processed != 2 || saved.Total != 5 || saved.Checkpoint != "2023-01-01T10:00:00Z" || saved.UnfixedByReason[ReasonAuthorNotFound] != 1 {
+		t.Errorf("saved report = %+v, want the last checkpoint", saved)
+	}
+}
+
+func TestReportStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		stopped  error
+		unfixed  int
+		expected string
+	}{
+		{name: "No error", expected: ReportCompleted},
+		{name: "Stopped", err: runStoppedError(ErrInterrupted, 1, 2), stopped: ErrInterrupted, expected: ReportInterrupted},
+		{name: "Aborted", err: runStoppedError(context.Canceled, 1, 2), stopped: context.Canceled, expected: ReportInterrupted},
+		{name: "Run timeout", err: runStoppedError(context.DeadlineExceeded, 1, 2), stopped: context.DeadlineExceeded, expected: ReportTimedOut},
+		{name: "Run timeout while fetching", err: fmt.Errorf("fetching posts: %w", context.DeadlineExceeded), stopped: context.DeadlineExceeded, expected: ReportTimedOut},
+		{name: "Call timeout", err: fmt.Errorf("fetching posts: %w", context.DeadlineExceeded), expected: ReportFailed},
+		{name: "Post timeouts", err: errors.New("few total error"), unfixed: 2, expected: ReportCompletedWithErrors},
+		{name: "Not confirmed", err: ErrNotConfirmed, expected: ReportAborted},
+		{name: "Too many changes", err: &TooManyChangesError{Posts: 10, MaxChanges: 5}, expected: ReportAborted},
+		{name: "Canary failed", err: &CanaryError{Failed: 1, Posts: 5}, expected: ReportCanaryFailed},
+		{name: "Unfixed posts", err: errors.New("few total error"), unfixed: 1, expected: ReportCompletedWithErrors},
+		{name: "Failed", err: errors.New("database error"), expected: ReportFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := reportStatus(tt.err, tt.stopped, tt.unfixed); result != tt.expected {
+				t.Errorf("reportStatus() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// minThrottleFactor is the lowest share of the configured rates a
+	// throttle slows down to under backpressure.
+	minThrottleFactor = 1.0 / 16
+	// throttleRecovery is the share of the configured rates given back
+	// after every write accepted under backpressure.
+	throttleRecovery = 0.05
+	// unlimitedBackpressureRate is the docs per second a throttle without
+	// a configured rate starts from when it gets pushed back.
+	unlimitedBackpressureRate = 100
+)
+
+// Throttle limits the writes to a store to DocsPerSecond documents and
+// RequestsPerSecond requests, zero meaning no limit. When the store pushes
+// back, the rates are halved down to minThrottleFactor of the configured ones
+// and slowly given back as writes get accepted again. It also counts the
+// documents written, for the throughput shown after every chunk.
+type Throttle struct {
+	Name              string
+	DocsPerSecond     float64
+	RequestsPerSecond float64
+
+	mu          sync.Mutex
+	docs        *rate.Limiter
+	requests    *rate.Limiter
+	factor      float64
+	windowStart time.Time
+	windowDocs  int
+}
+
+func NewThrottle(name string, docsPerSecond, requestsPerSecond float64) *Throttle {
+	return &Throttle{
+		Name:              name,
+		DocsPerSecond:     docsPerSecond,
+		RequestsPerSecond: requestsPerSecond,
+		docs:              rate.NewLimiter(rate.Inf, 0),
+		requests:          rate.NewLimiter(rate.Inf, 0),
+		factor:            1,
+		windowStart:       time.Now(),
+	}
+}
+
+// Wait blocks until a request writing docs documents is allowed, or ctx is
+// done. Bursts of up to one second worth of documents and requests go
+// through at once.
+func (throttle *Throttle) Wait(ctx context.Context, docs int) error {
+	throttle.mu.Lock()
+	docsRate, requestsRate := throttle.rates()
+	throttle.docs = setRate(throttle.docs, docsRate)
+	throttle.requests = setRate(throttle.requests, requestsRate)
+	docsLimiter, requestsLimiter := throttle.docs, throttle.requests
+	throttle.windowDocs += docs
+	throttle.mu.Unlock()
+
+	if err := requestsLimiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	// A request may write more documents than a burst holds, they are then
+	// let through a burst at a time.
+	for docs > 0 {
+		n := docs
+		if docsLimiter.Limit() != rate.Inf && n > docsLimiter.Burst() {
+			n = docsLimiter.Burst()
+		}
+		if err := docsLimiter.WaitN(ctx, n); err != nil {
+			return err
+		}
+		docs -= n
+	}
+
+	return nil
+}
+
+// setRate returns limiter set to perSecond with a burst of one second, zero
+// meaning no limit. A limiter that had no limit yet is replaced by a full one,
+// so the first burst goes through at once.
+func setRate(limiter *rate.Limiter, perSecond float64) *rate.Limiter {
+	if perSecond <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return limiter
+	}
+
+	burst := int(math.Max(1, math.Ceil(perSecond)))
+	if limiter.Limit() == rate.Inf {
+		return rate.NewLimiter(rate.Limit(perSecond), burst)
+	}
+
+	limiter.SetLimit(rate.Limit(perSecond))
+	limiter.SetBurst(burst)
+	return limiter
+}
+
+// Backoff slows the throttle down after the store pushed back.
+func (throttle *Throttle) Backoff() {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+
+	if throttle.factor <= minThrottleFactor {
+		return
+	}
+
+	throttle.factor /= 2
+	if throttle.factor < minThrottleFactor {
+		throttle.factor = minThrottleFactor
+	}
+	slog.Warn("store is pushing back, slowing writes down", "store", throttle.Name, "rate_share", throttle.factor)
+}
+
+// Recover gives back part of the rates after a write got accepted.
+func (throttle *Throttle) Recover() {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+
+	if throttle.factor >= 1 {
+		return
+	}
+
+	throttle.factor += throttleRecovery
+	if throttle.factor > 1 {
+		throttle.factor = 1
+	}
+}
+
+// Throughput returns the documents per second written since the previous
+// call, and the share of the configured rates currently allowed.
+func (throttle *Throttle) Throughput() (float64, float64) {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(throttle.windowStart).Seconds()
+	docs := throttle.windowDocs
+	throttle.windowStart = now
+	throttle.windowDocs = 0
+
+	if elapsed <= 0 {
+		return 0, throttle.factor
+	}
+
+	return float64(docs) / elapsed, throttle.factor
+}
+
+// rates are the current docs and requests rates, scaled down under
+// backpressure. A throttle without a docs rate gets one once pushed back.
+func (throttle *Throttle) rates() (float64, float64) {
+	if throttle.factor >= 1 {
+		return throttle.DocsPerSecond, throttle.RequestsPerSecond
+	}
+
+	docsRate := throttle.DocsPerSecond
+	if docsRate <= 0 {
+		docsRate = unlimitedBackpressureRate
+	}
+
+	return docsRate * throttle.factor, throttle.RequestsPerSecond * throttle.factor
+}
+
+// isBackpressure reports whether err is OpenSearch refusing more work: a 429,
+// or a bulk thread pool rejection.
+func isBackpressure(err error) bool {
+	var statusErr *OSStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+
+	return err != nil && strings.Contains(err.Error(), "rejected_execution_exception")
+}
+
+// logThroughput logs the write throughput of both stores since the
+// previous chunk.
+func logThroughput(run *Run) {
+	for _, throttle := range []*Throttle{run.DBThrottle, run.OSThrottle} {
+		docsPerSecond, factor := throttle.Throughput()
+		run.Log.Info("write throughput", "store", throttle.Name, "docs_per_second", docsPerSecond, "rate_share", factor)
+	}
+}
+
+// throttledDB holds the Postgres writes of the wrapped client to the run's
+// DBThrottle. A transaction counts as a single request writing one post.
+type throttledDB struct {
+	OneCMSDB
+	throttle *Throttle
+}
+
+// NewThrottledDB wraps onecmsDB with throttle.
+func NewThrottledDB(onecmsDB OneCMSDB, throttle *Throttle) OneCMSDB {
+	return &throttledDB{OneCMSDB: onecmsDB, throttle: throttle}
+}
+
+func (t *throttledDB) BeginTx(ctx context.Context) (*sql.Tx, error) {
+	if err := t.throttle.Wait(ctx, 1); err != nil {
+		return nil, err
+	}
+
+	return t.OneCMSDB.BeginTx(ctx)
+}
+
+func (t *throttledDB) EnqueueOSUpdate(ctx context.Context, transactionDB *sql.Tx, entry OSOutboxEntry) (int64, error) {
+	if transactionDB == nil {
+		if err := t.throttle.Wait(ctx, 1); err != nil {
+			return 0, err
+		}
+	}
+
+	return t.OneCMSDB.EnqueueOSUpdate(ctx, transactionDB, entry)
+}
+
+func (t *throttledDB) MarkOSUpdateDone(ctx context.Context, id int64) (int64, error) {
+	if err := t.throttle.Wait(ctx, 1); err != nil {
+		return 0, err
+	}
+
+	return t.OneCMSDB.MarkOSUpdateDone(ctx, id)
+}
+
+func (t *throttledDB) MarkOSUpdateFailed(ctx context.Context, id int64, lastError string, nextAttemptAt time.Time) (int64, error) {
+	if err := t.throttle.Wait(ctx, 1); err != nil {
+		return 0, err
+	}
+
+	return t.OneCMSDB.MarkOSUpdateFailed(ctx, id, lastError, nextAttemptAt)
+}
+
+// throttledOS holds the OpenSearch writes of the wrapped client to the run's
+// OSThrottle, and slows it down when OpenSearch pushes back.
+type throttledOS struct {
+	OneCMSOS
+	throttle *Throttle
+}
+
+// NewThrottledOS wraps onecmsOS with throttle.
+func NewThrottledOS(onecmsOS OneCMSOS, throttle *Throttle) OneCMSOS {
+	return &throttledOS{OneCMSOS: onecmsOS, throttle: throttle}
+}
+
+func (t *throttledOS) DynamicUpdate(ctx context.Context, data interface{}, docID, index string) error {
+	if err := t.throttle.Wait(ctx, 1); err != nil {
+		return err
+	}
+
+	err := t.OneCMSOS.DynamicUpdate(ctx, data, docID, index)
+	t.observe(err)
+
+	return err
+}
+
+func (t *throttledOS) BulkUpdate(ctx context.Context, actions []BulkUpdateAction, index string) (map[string]error, error) {
+	if err := t.throttle.Wait(ctx, len(actions)); err != nil {
+		return nil, err
+	}
+
+	itemErrors, err := t.OneCMSOS.BulkUpdate(ctx, actions, index)
+	if err != nil {
+		t.observe(err)
+		return itemErrors, err
+	}
+
+	var rejected error
+	for _, itemErr := range itemErrors {
+		if isBackpressure(itemErr) {
+			rejected = itemErr
+			break
+		}
+	}
+	t.observe(rejected)
+
+	return itemErrors, nil
+}
+
+func (t *throttledOS) observe(err error) {
+	if isBackpressure(err) {
+		t.throttle.Backoff()
+		return
+	}
+
+	if err == nil {
+		t.throttle.Recover()
+	}
+}
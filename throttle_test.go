@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestThrottleWait(t *testing.T) {
+	ctx := context.Background()
+
+	throttle := NewThrottle("Postgres", 10, 0)
+	start := time.Now()
+	if err := throttle.Wait(ctx, 10); err != nil || time.Since(start) > 50*time.Millisecond {
+		t.Errorf("Wait() first burst = %v after %v, want no wait", err, time.Since(start))
+	}
+
+	shortCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := throttle.Wait(shortCtx, 5); err == nil {
+		t.Errorf("Wait() over the burst = nil, want an error since it takes 500ms")
+	}
+
+	unlimited := NewThrottle("OpenSearch", 0, 0)
+	start = time.Now()
+	if err := unlimited.Wait(ctx, 1000); err != nil || time.Since(start) > 50*time.Millisecond {
+		t.Errorf("Wait() without a rate = %v after %v, want no wait", err, time.Since(start))
+	}
+
+	large := NewThrottle("OpenSearch", 1000, 0)
+	start = time.Now()
+	if err := large.Wait(ctx, 1100); err != nil || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Wait() above the burst = %v after %v, want a wait for the extra documents", err, time.Since(start))
+	}
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	throttle := NewThrottle("OpenSearch", 200, 0)
+
+	throttle.Backoff()
+	throttle.Backoff()
+	if docs, _ := throttle.rates(); docs != 50 {
+		t.Errorf("rates() after two backoffs = %v, want 50", docs)
+	}
+
+	for i := 0; i < 10; i++ {
+		throttle.Backoff()
+	}
+	if docs, _ := throttle.rates(); docs != 200*minThrottleFactor {
+		t.Errorf("rates() after many backoffs = %v, want %v", docs, 200*minThrottleFactor)
+	}
+
+	for i := 0; i < 40; i++ {
+		throttle.Recover()
+	}
+	if docs, _ := throttle.rates(); docs != 200 {
+		t.Errorf("rates() after recovering = %v, want 200", docs)
+	}
+}
+
+func TestThrottledOS(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Slows down on bulk rejections", func(t *testing.T) {
+		throttle := NewThrottle("OpenSearch", 0, 0)
+		mockOS := &MockOneCMSOS{
+			BulkItemErrors: map[string]error{
+				"1": &OSStatusError{StatusCode: http.StatusTooManyRequests, Message: "es_rejected_execution_exception: rejected execution"},
+			},
+		}
+
+		_, err := NewThrottledOS(mockOS, throttle).BulkUpdate(ctx, []BulkUpdateAction{{DocID: "1"}, {DocID: "2"}}, "test-index")
+		if err != nil {
+			t.Fatalf("BulkUpdate() error = %v, expected nil", err)
+		}
+
+		docsPerSecond, factor := throttle.Throughput()
+		if factor != 0.5 || docsPerSecond <= 0 {
+			t.Errorf("Throughput() = %v docs/s at %v, want documents counted and the rate halved", docsPerSecond, factor)
+		}
+	})
+
+	t.Run("Keeps the rate on other errors", func(t *testing.T) {
+		throttle := NewThrottle("OpenSearch", 0, 0)
+		mockOS := &MockOneCMSOS{DynamicUpdateErr: errors.New("document_missing_exception")}
+
+		if err := NewThrottledOS(mockOS, throttle).DynamicUpdate(ctx, nil, "1", "test-index"); err == nil {
+			t.Fatalf("DynamicUpdate() expected the error to be returned, got nil")
+		}
+
+		if _, factor := throttle.Throughput(); factor != 1 {
+			t.Errorf("Throughput() factor = %v, want 1", factor)
+		}
+	})
+}
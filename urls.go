@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ampSuffix is the path segment the frontend serves the AMP variant under.
+const ampSuffix = "/amp"
+
+// parsePostURL parses an absolute post URL or a bare path starting with "/".
+func parsePostURL(rawURL string) (*url.URL, error) {
+	if rawURL == "" {
+		return nil, errInvalidURLFormat
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Opaque != "" {
+		return nil, errInvalidURLFormat
+	}
+
+	if u.Host == "" && (u.Scheme != "" || !strings.HasPrefix(u.EscapedPath(), "/")) {
+		return nil, errInvalidURLFormat
+	}
+
+	return u, nil
+}
+
+// canonicalPath strips trailing slashes and an AMP suffix from an escaped
+// URL path, so "/a/b/", "/a/b/amp" and "/a/b/amp/" all become "/a/b". The
+// root stays "/".
+func canonicalPath(escapedPath string) string {
+	path := strings.TrimRight(escapedPath, "/")
+	if strings.HasSuffix(path, ampSuffix) {
+		path = strings.TrimRight(strings.TrimSuffix(path, ampSuffix), "/")
+	}
+
+	if path == "" {
+		return "/"
+	}
+
+	return path
+}
+
+// setEscapedPath replaces the path of u, keeping the given escaping.
+func setEscapedPath(u *url.URL, escapedPath string) error {
+	path, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		return errInvalidURLFormat
+	}
+
+	u.Path = path
+	u.RawPath = escapedPath
+
+	return nil
+}
+
+// CanonicalURL normalizes a post URL to its canonical form, without trailing
+// slash or AMP suffix. Scheme, host, query and fragment are kept.
+func CanonicalURL(rawURL string) (string, error) {
+	u, err := parsePostURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	if err := setEscapedPath(u, canonicalPath(u.EscapedPath())); err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
+
+// AMPURL derives the AMP variant of a post URL by appending the AMP suffix to
+// its canonical path. Query and fragment stay after the path, and a URL that
+// already points to the AMP variant is returned unchanged.
+func AMPURL(rawURL string) (string, error) {
+	u, err := parsePostURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	path := strings.TrimSuffix(canonicalPath(u.EscapedPath()), "/") + ampSuffix
+	if err := setEscapedPath(u, path); err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
+
+// BuildPostURL renders the URL of a post from its canonical fields: the
+// slugified title, the category path, the author key and the post key, laid
+// out with the publisher's URL schema. Scheme and host come from the stored
+// URL, or from BASE_URL_<PUBLISHER> / BASE_URL when it has none.
+func BuildPostURL(post Post, authorKey string) (string, error) {
+	schema, err := URLSchemaForPublisher(post.Publisher)
+	if err != nil {
+		return "", err
+	}
+
+	category := strings.Trim(post.CategoryPath, "/")
+	categoryPath := ""
+	if category != "" {
+		categoryPath = "/" + category
+	}
+
+	path, err := schema.Render(map[string]string{
+		"path":      categoryPath,
+		"category":  category,
+		"slug":      Slugify(post.Title),
+		"authorKey": authorKey,
+		"postKey":   post.Key,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	base, err := postBaseURL(post)
+	if err != nil {
+		return "", err
+	}
+
+	base.Path = path
+	base.RawPath = ""
+
+	return base.String(), nil
+}
+
+// DisambiguateURL appends "-n" to the slug of a post URL, laid out with the
+// publisher's URL schema, so "/title-key-1" becomes "/title-2-key-1".
+func DisambiguateURL(rawURL, publisher string, n int) (string, error) {
+	schema, err := URLSchemaForPublisher(publisher)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := parsePostURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := url.PathUnescape(canonicalPath(u.EscapedPath()))
+	if err != nil {
+		return "", errInvalidURLFormat
+	}
+
+	fields, err := schema.Parse(path)
+	if err != nil {
+		return "", err
+	}
+
+	return schema.Rewrite(rawURL, map[string]string{"slug": fields["slug"] + "-" + strconv.Itoa(n)})
+}
+
+func postBaseURL(post Post) (*url.URL, error) {
+	if stored, err := parsePostURL(post.FullURL); err == nil && stored.Host != "" {
+		return &url.URL{Scheme: stored.Scheme, User: stored.User, Host: stored.Host}, nil
+	}
+
+	baseURL := os.Getenv(publisherEnvKey("BASE_URL", post.Publisher))
+	if baseURL == "" {
+		baseURL = os.Getenv("BASE_URL")
+	}
+	if baseURL == "" {
+		return nil, errors.New("stored URL has no host and no base URL is configured")
+	}
+
+	base, err := url.Parse(baseURL)
+	if err != nil || base.Host == "" {
+		return nil, errInvalidURLFormat
+	}
+
+	return &url.URL{Scheme: base.Scheme, User: base.User, Host: base.Host}, nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFixURLPreservesURLParts(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "Trailing slash",
+			url:      "https://example.com/article-title-oldkey-12345/",
+			expected: "https://example.com/article-title-newkey-12345",
+		},
+		{
+			name:     "Query string",
+			url:      "https://example.com/article-title-oldkey-12345?utm_source=fb&utm_medium=social",
+			expected: "https://example.com/article-title-newkey-12345?utm_source=fb&utm_medium=social",
+		},
+		{
+			name:     "Fragment",
+			url:      "https://example.com/article-title-oldkey-12345#comments",
+			expected: "https://example.com/article-title-newkey-12345#comments",
+		},
+		{
+			name:     "AMP suffix",
+			url:      "https://example.com/article-title-oldkey-12345/amp",
+			expected: "https://example.com/article-title-newkey-12345",
+		},
+		{
+			name:     "AMP suffix with trailing slash and query",
+			url:      "https://example.com/article-title-oldkey-12345/amp/?utm=x",
+			expected: "https://example.com/article-title-newkey-12345?utm=x",
+		},
+		{
+			name:     "Nested path",
+			url:      "https://example.com/news/local/article-title-oldkey-12345",
+			expected: "https://example.com/news/local/article-title-newkey-12345",
+		},
+		{
+			name:     "Port and user info",
+			url:      "http://user@example.com:8080/article-title-oldkey-12345",
+			expected: "http://user@example.com:8080/article-title-newkey-12345",
+		},
+		{
+			name:     "Bare path",
+			url:      "/article-title-oldkey-12345",
+			expected: "/article-title-newkey-12345",
+		},
+		{
+			name:     "Escaped characters",
+			url:      "https://example.com/caf%C3%A9-title-oldkey-12345",
+			expected: "https://example.com/caf%C3%A9-title-newkey-12345",
+		},
+		{
+			name:        "Host only",
+			url:         "https://example.com",
+			expectError: true,
+		},
+		{
+			name:        "Host only with trailing slash",
+			url:         "https://example.com/",
+			expectError: true,
+		},
+		{
+			name:        "Relative without leading slash",
+			url:         "article-title-oldkey-12345",
+			expectError: true,
+		},
+		{
+			name:        "Opaque URL",
+			url:         "mailto:article-title-oldkey-12345",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := FixURL(tt.url, "newkey")
+			if (err != nil) != tt.expectError {
+				t.Fatalf("FixURL() error = %v, expectError %v", err, tt.expectError)
+			}
+			if result != tt.expected {
+				t.Errorf("FixURL() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCanonicalURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		expected string
+	}{
+		{
+			name:     "Already canonical",
+			url:      "https://example.com/a/b",
+			expected: "https://example.com/a/b",
+		},
+		{
+			name:     "Trailing slashes",
+			url:      "https://example.com/a/b//",
+			expected: "https://example.com/a/b",
+		},
+		{
+			name:     "AMP with query and fragment",
+			url:      "https://example.com/a/b/amp?x=1#top",
+			expected: "https://example.com/a/b?x=1#top",
+		},
+		{
+			name:     "Root AMP",
+			url:      "https://example.com/amp/",
+			expected: "https://example.com/",
+		},
+		{
+			name:     "Segment ending in amp is not the AMP suffix",
+			url:      "https://example.com/a/champ",
+			expected: "https://example.com/a/champ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := CanonicalURL(tt.url)
+			if err != nil {
+				t.Fatalf("CanonicalURL() error = %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("CanonicalURL() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAMPURL(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "Canonical URL",
+			url:      "https://example.com/a/title-key-1",
+			expected: "https://example.com/a/title-key-1/amp",
+		},
+		{
+			name:     "Trailing slash",
+			url:      "https://example.com/a/title-key-1/",
+			expected: "https://example.com/a/title-key-1/amp",
+		},
+		{
+			name:     "Already AMP",
+			url:      "https://example.com/a/title-key-1/amp",
+			expected: "https://example.com/a/title-key-1/amp",
+		},
+		{
+			name:     "Query and fragment stay after the path",
+			url:      "https://example.com/a/title-key-1?utm=x#top",
+			expected: "https://example.com/a/title-key-1/amp?utm=x#top",
+		},
+		{
+			name:        "Empty URL",
+			url:         "",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := AMPURL(tt.url)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("AMPURL() error = %v, expectError %v", err, tt.expectError)
+			}
+			if result != tt.expected {
+				t.Errorf("AMPURL() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBuildPostURL(t *testing.T) {
+	os.Setenv("URL_SCHEMA_POPMAMA", "/{category}/{slug}-{authorKey}-{postKey}")
+	os.Setenv("BASE_URL_POPMAMA", "https://www.popmama.com")
+	defer os.Unsetenv("URL_SCHEMA_POPMAMA")
+	defer os.Unsetenv("BASE_URL_POPMAMA")
+
+	tests := []struct {
+		name        string
+		post        Post
+		authorKey   string
+		expected    string
+		expectError bool
+	}{
+		{
+			name: "Default schema keeps stored host",
+			post: Post{
+				Title:        "Hello World",
+				Key:          "12345",
+				FullURL:      "https://example.com/hello-wor",
+				CategoryPath: "news",
+			},
+			authorKey: "author",
+			expected:  "https://example.com/news/hello-world-author-12345",
+		},
+		{
+			name: "Publisher schema with base URL",
+			post: Post{
+				Title:        "Hello World",
+				Key:          "12345",
+				FullURL:      "hello-world",
+				Publisher:    "popmama",
+				CategoryPath: "/parenting/baby/",
+			},
+			authorKey: "author",
+			expected:  "https://www.popmama.com/parenting/baby/hello-world-author-12345",
+		},
+		{
+			name: "Missing category for publisher schema",
+			post: Post{
+				Title:     "Hello World",
+				Key:       "12345",
+				FullURL:   "https://www.popmama.com/x",
+				Publisher: "popmama",
+			},
+			authorKey:   "author",
+			expectError: true,
+		},
+		{
+			name: "No host anywhere",
+			post: Post{
+				Title:   "Hello World",
+				Key:     "12345",
+				FullURL: "",
+			},
+			authorKey:   "author",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := BuildPostURL(tt.post, tt.authorKey)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("BuildPostURL() error = %v, expectError %v", err, tt.expectError)
+			}
+			if result != tt.expected {
+				t.Errorf("BuildPostURL() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDisambiguateURL(t *testing.T) {
+	result, err := DisambiguateURL("https://example.com/news/title-key-1/?utm=x", "", 2)
+	if err != nil {
+		t.Fatalf("DisambiguateURL() error = %v", err)
+	}
+	if result != "https://example.com/news/title-2-key-1?utm=x" {
+		t.Errorf("DisambiguateURL() = %v, want https://example.com/news/title-2-key-1?utm=x", result)
+	}
+
+	if _, err := DisambiguateURL("https://example.com", "", 2); err == nil {
+		t.Errorf("DisambiguateURL() expected error for a URL without a post path, got nil")
+	}
+}
+
+func FuzzFixURL(f *testing.F) {
+	seeds := []string{
+		"https://example.com/article-title-oldkey-12345",
+		"https://example.com/article-title-oldkey-12345/",
+		"https://example.com/article-title-oldkey-12345/amp?utm=x#top",
+		"/news/article-title-oldkey-12345",
+		"https://example.com/caf%C3%A9-oldkey-1",
+		"https://example.com",
+		"",
+	}
+	for _, seed := range seeds {
+		f.Add(seed, "newkey")
+	}
+
+	f.Fuzz(func(t *testing.T, rawURL, authorKey string) {
+		if authorKey == "" || strings.ContainsAny(authorKey, "/?#%-") {
+			t.Skip()
+		}
+
+		result, err := FixURL(rawURL, authorKey)
+		if err != nil {
+			return
+		}
+
+		original, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatalf("FixURL(%q) succeeded on an unparsable URL", rawURL)
+		}
+
+		fixed, err := url.Parse(result)
+		if err != nil {
+			t.Fatalf("FixURL(%q) = %q, which does not parse: %v", rawURL, result, err)
+		}
+
+		if fixed.Scheme != original.Scheme || fixed.Host != original.Host || fixed.RawQuery != original.RawQuery || fixed.Fragment != original.Fragment {
+			t.Errorf("FixURL(%q) = %q, changed scheme, host, query or fragment", rawURL, result)
+		}
+
+		if strings.HasSuffix(fixed.Path, "/") || strings.HasSuffix(fixed.Path, ampSuffix) {
+			t.Errorf("FixURL(%q) = %q, path is not canonical", rawURL, result)
+		}
+
+		fields, err := defaultSchema(t).Parse(fixed.Path)
+		if err != nil || fields["authorKey"] != authorKey {
+			t.Errorf("FixURL(%q) = %q, author key not replaced", rawURL, result)
+		}
+
+		again, err := FixURL(result, authorKey)
+		if err != nil || again != result {
+			t.Errorf("FixURL(%q) is not idempotent: %q then %q (%v)", rawURL, result, again, err)
+		}
+	})
+}
+
+func FuzzAMPURL(f *testing.F) {
+	seeds := []string{
+		"https://example.com/a/title-key-1",
+		"https://example.com/a/title-key-1/amp/",
+		"/a/b?x=1#y",
+		"https://example.com",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, rawURL string) {
+		ampURL, err := AMPURL(rawURL)
+		if err != nil {
+			return
+		}
+
+		again, err := AMPURL(ampURL)
+		if err != nil || again != ampURL {
+			t.Errorf("AMPURL(%q) is not idempotent: %q then %q (%v)", rawURL, ampURL, again, err)
+		}
+
+		canonical, err := CanonicalURL(ampURL)
+		if err != nil {
+			t.Fatalf("CanonicalURL(%q) error = %v", ampURL, err)
+		}
+
+		fromCanonical, err := AMPURL(canonical)
+		if err != nil || fromCanonical != ampURL {
+			t.Errorf("AMPURL(CanonicalURL(%q)) = %q, want %q (%v)", ampURL, fromCanonical, ampURL, err)
+		}
+	})
+}
+
+func defaultSchema(t *testing.T) *URLSchema {
+	t.Helper()
+
+	schema, err := ParseURLSchema(DefaultURLSchema)
+	if err != nil {
+		t.Fatalf("ParseURLSchema() error = %v", err)
+	}
+
+	return schema
+}
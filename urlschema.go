@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// DefaultURLSchema is the layout FixURL has always assumed: whatever leading
+// segments, then a last segment made of the slug, the author key and the post
+// key.
+const DefaultURLSchema = "{path}/{slug}-{authorKey}-{postKey}"
+
+var (
+	errInvalidURLFormat    = errors.New("invalid URL format")
+	errInvalidURLStructure = errors.New("invalid URL structure")
+
+	urlSchemaPlaceholder = regexp.MustCompile(`\{([A-Za-z][A-Za-z0-9_]*)(?::([^{}]+))?\}`)
+
+	urlSchemaCache   = map[string]*URLSchema{}
+	urlSchemaCacheMu sync.Mutex
+)
+
+// URLSchema describes the path layout of a post URL with named placeholders,
+// e.g. "/{category}/{slug}-{authorKey}-{postKey}". A placeholder may carry
+// its own pattern as "{postKey:[0-9]+}"; otherwise "path" matches any number
+// of leading segments (including none), "category" spans one or more
+// segments, "slug" spans one segment, and any other field is a single
+// dash-free token.
+type URLSchema struct {
+	Template string
+	fields   []string
+	pattern  *regexp.Regexp
+}
+
+func ParseURLSchema(template string) (*URLSchema, error) {
+	if !strings.HasPrefix(template, "/") && !strings.HasPrefix(template, "{path}") {
+		return nil, fmt.Errorf("URL schema %q must start with \"/\" or \"{path}\"", template)
+	}
+
+	schema := &URLSchema{Template: template}
+	seen := map[string]bool{}
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+
+	last := 0
+	for _, loc := range urlSchemaPlaceholder.FindAllStringSubmatchIndex(template, -1) {
+		pattern.WriteString(regexp.QuoteMeta(template[last:loc[0]]))
+
+		name := template[loc[2]:loc[3]]
+		if seen[name] {
+			return nil, fmt.Errorf("URL schema %q repeats field %q", template, name)
+		}
+		seen[name] = true
+		schema.fields = append(schema.fields, name)
+
+		fieldPattern := defaultFieldPattern(name)
+		if loc[4] >= 0 {
+			fieldPattern = template[loc[4]:loc[5]]
+		}
+		fmt.Fprintf(&pattern, "(?P<%s>%s)", name, fieldPattern)
+
+		last = loc[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(template[last:]))
+	pattern.WriteString("$")
+
+	if len(schema.fields) == 0 {
+		return nil, fmt.Errorf("URL schema %q has no fields", template)
+	}
+
+	compiled, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, fmt.Errorf("URL schema %q is invalid: %w", template, err)
+	}
+	schema.pattern = compiled
+
+	return schema, nil
+}
+
+func defaultFieldPattern(name string) string {
+	switch name {
+	case "path":
+		return `(?:/[^/]+)*?`
+	case "category":
+		return `[^/]+(?:/[^/]+)*?`
+	case "slug":
+		return `[^/]+`
+	default:
+		return `[^/-]+`
+	}
+}
+
+// Fields returns the placeholder names in template order.
+func (schema *URLSchema) Fields() []string {
+	return append([]string(nil), schema.fields...)
+}
+
+// Parse extracts the schema fields from a URL path.
+func (schema *URLSchema) Parse(path string) (map[string]string, error) {
+	match := schema.pattern.FindStringSubmatch(path)
+	if match == nil {
+		return nil, errInvalidURLStructure
+	}
+
+	fields := map[string]string{}
+	for i, name := range schema.pattern.SubexpNames() {
+		if name != "" {
+			fields[name] = match[i]
+		}
+	}
+
+	return fields, nil
+}
+
+// Render builds a URL path from the given fields. Every placeholder of the
+// schema must be present, and only "path" may be empty.
+func (schema *URLSchema) Render(fields map[string]string) (string, error) {
+	var missing []string
+	path := urlSchemaPlaceholder.ReplaceAllStringFunc(schema.Template, func(placeholder string) string {
+		name := urlSchemaPlaceholder.FindStringSubmatch(placeholder)[1]
+		value, ok := fields[name]
+		if !ok || (value == "" && name != "path") {
+			missing = append(missing, name)
+		}
+		return value
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing URL fields: %s", strings.Join(missing, ", "))
+	}
+
+	return path, nil
+}
+
+// Rewrite parses the canonical path of rawURL, overrides the given fields
+// and renders the URL back. Scheme, host, query and fragment are kept, while
+// a trailing slash or an AMP suffix is dropped.
+func (schema *URLSchema) Rewrite(rawURL string, changes map[string]string) (string, error) {
+	u, err := parsePostURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := url.PathUnescape(canonicalPath(u.EscapedPath()))
+	if err != nil {
+		return "", errInvalidURLFormat
+	}
+
+	fields, err := schema.Parse(path)
+	if err != nil {
+		return "", err
+	}
+
+	for name, value := range changes {
+		fields[name] = value
+	}
+
+	newPath, err := schema.Render(fields)
+	if err != nil {
+		return "", err
+	}
+
+	u.Path = newPath
+	u.RawPath = ""
+
+	return u.String(), nil
+}
+
+// URLSchemaForPublisher returns the schema configured in
+// URL_SCHEMA_<PUBLISHER>, falling back to URL_SCHEMA and then to
+// DefaultURLSchema.
+func URLSchemaForPublisher(publisher string) (*URLSchema, error) {
+	template := os.Getenv(publisherEnvKey("URL_SCHEMA", publisher))
+	if template == "" {
+		template = os.Getenv("URL_SCHEMA")
+	}
+	if template == "" {
+		template = DefaultURLSchema
+	}
+
+	urlSchemaCacheMu.Lock()
+	defer urlSchemaCacheMu.Unlock()
+
+	if schema, ok := urlSchemaCache[template]; ok {
+		return schema, nil
+	}
+
+	schema, err := ParseURLSchema(template)
+	if err != nil {
+		return nil, err
+	}
+	urlSchemaCache[template] = schema
+
+	return schema, nil
+}
+
+// publisherEnvKey builds a per-publisher variable name such as
+// URL_SCHEMA_POPMAMA.
+func publisherEnvKey(prefix, publisher string) string {
+	if publisher == "" {
+		return prefix
+	}
+
+	key := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, publisher)
+
+	return prefix + "_" + key
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseURLSchema(t *testing.T) {
+	tests := []struct {
+		name        string
+		template    string
+		fields      []string
+		expectError bool
+	}{
+		{
+			name:     "Default schema",
+			template: DefaultURLSchema,
+			fields:   []string{"path", "slug", "authorKey", "postKey"},
+		},
+		{
+			name:     "Schema with category and custom pattern",
+			template: "/{category}/{slug}-{authorKey}-{postKey:[0-9]+}",
+			fields:   []string{"category", "slug", "authorKey", "postKey"},
+		},
+		{
+			name:        "Relative schema",
+			template:    "{slug}-{postKey}",
+			expectError: true,
+		},
+		{
+			name:        "Repeated field",
+			template:    "/{slug}/{slug}",
+			expectError: true,
+		},
+		{
+			name:        "No fields",
+			template:    "/static",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := ParseURLSchema(tt.template)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("ParseURLSchema() error = %v, expectError %v", err, tt.expectError)
+			}
+			if !tt.expectError && !reflect.DeepEqual(schema.Fields(), tt.fields) {
+				t.Errorf("ParseURLSchema() fields = %v, want %v", schema.Fields(), tt.fields)
+			}
+		})
+	}
+}
+
+func TestURLSchemaParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		template    string
+		path        string
+		expected    map[string]string
+		expectError bool
+	}{
+		{
+			name:     "Default schema",
+			template: DefaultURLSchema,
+			path:     "/article-title-oldkey-12345",
+			expected: map[string]string{"path": "", "slug": "article-title", "authorKey": "oldkey", "postKey": "12345"},
+		},
+		{
+			name:     "Default schema with leading segments",
+			template: DefaultURLSchema,
+			path:     "/news/local/article-title-oldkey-12345",
+			expected: map[string]string{"path": "/news/local", "slug": "article-title", "authorKey": "oldkey", "postKey": "12345"},
+		},
+		{
+			name:     "Slug containing the author key",
+			template: DefaultURLSchema,
+			path:     "/oldkey-interview-oldkey-12345",
+			expected: map[string]string{"path": "", "slug": "oldkey-interview", "authorKey": "oldkey", "postKey": "12345"},
+		},
+		{
+			name:     "Nested category",
+			template: "/{category}/{slug}-{authorKey}-{postKey}",
+			path:     "/parenting/baby/first-steps-oldkey-12345",
+			expected: map[string]string{"category": "parenting/baby", "slug": "first-steps", "authorKey": "oldkey", "postKey": "12345"},
+		},
+		{
+			name:     "Key before slug",
+			template: "/{category}/{postKey}/{slug}",
+			path:     "/news/12345/some-title",
+			expected: map[string]string{"category": "news", "postKey": "12345", "slug": "some-title"},
+		},
+		{
+			name:        "Too few tokens",
+			template:    DefaultURLSchema,
+			path:        "/title",
+			expectError: true,
+		},
+		{
+			name:        "Custom pattern rejects value",
+			template:    "/{slug}-{postKey:[0-9]+}",
+			path:        "/title-abc",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := ParseURLSchema(tt.template)
+			if err != nil {
+				t.Fatalf("ParseURLSchema() error = %v", err)
+			}
+
+			fields, err := schema.Parse(tt.path)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("Parse() error = %v, expectError %v", err, tt.expectError)
+			}
+			if !tt.expectError && !reflect.DeepEqual(fields, tt.expected) {
+				t.Errorf("Parse() = %v, want %v", fields, tt.expected)
+			}
+		})
+	}
+}
+
+func TestURLSchemaRender(t *testing.T) {
+	schema, err := ParseURLSchema("/{category}/{slug}-{authorKey}-{postKey}")
+	if err != nil {
+		t.Fatalf("ParseURLSchema() error = %v", err)
+	}
+
+	path, err := schema.Render(map[string]string{"category": "news", "slug": "title", "authorKey": "key", "postKey": "1"})
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	if path != "/news/title-key-1" {
+		t.Errorf("Render() = %v, want /news/title-key-1", path)
+	}
+
+	if _, err := schema.Render(map[string]string{"slug": "title"}); err == nil {
+		t.Errorf("Render() expected error for missing fields, got nil")
+	}
+}
+
+func TestURLSchemaRewrite(t *testing.T) {
+	schema, err := ParseURLSchema("/{category}/{slug}-{authorKey}-{postKey}")
+	if err != nil {
+		t.Fatalf("ParseURLSchema() error = %v", err)
+	}
+
+	result, err := schema.Rewrite("https://example.com/news/local/title-oldkey-1", map[string]string{"authorKey": "newkey"})
+	if err != nil {
+		t.Fatalf("Rewrite() error = %v", err)
+	}
+	if result != "https://example.com/news/local/title-newkey-1" {
+		t.Errorf("Rewrite() = %v, want https://example.com/news/local/title-newkey-1", result)
+	}
+}
+
+func TestURLSchemaForPublisher(t *testing.T) {
+	os.Setenv("URL_SCHEMA_POPMAMA", "/{category}/{slug}-{authorKey}-{postKey}")
+	defer os.Unsetenv("URL_SCHEMA_POPMAMA")
+
+	schema, err := URLSchemaForPublisher("popmama")
+	if err != nil {
+		t.Fatalf("URLSchemaForPublisher() error = %v", err)
+	}
+	if schema.Template != "/{category}/{slug}-{authorKey}-{postKey}" {
+		t.Errorf("URLSchemaForPublisher() template = %v, want publisher schema", schema.Template)
+	}
+
+	schema, err = URLSchemaForPublisher("idntimes")
+	if err != nil {
+		t.Fatalf("URLSchemaForPublisher() error = %v", err)
+	}
+	if schema.Template != DefaultURLSchema {
+		t.Errorf("URLSchemaForPublisher() template = %v, want default schema", schema.Template)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+)
+
+// PostState is the state a repair meant to leave a post in, checked by
+// verifyPosts. OldID is only set for posts known by their old ID. AuthorIDs
+// are the post_authors of the post in order, and Authors the authors its
+// document must list. Nil leaves them unchecked.
+type PostState struct {
+	ID        string
+	OldID     string
+	FullURL   string
+	AuthorIDs []string
+	Authors   []AuthorOS
+}
+
+// CanaryError is returned by a run whose canary posts did not all land as
+// intended. The remaining posts are left untouched.
+type CanaryError struct {
+	Failed int
+	Posts  int
+}
+
+func (e *CanaryError) Error() string {
+	return fmt.Sprintf("canary failed: %d of %d posts did not land as intended, the remaining posts were left untouched", e.Failed, e.Posts)
+}
+
+// canarySplit takes the canary posts of the run out of posts: the first
+// run.Canary ones, or as many picked at random with run.CanaryRandom. The
+// rest keep their order.
+func canarySplit[T any](run *Run, posts []T) ([]T, []T) {
+	if run.Canary <= 0 {
+		return nil, posts
+	}
+	if run.Canary >= len(posts) {
+		return posts, nil
+	}
+
+	picked := map[int]bool{}
+	if run.CanaryRandom {
+		for _, i := range rand.Perm(len(posts))[:run.Canary] {
+			picked[i] = true
+		}
+	} else {
+		for i := 0; i < run.Canary; i++ {
+			picked[i] = true
+		}
+	}
+
+	canary := []T{}
+	rest := []T{}
+	for i, post := range posts {
+		if picked[i] {
+			canary = append(canary, post)
+		} else {
+			rest = append(rest, post)
+		}
+	}
+
+	return canary, rest
+}
+
+// withCanary puts the canary posts in a chunk of their own, ahead of the
+// chunks of the other posts.
+func withCanary[T any](canary []T, chunks [][]T) [][]T {
+	if len(canary) == 0 {
+		return chunks
+	}
+
+	return append([][]T{canary}, chunks...)
+}
+
+// verifyPosts re-reads the posts from Postgres and, when the run writes
+// inline, from OpenSearch, and returns the posts either store disagrees with
+// their intended state on.
+func verifyPosts(ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, states []PostState, osIndex string) ([]UnfixedPosts, error) {
+	unfixedPosts := []UnfixedPosts{}
+	if len(states) == 0 {
+		return unfixedPosts, nil
+	}
+
+	ids := []string{}
+	for _, state := range states {
+		ids = append(ids, state.ID)
+	}
+
+	posts, err := onecmsDB.GetPostsByIDs(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed re-reading posts from Postgres: %w", err)
+	}
+	stored := map[string]Post{}
+	for _, post := range posts {
+		stored[post.ID] = post
+	}
+
+	var authorIDs map[string][]string
+	for _, state := range states {
+		if state.AuthorIDs != nil {
+			authorIDs, err = onecmsDB.GetPostsAuthorIDs(ctx, ids)
+			if err != nil {
+				return nil, fmt.Errorf("failed re-reading post authors from Postgres: %w", err)
+			}
+			break
+		}
+	}
+
+	// Outbox updates reach OpenSearch later, through drain-outbox.
+	var documents map[string]PostDocument
+	if run.OSWriteMode == OSWriteInline {
+		documents, err = onecmsOS.GetPostDocuments(ctx, ids, osIndex)
+		if err != nil {
+			return nil, fmt.Errorf("failed re-reading posts from OpenSearch: %w", err)
+		}
+	}
+
+	for _, state := range states {
+		problems := []string{}
+
+		if post, ok := stored[state.ID]; !ok {
+			problems = append(problems, "post not found in Postgres")
+		} else if post.FullURL != state.FullURL {
+			problems = append(problems, fmt.Sprintf("Postgres full_url is %q, want %q", post.FullURL, state.FullURL))
+		}
+		if state.AuthorIDs != nil && !slices.Equal(authorIDs[state.ID], state.AuthorIDs) {
+			problems = append(problems, fmt.Sprintf("Postgres post_authors are %v, want %v", authorIDs[state.ID], state.AuthorIDs))
+		}
+
+		if documents != nil {
+			problems = append(problems, documentProblems(documents, state)...)
+		}
+
+		if len(problems) > 0 {
+			unfixed := unfixedPost(state.ID, ReasonVerificationFailed, "post did not land as intended: "+strings.Join(problems, ", "), nil)
+			unfixed.OldID = state.OldID
+			unfixedPosts = append(unfixedPosts, *unfixed)
+		}
+	}
+
+	return unfixedPosts, nil
+}
+
+// documentProblems lists how the OpenSearch document of a post differs from
+// its intended state.
+func documentProblems(documents map[string]PostDocument, state PostState) []string {
+	document, ok := documents[state.ID]
+	if !ok {
+		return []string{"document not found in OpenSearch"}
+	}
+
+	problems := []string{}
+	if document.ArticleURL != state.FullURL {
+		problems = append(problems, fmt.Sprintf("OpenSearch article_url is %q, want %q", document.ArticleURL, state.FullURL))
+	}
+	if ampURL, err := AMPURL(state.FullURL); err == nil && document.ArticleURLAMP != ampURL {
+		problems = append(problems, fmt.Sprintf("OpenSearch article_url_amp is %q, want %q", document.ArticleURLAMP, ampURL))
+	}
+	for _, author := range state.Authors {
+		if !slices.Contains(document.Authors, author) {
+			problems = append(problems, fmt.Sprintf("OpenSearch authors do not list %s (%s) as intended", author.Name, author.UUID))
+		}
+	}
+
+	return problems
+}
+
+// verifyChunk verifies the posts repaired by a chunk when the run has
+// VerifyWrites, and returns the posts that did not land as intended. When the
+// posts cannot be read back, they are all returned, since none of them is
+// known to have landed.
+func verifyChunk(ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, states []PostState, osIndex string) []UnfixedPosts {
+	if !run.VerifyWrites || len(states) == 0 {
+		return nil
+	}
+
+	failed, err := verifyPosts(ctx, run, onecmsDB, onecmsOS, states, osIndex)
+	if err != nil {
+		run.Log.Error("failed verifying chunk", "stage", StageVerify, "posts", len(states), "error", err.Error())
+		failed = []UnfixedPosts{}
+		for _, state := range states {
+			unfixed := unfixedPost(state.ID, ReasonVerificationFailed, "could not verify this post", err)
+			unfixed.OldID = state.OldID
+			failed = append(failed, *unfixed)
+		}
+	}
+	for _, unfixed := range failed {
+		logUnfixed(run, unfixed)
+	}
+	run.Log.Info("verified chunk", "stage", StageVerify, "verified", len(states), "failed", len(failed))
+
+	return failed
+}
+
+// checkCanary verifies the posts repaired by the canary chunk, then shows the
+// impact of the remaining posts to the run's Confirm. unfixed are the canary
+// posts the repair itself left unfixed. It returns the posts that did not land
+// as intended, with a *CanaryError when any canary post failed.
+func checkCanary(ctx context.Context, run *Run, onecmsDB OneCMSDB, onecmsOS OneCMSOS, states []PostState, unfixed []UnfixedPosts, canaryPosts int, remaining Impact, osIndex string) ([]UnfixedPosts, error) {
+	failed, err := verifyPosts(ctx, run, onecmsDB, onecmsOS, states, osIndex)
+	if err != nil {
+		return nil, err
+	}
+	for _, unfixed := range failed {
+		logUnfixed(run, unfixed)
+	}
+	if len(unfixed)+len(failed) > 0 {
+		return failed, &CanaryError{Failed: len(unfixed) + len(failed), Posts: canaryPosts}
+	}
+
+	run.Log.Info("canary passed", "stage", StageVerify, "verified", len(states), "canary_posts", canaryPosts, "remaining", remaining.Posts)
+	if remaining.Posts == 0 || run.Confirm == nil {
+		return failed, nil
+	}
+	if !run.Confirm(remaining) {
+		return failed, ErrNotConfirmed
+	}
+
+	return failed, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCanarySplit(t *testing.T) {
+	posts := []int{1, 2, 3, 4, 5}
+
+	run := NewRun("fix-url")
+	canary, rest := canarySplit(run, posts)
+	if canary != nil || !reflect.DeepEqual(rest, posts) {
+		t.Errorf("canarySplit() = %v, %v without canary, want every post left", canary, rest)
+	}
+
+	run.Canary = 2
+	canary, rest = canarySplit(run, posts)
+	if !reflect.DeepEqual(canary, []int{1, 2}) || !reflect.DeepEqual(rest, []int{3, 4, 5}) {
+		t.Errorf("canarySplit() = %v, %v, want the first 2 posts as canary", canary, rest)
+	}
+
+	run.CanaryRandom = true
+	canary, rest = canarySplit(run, posts)
+	if len(canary) != 2 || len(rest) != 3 {
+		t.Fatalf("canarySplit() = %v, %v, want 2 random posts as canary", canary, rest)
+	}
+	for i := 1; i < len(rest); i++ {
+		if rest[i] < rest[i-1] {
+			t.Errorf("canarySplit() left %v out of order", rest)
+		}
+	}
+
+	run.Canary = 10
+	canary, rest = canarySplit(run, posts)
+	if len(canary) != 5 || len(rest) != 0 {
+		t.Errorf("canarySplit() = %v, %v, want every post as canary", canary, rest)
+	}
+}
+
+func TestVerifyPosts(t *testing.T) {
+	mockDB := &MockOneCMSDB{
+		UpdatedURLs: map[string]string{
+			"1": "https://example.com/a-newkey-1",
+			"2": "https://example.com/b-oldkey-2",
+		},
+	}
+	mockOS := &MockOneCMSOS{
+		Documents: map[string]PostDocument{
+			"1": {ArticleURL: "https://example.com/a-newkey-1", ArticleURLAMP: "https://example.com/a-newkey-1/amp"},
+			"2": {ArticleURL: "https://example.com/b-newkey-2", ArticleURLAMP: "https://example.com/b-newkey-2/amp"},
+		},
+	}
+	states := []PostState{
+		{ID: "1", FullURL: "https://example.com/a-newkey-1"},
+		{ID: "2", FullURL: "https://example.com/b-newkey-2"},
+		{ID: "3", OldID: "old-3", FullURL: "https://example.com/c-newkey-3"},
+	}
+
+	run := NewRun("fix-url")
+	unfixed, err := verifyPosts(context.Background(), run, mockDB, mockOS, states, "test-index")
+	if err != nil {
+		t.Fatalf("verifyPosts() error = %v", err)
+	}
+	if len(unfixed) != 2 || unfixed[0].ID != "2" || unfixed[1].ID != "3" || unfixed[1].OldID != "old-3" {
+		t.Fatalf("verifyPosts() = %+v, want posts 2 and 3", unfixed)
+	}
+	if !strings.Contains(unfixed[0].Error, "Postgres full_url") || strings.Contains(unfixed[0].Error, "OpenSearch") {
+		t.Errorf("verifyPosts() error = %q, want only the Postgres URL", unfixed[0].Error)
+	}
+	if !strings.Contains(unfixed[1].Error, "not found in Postgres") || !strings.Contains(unfixed[1].Error, "not found in OpenSearch") {
+		t.Errorf("verifyPosts() error = %q, want the post missing from both stores", unfixed[1].Error)
+	}
+
+	// Outbox updates are not in OpenSearch yet.
+	run.OSWriteMode = OSWriteOutbox
+	mockOS.Documents = nil
+	unfixed, _ = verifyPosts(context.Background(), run, mockDB, mockOS, states[:1], "test-index")
+	if len(unfixed) != 0 {
+		t.Errorf("verifyPosts() = %+v with outbox writes, want OpenSearch left unchecked", unfixed)
+	}
+}
+
+func TestVerifyPostAuthors(t *testing.T) {
+	author := AuthorOS{UUID: "author-1", Name: "Author", Key: "newkey"}
+	mockDB := &MockOneCMSDB{
+		Post:          &Post{ID: "1", FullURL: "https://example.com/a-newkey-1"},
+		PostAuthorIDs: []string{"oldkey"},
+	}
+	mockOS := &MockOneCMSOS{
+		Documents: map[string]PostDocument{
+			"1": {ArticleURL: "https://example.com/a-newkey-1", ArticleURLAMP: "https://example.com/a-newkey-1/amp", Authors: []AuthorOS{{UUID: "author-2"}}},
+		},
+	}
+	states := []PostState{
+		{ID: "1", FullURL: "https://example.com/a-newkey-1", AuthorIDs: []string{"newkey"}, Authors: []AuthorOS{author}},
+	}
+
+	run := NewRun("fix-csc-popmama")
+	if unfixed := verifyChunk(context.Background(), run, mockDB, mockOS, states, "test-index"); unfixed != nil {
+		t.Errorf("verifyChunk() = %+v without VerifyWrites, want nothing verified", unfixed)
+	}
+
+	run.VerifyWrites = true
+	unfixed := verifyChunk(context.Background(), run, mockDB, mockOS, states, "test-index")
+	if len(unfixed) != 1 {
+		t.Fatalf("verifyChunk() = %+v, want post 1", unfixed)
+	}
+	if !strings.Contains(unfixed[0].Error, "post_authors are [oldkey]") || !strings.Contains(unfixed[0].Error, "authors do not list Author") {
+		t.Errorf("verifyChunk() error = %q, want both stores disagreeing on the authors", unfixed[0].Error)
+	}
+
+	mockDB.PostAuthorIDs = []string{"newkey"}
+	mockOS.Documents["1"] = PostDocument{ArticleURL: "https://example.com/a-newkey-1", ArticleURLAMP: "https://example.com/a-newkey-1/amp", Authors: []AuthorOS{author}}
+	if unfixed := verifyChunk(context.Background(), run, mockDB, mockOS, states, "test-index"); len(unfixed) != 0 {
+		t.Errorf("verifyChunk() = %+v, want the post verified", unfixed)
+	}
+}
+
+func TestVerifyChunkReadFailure(t *testing.T) {
+	mockDB := &MockOneCMSDB{GetPostsByIDsErr: errors.New("connection reset")}
+	states := []PostState{
+		{ID: "1", FullURL: "https://example.com/a-newkey-1"},
+		{ID: "2", OldID: "old-2", FullURL: "https://example.com/b-newkey-2"},
+	}
+
+	run := NewRun("fix-url")
+	run.VerifyWrites = true
+	unfixed := verifyChunk(context.Background(), run, mockDB, &MockOneCMSOS{}, states, "test-index")
+	if len(unfixed) != 2 || unfixed[1].OldID != "old-2" {
+		t.Fatalf("verifyChunk() = %+v, want both posts unfixed", unfixed)
+	}
+	for _, post := range unfixed {
+		if post.Reason != ReasonVerificationFailed || !strings.Contains(post.Error, "connection reset") {
+			t.Errorf("verifyChunk() = %+v, want the post unfixed by the failed verification", post)
+		}
+	}
+}